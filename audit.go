@@ -0,0 +1,111 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// The operations recorded in the audit log
+const (
+	auditCreateDeployKey   = "create_deploy_key"
+	auditUpdateDeployKey   = "update_deploy_key"
+	auditDeleteDeployKey   = "delete_deploy_key"
+	auditCreateDeployToken = "create_deploy_token"
+	auditDeleteDeployToken = "delete_deploy_token"
+)
+
+// auditStdoutMarker prefixes the audit records written to stdout, to tell
+// them apart from the rest of the output
+const auditStdoutMarker = "AUDIT "
+
+// auditRecord is the audit log line of a successful gitlab mutation
+type auditRecord struct {
+	Time      string `json:"time"`
+	Actor     string `json:"actor"`
+	Operation string `json:"operation"`
+	Project   string `json:"project"`
+	ID        int    `json:"id"`
+	Title     string `json:"title,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+}
+
+// auditLog writes the audit records, one JSON object per line, to the
+// -audit-log-path destination. It discards them when there's none.
+type auditLog struct {
+	mu     sync.Mutex
+	out    io.Writer
+	prefix string
+}
+
+// audit is the audit log of the controller, set up by main
+var audit = &auditLog{}
+
+// open sets the destination of the audit log: "-" for stdout, where every
+// record is prefixed with auditStdoutMarker, or the path of a file the
+// records are appended to
+func (a *auditLog) open(path string) error {
+	if path == "-" {
+		a.out, a.prefix = os.Stdout, auditStdoutMarker
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	a.out = f
+	return nil
+}
+
+// record writes the audit record of operation on the deploy key or token id
+// of project, made for secret. Failing to write it doesn't fail the sync,
+// as the mutation already happened.
+func (a *auditLog) record(operation, project string, id int, title string, secret *corev1.Secret) {
+	if a.out == nil {
+		return
+	}
+	r := auditRecord{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Actor:     controllerAgentName,
+		Operation: operation,
+		Project:   project,
+		ID:        id,
+		Title:     title,
+	}
+	if secret != nil {
+		r.Secret = secret.Namespace + "/" + secret.Name
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to encode the audit record of %s %d: %s", operation, id, err.Error()))
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := fmt.Fprintf(a.out, "%s%s\n", a.prefix, line); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to write the audit record of %s %d: %s", operation, id, err.Error()))
+	}
+}
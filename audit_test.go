@@ -0,0 +1,77 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a := &auditLog{}
+	a.record(auditCreateDeployKey, "group/app", 1, "flux", nil)
+	if err := a.open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer a.out.(*os.File).Close()
+	a.record(auditDeleteDeployKey, "group/app", 2, "", fluxSecret())
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("audit log = %q, want only the record made once opened", data)
+	}
+	var r auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Operation != auditDeleteDeployKey || r.Project != "group/app" || r.ID != 2 || r.Secret != "flux/flux-git-deploy" || r.Actor != controllerAgentName {
+		t.Errorf("audit record = %+v", r)
+	}
+}
+
+func TestSyncAudit(t *testing.T) {
+	defer func(a *auditLog) { audit = a }(audit)
+	var out bytes.Buffer
+	audit = &auditLog{out: &out, prefix: auditStdoutMarker}
+
+	secret := identitySecret(t)
+	s := newTestSync(t, newFakeGitlab(), secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	var r auditRecord
+	if !strings.HasPrefix(out.String(), auditStdoutMarker) {
+		t.Fatalf("audit log = %q, want a marked record", out.String())
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(out.String(), auditStdoutMarker)), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Operation != auditCreateDeployKey || r.ID != 1 {
+		t.Errorf("audit record = %+v, want the creation of deploy key 1", r)
+	}
+}
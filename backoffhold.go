@@ -0,0 +1,66 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// backoffHolds holds, by namespace/name, the Secrets waiting out the backoff
+// of a failed sync. The retry is already scheduled, so neither a resync nor
+// another update of the Secret syncs it again before the backoff is over.
+type backoffHolds struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// hold holds the Secret for after
+func (h *backoffHolds) hold(object metav1.Object, after time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.until == nil {
+		h.until = map[string]time.Time{}
+	}
+	h.until[object.GetNamespace()+"/"+object.GetName()] = time.Now().Add(after)
+}
+
+// remaining returns how long the Secret is still held. It reports false once
+// the backoff is over, forgetting it.
+func (h *backoffHolds) remaining(object metav1.Object) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := object.GetNamespace() + "/" + object.GetName()
+	until, ok := h.until[key]
+	if !ok {
+		return 0, false
+	}
+	if after := time.Until(until); after > 0 {
+		return after, true
+	}
+	delete(h.until, key)
+	return 0, false
+}
+
+// release forgets the backoff of the Secret once its sync succeeded
+func (h *backoffHolds) release(object metav1.Object) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.until, object.GetNamespace()+"/"+object.GetName())
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// redacted replaces the sensitive values in the effective configuration
+const redacted = "<redacted>"
+
+// sensitiveFlags are the flags whose values are redacted from the effective
+// configuration
+var sensitiveFlags = map[string]bool{
+	"gitlab-token":    true,
+	"reconcile-token": true,
+}
+
+// effectiveConfig returns the value of every flag once the flags, the
+// environment and the token file were read, with the tokens and the
+// -gitlab-header values redacted
+func effectiveConfig() map[string]string {
+	config := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = redactedValue(f.Name, f.Value.String())
+	})
+	return config
+}
+
+// redactedValue returns the value of the flag with anything sensitive
+// replaced
+func redactedValue(name, value string) string {
+	if value == "" {
+		return value
+	}
+	switch {
+	case sensitiveFlags[name]:
+		return redacted
+	case name == "gitlab-header":
+		// Headers often carry credentials of an authenticating proxy, only
+		// their names are kept
+		headers := strings.Split(value, ",")
+		for i, header := range headers {
+			headers[i] = strings.SplitN(header, "=", 2)[0] + "=" + redacted
+		}
+		return strings.Join(headers, ",")
+	}
+	return value
+}
+
+// logEffectiveConfig logs the effective configuration as JSON
+func logEffectiveConfig() {
+	config, err := json.Marshal(effectiveConfig())
+	if err != nil {
+		klog.Warningf("Failed to marshal the effective configuration: %s", err.Error())
+		return
+	}
+	klog.Infof("Effective configuration: %s", config)
+}
+
+// configHandler serves the effective configuration as JSON
+func configHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(effectiveConfig())
+	})
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedactedValue(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"gitlab-token", "secret", redacted},
+		{"reconcile-token", "secret", redacted},
+		{"gitlab-token", "", ""},
+		{"gitlab-header", "X-Proxy-Token=secret,X-Tenant=a=b", "X-Proxy-Token=" + redacted + ",X-Tenant=" + redacted},
+		{"workers", "2", "2"},
+	}
+	for _, test := range tests {
+		if got := redactedValue(test.name, test.value); got != test.want {
+			t.Errorf("redactedValue(%s, %q) = %q, want %q", test.name, test.value, got, test.want)
+		}
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	defer flag.Set("gitlab-token", gitlabToken)
+	if err := flag.Set("gitlab-token", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	configHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	var config map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["gitlab-token"] != redacted || config["workers"] != flag.Lookup("workers").Value.String() {
+		t.Errorf("config = %v, want every flag with the token redacted", config)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+}
@@ -17,11 +17,21 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/rsa"
+	"encoding/json"
+	goerrors "errors"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"path"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xanzy/go-gitlab"
@@ -30,8 +40,11 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	v1 "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -39,18 +52,78 @@ import (
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
 )
 
 const controllerAgentName = "flux-gitlab-controller"
 
+// errMissingIdentity is returned when a Secret has none of the identity keys
+var errMissingIdentity = fmt.Errorf("secret has none of the identity keys")
+
+// errDeployKeyNotFound is returned when no deploy key of a project has the
+// fingerprint looked for
+var errDeployKeyNotFound = fmt.Errorf("no deploy key has the fingerprint")
+
+// authErrorBackoff is how long a Secret waits before being retried after the
+// gitlab API rejected the controller token
+const authErrorBackoff = 5 * time.Minute
+
+// rateLimitBackoff is how long a rate limited Secret waits before being
+// retried when gitlab doesn't say when to retry
+const rateLimitBackoff = time.Minute
+
 const (
 
 	// deployKeyLabelName is the label used to update the secret with the gitlab
 	// deploy key id
 	deployKeyLabelName = "fluxcd.io/deployKeyId"
 
+	// deployKeyFingerprintLabelName is the label used to record the
+	// fingerprint of the deploy key created for the secret
+	deployKeyFingerprintLabelName = "fluxcd.io/deployKeyFingerprint"
+
+	// createdTitleLabelName is the label used to record the title of the
+	// deploy key created for the secret
+	createdTitleLabelName = "fluxcd.io/deployKeyTitle"
+
+	// createdAtLabelName is the label used to record when the deploy key was
+	// created for the secret
+	createdAtLabelName = "fluxcd.io/deployKeyCreatedAt"
+
+	// keySequenceLabelName is the label used to record how many times the
+	// deploy key of the secret was rotated, the title of its key ending
+	// with that sequence number
+	keySequenceLabelName = "fluxcd.io/deployKeySequence"
+
+	// retiredKeyLabelName is the label used to record the id of the deploy
+	// key a -max-key-age rotation replaced until it's deleted
+	retiredKeyLabelName = "fluxcd.io/retiredDeployKeyId"
+
+	// deployKeyMissingLabelName is the label used to record the id of a
+	// deploy key found missing in gitlab while recreation is disabled. The
+	// key is recreated once it's removed.
+	deployKeyMissingLabelName = "fluxcd.io/deployKeyMissing"
+
+	// deployKeyPinnedLabelName is the label used to pin the deploy key id of
+	// the secret so it's never rotated or recreated, only deleted
+	deployKeyPinnedLabelName = "fluxcd.io/deployKeyId-pinned"
+
+	// suspendLabelName is the label used to suspend the deploy key of the
+	// secret: it's deleted from gitlab and only created again once the
+	// label is removed
+	suspendLabelName = "fluxcd.io/suspend"
+
+	// projectIdLabelName is the label used to record the gitlab project id
+	// resolved on the first reconcile so later calls skip the lookup by path
+	projectIdLabelName = "fluxcd.io/gitlab-project-id"
+
+	// projectPathLabelName is the label used to record the path of the
+	// gitlab project the deploy key was created in
+	projectPathLabelName = "fluxcd.io/gitlab-project-path"
+
 	// gitUrlLabelName is the label used to retrieve the gitlab project url used to
 	// add the deployment key to
 	fluxSecretLabelFilter = "fluxcd.io/sync-gc-mark"
@@ -59,20 +132,288 @@ const (
 	// add the deployment key to
 	gitUrlLabelName = "fluxcd.io/git-url"
 
+	// deployKeyTitleLabelName is the label used to retrieve the title of the
+	// deploy key
+	deployKeyTitleLabelName = "fluxcd.io/deploy-key-title"
+
+	// deployKeyCanPushLabelName is the label used to retrieve whether the
+	// deploy key can push to the project
+	deployKeyCanPushLabelName = "fluxcd.io/deploy-key-can-push"
+
+	// pushRequiredLabelName is the label used to require a deploy key that
+	// can push, e.g. for image update automation. The key isn't created
+	// rather than being created read-only when push keys are disallowed.
+	pushRequiredLabelName = "fluxcd.io/push-required"
+
+	// mirrorLabelName is the label used to mark the project as a pull mirror,
+	// whose deploy key can't push. The controller sets it on the secrets of
+	// the projects gitlab reports as mirrors.
+	mirrorLabelName = "fluxcd.io/mirror"
+
+	// archivedLabelName is the label used to mark the project as archived,
+	// whose deploy key can't push. The controller sets it on the secrets of
+	// the projects gitlab reports as archived.
+	archivedLabelName = "fluxcd.io/archived"
+
+	// sourceKindLabelName is the label used to retrieve the kind of flux
+	// source using the secret, which is added to the deploy key title
+	sourceKindLabelName = "fluxcd.io/source-kind"
+
+	// maxDeployKeyTitleLength is the longest title gitlab accepts for a
+	// deploy key
+	maxDeployKeyTitleLength = 255
+
+	// defaultDeployKeyTitle is the deploy key title used when the secret
+	// doesn't set one
+	defaultDeployKeyTitle = "Flux deployment key"
+
+	// requestTimeoutLabelName is the label used to override the timeout of the
+	// gitlab calls made for a secret
+	requestTimeoutLabelName = "fluxcd.io/request-timeout"
+
+	// providerLabelName is the label used to retrieve the git provider of
+	// the secret, which defaults to -provider. The controller only handles
+	// the gitlab secrets, leaving the others to the controllers of their
+	// provider.
+	providerLabelName = "fluxcd.io/provider"
+
+	// gitlabProvider is the provider the controller handles
+	gitlabProvider = "gitlab"
+
 	// SuccessSynced is used as part of the Event 'reason' when a Secret is synced
 	SuccessSynced = "Synced"
+	// SuccessUpdated is used as part of the Event 'reason' when the deploy key
+	// of a Secret is updated to match it
+	SuccessUpdated = "Updated"
+	// ReadOnlyMirror is used as part of the Event 'reason' when a push key was
+	// asked for a pull mirror project and a read-only key is created instead
+	ReadOnlyMirror = "ReadOnlyMirror"
+	// ReadOnlyArchived is used as part of the Event 'reason' when a push key
+	// was asked for an archived project and a read-only key is created
+	// instead
+	ReadOnlyArchived = "ReadOnlyArchived"
+	// PushPolicyDenied is used as part of the Event 'reason' when a push key
+	// was asked for a project outside of the -push-policy and a read-only key
+	// is created instead
+	PushPolicyDenied = "PushPolicyDenied"
+	// ProjectNotAllowed is used as part of the Event 'reason' when a Secret's
+	// project isn't in the project allowlist
+	ProjectNotAllowed = "ProjectNotAllowed"
+	// DeployKeyMissing is used as part of the Event 'reason' when verify mode
+	// finds the deploy key of a Secret deleted and recreation is disabled
+	DeployKeyMissing = "DeployKeyMissing"
+	// IdentityRotated is used as part of the Event 'reason' when the deploy
+	// key of a Secret is replaced because its identity changed
+	IdentityRotated = "IdentityRotated"
+	// ReconcileTimeout is used as part of the Event 'reason' when the sync of
+	// a Secret outlasts -reconcile-timeout
+	ReconcileTimeout = "ReconcileTimeout"
+	// ReconcileDeadLettered is used as part of the Event 'reason' when a
+	// Secret isn't retried anymore after timing out too many times
+	ReconcileDeadLettered = "ReconcileDeadLettered"
+	// KeyAgeRotated is used as part of the Event 'reason' when the deploy
+	// key of a Secret is replaced because it's older than -max-key-age
+	KeyAgeRotated = "KeyAgeRotated"
+	// IdentityReplaced is used as part of the Event 'reason' when the
+	// private key of a Secret is replaced by a -max-key-age rotation
+	IdentityReplaced = "IdentityReplaced"
+	// DeployKeySuspended is used as part of the Event 'reason' when the
+	// deploy key of a suspended Secret is deleted
+	DeployKeySuspended = "DeployKeySuspended"
+	// PushProtected is used as part of the Event 'reason' when a push key
+	// was created but the project's default branch doesn't let it push
+	PushProtected = "PushProtected"
+	// DeployKeyAdopted is used as part of the Event 'reason' when the key of
+	// a Secret already was a deploy key of the project and is adopted
+	DeployKeyAdopted = "DeployKeyAdopted"
+	// DeployKeyRenamed is used as part of the Event 'reason' when the key of
+	// a Secret deleted within -delete-grace-period is adopted by a Secret
+	// recreated under another name with the same identity
+	DeployKeyRenamed = "DeployKeyRenamed"
+	// AdoptedPushMismatch is used as part of the Event 'reason' when the push
+	// permission of an adopted deploy key is changed to the one the Secret
+	// asks for
+	AdoptedPushMismatch = "AdoptedPushMismatch"
+	// ProjectKeyLimitNear is used as part of the Event 'reason' when the
+	// project of a Secret nears its deploy key limit
+	ProjectKeyLimitNear = "ProjectKeyLimitNear"
+	// NamespaceTerminating is used as part of the Event 'reason' when the
+	// deploy key of a Secret can't be recorded because its namespace is
+	// being deleted
+	NamespaceTerminating = "NamespaceTerminating"
+	// DeployKeyDeleted is used as part of the Event 'reason' when the deploy
+	// key of a deleted Secret is removed from gitlab
+	DeployKeyDeleted = "DeployKeyDeleted"
+	// SkippedDelete is used as part of the Event 'reason' when the deploy key
+	// of a deleted Secret is left in gitlab because deletion is disabled
+	SkippedDelete = "SkippedDelete"
 	// ErrResourceExists is used as part of the Event 'reason' when a Secret fails
 	// to sync due to a Deployment of the same name already existing.
 	ErrResourceExists = "ErrResourceExists"
 
+	// ErrInvalidRequestTimeout is used as part of the Event 'reason' when a
+	// Secret has a request timeout annotation that can't be parsed
+	ErrInvalidRequestTimeout = "ErrInvalidRequestTimeout"
+
+	// ErrGitLabAuth is used as part of the Event 'reason' when the gitlab API
+	// rejects the token used by the controller
+	ErrGitLabAuth = "GitLabAuthError"
+
+	// ErrKeyLimitReached is used as part of the Event 'reason' when no key
+	// is created for a Secret because of the managed keys limit
+	ErrKeyLimitReached = "ErrKeyLimitReached"
+
+	// ErrPushRequired is used as part of the Event 'reason' when no key is
+	// created for a Secret requiring push because it can't push
+	ErrPushRequired = "ErrPushRequired"
+
+	// ErrProjectKeyLimit is used as part of the Event 'reason' when no key
+	// is created for a Secret because its project has as many deploy keys
+	// as allowed
+	ErrProjectKeyLimit = "ErrProjectKeyLimit"
+
+	// ErrEmptyProject is used as part of the Event 'reason' when gitlab
+	// answers the project request of a Secret with an empty project
+	ErrEmptyProject = "ErrEmptyProject"
+
+	// ErrMissingIdentity is used as part of the Event 'reason' when a Secret
+	// has no private key under any of the identity keys
+	ErrMissingIdentity = "ErrMissingIdentity"
+
+	// ErrMissingGitURL is used as part of the Event 'reason' when a Secret
+	// has an identity but no git url with -require-git-url
+	ErrMissingGitURL = "ErrMissingGitURL"
+
+	// ErrInvalidTokenScopes is used as part of the Event 'reason' when a
+	// Secret asks for deploy token scopes that aren't allowed
+	ErrInvalidTokenScopes = "ErrInvalidTokenScopes"
+	// ErrKeyPolicy is used as part of the Event 'reason' when the public key
+	// of a Secret breaks the -enforce-key-policy
+	ErrKeyPolicy = "ErrKeyPolicy"
+
+	// TitleDrift is used as part of the Event 'reason' when the hash
+	// embedded in the title of a deploy key doesn't match its parameters
+	TitleDrift = "TitleDrift"
+
 	// MessageResourceExists is the message used for Events when a resource
 	// fails to sync due to a Deployment already existing
 	MessageResourceExists = "Resource %q already exists and is not managed by Secret"
 	// MessageResourceSynced is the message used for an Event fired when a Secret
 	// is synced successfully
 	MessageResourceSynced = "Secret synced successfully"
+	// MessageDeployKeyCreated is the message used for an Event fired when the
+	// deploy key of a Secret is created, linking to it in the gitlab UI
+	MessageDeployKeyCreated = "Secret synced successfully, deploy key %d is listed at %s"
+	// MessageResourceUpdated is the message used for an Event fired when the
+	// deploy key of a Secret is updated successfully
+	MessageResourceUpdated = "Deploy key updated successfully"
+	// MessageTitleDrift is the message used for an Event fired when the
+	// hash embedded in the title of a deploy key doesn't match its parameters
+	MessageTitleDrift = "Deploy key %d was changed outside of the controller, its title %q doesn't match its parameters"
+	// MessageReadOnlyMirror is the message used for an Event fired when a
+	// read-only key is created for a pull mirror project
+	MessageReadOnlyMirror = "Project %q is a pull mirror, creating a read-only deploy key"
+	// MessageReadOnlyArchived is the message used for an Event fired when a
+	// read-only key is created for an archived project
+	MessageReadOnlyArchived = "Project %q is archived, creating a read-only deploy key"
+	// MessagePushPolicyDenied is the message used for an Event fired when a
+	// read-only key is created for a project outside of the -push-policy
+	MessagePushPolicyDenied = "Project %q isn't allowed push keys by the push policy, creating a read-only deploy key"
+	// MessageProjectNotAllowed is the message used for an Event fired when a
+	// Secret is skipped because its project isn't in the project allowlist
+	MessageProjectNotAllowed = "Project %q isn't in the project allowlist, skipping the secret"
+	// MessageDeployKeyMissing is the message used for an Event fired when
+	// the deploy key of a Secret is found deleted and not recreated
+	MessageDeployKeyMissing = "Deploy key %d of project %q was deleted in gitlab and recreation is disabled, remove the fluxcd.io/deployKeyMissing annotation to recreate it"
+	// MessageIdentityRotated is the message used for an Event fired when the
+	// deploy key of a Secret is replaced because its identity changed
+	MessageIdentityRotated = "Identity changed, replacing deploy key %d with a key of the new identity"
+	// MessageReconcileTimeout is the message used for an Event fired when
+	// the sync of a Secret outlasts -reconcile-timeout
+	MessageReconcileTimeout = "Sync didn't finish within %s, retrying later"
+	// MessageReconcileDeadLettered is the message used for an Event fired
+	// when a Secret isn't retried anymore after timing out too many times
+	MessageReconcileDeadLettered = "Sync timed out %d times in a row, not retrying until the secret changes"
+	// MessageKeyAgeRotated is the message used for an Event fired when the
+	// deploy key of a Secret is replaced because it's older than -max-key-age
+	MessageKeyAgeRotated = "Deploy key %d is older than %s, replaced it and the identity with deploy key %d"
+	// MessageIdentityReplaced is the message used for an Event fired when
+	// the private key of a Secret is replaced by a rotation
+	MessageIdentityReplaced = "Replaced the private key in data key %q with a new identity, update the source the secret is applied from or it will revert it"
+	// MessageDeployKeySuspended is the message used for an Event fired when
+	// the deploy key of a suspended Secret is deleted
+	MessageDeployKeySuspended = "Secret is suspended, deleted deploy key %d of project %q until the suspension is lifted"
+	// MessagePushProtected is the message used for an Event fired when the
+	// push key of a Secret can't push to the protected default branch
+	MessagePushProtected = "Deploy key can push, but nobody is allowed to push to the protected branch %q of project %q"
+	// MessageDeployKeyAdopted is the message used for an Event fired when an
+	// existing deploy key is adopted instead of being created
+	MessageDeployKeyAdopted = "Secret synced successfully, its key already was deploy key %d, listed at %s"
+	// MessageDeployKeyRenamed is the message used for an Event fired when
+	// the deploy key of a deleted Secret is adopted under its new name
+	MessageDeployKeyRenamed = "Secret synced successfully, adopted deploy key %d of deleted secret %s/%s and retitled it %q"
+	// MessageAdoptedPushUpdated is the message used for an Event fired when
+	// the push permission of an adopted deploy key is updated
+	MessageAdoptedPushUpdated = "Adopted deploy key %d had can_push %t, updated it to %t"
+	// MessageAdoptedPushRecreated is the message used for an Event fired when
+	// an adopted deploy key is recreated to change its push permission
+	MessageAdoptedPushRecreated = "Adopted deploy key %d had can_push %t and can't be updated, recreated it as deploy key %d with can_push %t"
+	// MessageNamespaceTerminating is the message used for an Event fired
+	// when the deploy key of a Secret can't be recorded because its
+	// namespace is being deleted
+	MessageNamespaceTerminating = "Namespace is terminating, deploy key %d can't be recorded in the secret and is removed from gitlab"
+	// MessageDeployKeyDeleted is the message used for an Event fired when
+	// the deploy key of a deleted Secret is removed from gitlab
+	MessageDeployKeyDeleted = "Deploy key %d was removed from project %q"
+	// MessageSkippedDelete is the message used for an Event fired when the
+	// deploy key of a deleted Secret is left in gitlab
+	MessageSkippedDelete = "Deletion is disabled, deploy key %d of project %q was left in place"
+	// MessageGitLabAuth is the message used for Events when the gitlab API
+	// rejects the token used by the controller
+	MessageGitLabAuth = "GitLab rejected the controller token with status %d for project %q"
+	// MessageKeyLimitReached is the message used for Events when no key is
+	// created for a Secret because of the managed keys limit
+	MessageKeyLimitReached = "The controller already manages %d deploy keys, the limit set by -max-managed-keys, not creating a new one"
+	// MessagePushNotAllowed is the message used for Events when no key is
+	// created for a Secret requiring push because of -allow-push-keys
+	MessagePushNotAllowed = "Secret requires a deploy key that can push, but push keys are disallowed by -allow-push-keys"
+	// MessagePushRequiredReadOnly is the message used for Events when no key
+	// is created for a Secret requiring push because its project is a mirror
+	// or archived
+	MessagePushRequiredReadOnly = "Secret requires a deploy key that can push, but project %q is %s"
+	// MessageProjectKeyLimit is the message used for Events when no key is
+	// created for a Secret because its project has as many deploy keys as
+	// allowed
+	MessageProjectKeyLimit = "Project %q has as many deploy keys as allowed, remove unused ones to create this one: %s"
+	// MessageProjectKeyLimitNear is the message used for Events when the
+	// project of a Secret nears its deploy key limit
+	MessageProjectKeyLimitNear = "Project %q has %d deploy keys, nearing the limit of %d set by -project-key-limit"
+	// MessageEmptyProject is the message used for Events when gitlab answers
+	// the project request of a Secret with an empty project
+	MessageEmptyProject = "GitLab returned an empty project for %q"
+	// MessageMissingIdentity is the message used for Events when a Secret has
+	// no private key under any of the identity keys
+	MessageMissingIdentity = "Secret has no private key under any of the %q data keys"
+	// MessageMissingGitURL is the message used for Events when a Secret has
+	// an identity but no git url with -require-git-url
+	MessageMissingGitURL = "Secret has an identity but no %s annotation, skipping it"
+	// MessageInvalidTokenScopes is the message used for Events when a Secret
+	// asks for deploy token scopes that aren't allowed
+	MessageInvalidTokenScopes = "Invalid deploy token scopes %q: %s"
+	// MessageKeyPolicy is the message used for Events when the public key of
+	// a Secret breaks the -enforce-key-policy
+	MessageKeyPolicy = "Public key %s breaks the key policy, not uploading it: %s"
+	// MessageInvalidRequestTimeout is the message used for Events when a Secret
+	// request timeout annotation is invalid
+	MessageInvalidRequestTimeout = "Invalid request timeout %q, using the default of %s"
 )
 
+// verification records until when a verified deploy key is trusted
+type verification struct {
+	deployKey string
+	until     time.Time
+}
+
 // Controller is the controller implementation for Secret resources
 type Controller struct {
 	// kubeclientset is a standard kubernetes clientset
@@ -80,8 +421,67 @@ type Controller struct {
 
 	secretsLister corelisters.SecretLister
 	secretsSynced cache.InformerSynced
+	// list lists the Secrets watched by the controller, from the informer
+	// cache or the manager cache
+	list listFunc
+	// forProject lists the Secrets referencing a gitlab project, from the
+	// informer index or the manager cache index
+	forProject projectFunc
 
 	gitlabClient *gitlab.Client
+	// gitlabToken authenticates the gitlabClient requests
+	gitlabToken *tokenTransport
+	// deletions guards against mass deploy key deletions
+	deletions deletionGuard
+	// pending holds the deleted Secrets waiting for -delete-grace-period
+	pending pendingDeletions
+	// projects serializes the syncs of the Secrets of each project, shared
+	// by the controllers of every cluster
+	projects *projectLocks
+	// missingProjects are the projects recently not found in gitlab, shared
+	// by the controllers of every cluster
+	missingProjects *missingProjects
+	// lastProgress is when a Secret was last synced successfully, or when
+	// the workers started, in unix nanoseconds
+	lastProgress int64
+	// timeouts tracks the syncs that outlasted -reconcile-timeout
+	timeouts syncTimeouts
+	// holds are the Secrets of the workqueue waiting out a backoff
+	holds backoffHolds
+	// invalidTimeouts tracks the invalid request timeout annotations already
+	// warned about
+	invalidTimeouts invalidTimeouts
+	// cluster is the name of the -remote-kubeconfigs cluster of the Secrets,
+	// empty for the local one
+	cluster string
+	// remotes are the controllers of the -remote-kubeconfigs clusters, set
+	// on the local one before it runs
+	remotes []*Controller
+	// dynamicClient gets the GitRepositories owning the Secrets with
+	// -git-url-from-owner, nil otherwise
+	dynamicClient dynamic.Interface
+	// state keeps the annotations of the Secrets instead of them with
+	// -state-configmap, nil otherwise
+	state *stateStore
+	// knownHosts caches the known hosts of the gitlab SSH host
+	knownHosts knownHosts
+	// throttle pauses the workers while gitlab keeps rate limiting them
+	throttle throttle
+
+	// verified holds, by Secret namespace/name, the deploy keys verified
+	// within the verify cache TTL
+	verifiedMu sync.Mutex
+	verified   map[string]verification
+
+	// synced holds, by Secret namespace/name, the time of the last
+	// successful sync
+	syncedMu sync.Mutex
+	synced   map[string]time.Time
+
+	// created holds, by Secret namespace/name, when the deploy keys created
+	// are due for their -verify-after-create verification
+	createdMu sync.Mutex
+	created   map[string]time.Time
 
 	// workqueue is a rate limited work queue. This is used to queue work to be
 	// processed instead of performing it as soon as a change happens. This
@@ -89,6 +489,9 @@ type Controller struct {
 	// time, and makes it easy to ensure we are never processing the same item
 	// simultaneously in two different workers.
 	workqueue workqueue.RateLimitingInterface
+	// deletionqueue holds the deleted Secrets, processed by their own
+	// workers so deletions don't hold up the creations in the workqueue
+	deletionqueue workqueue.RateLimitingInterface
 	// recorder is an event recorder for recording Event resources to the
 	// Kubernetes API.
 	recorder record.EventRecorder
@@ -97,28 +500,41 @@ type Controller struct {
 // NewController returns a new sample controller
 func NewController(
 	kubeclientset kubernetes.Interface,
-	secretInformer v1.SecretInformer) *Controller {
+	secretInformer v1.SecretInformer,
+	cluster string) *Controller {
 
 	// Create event broadcaster
 	// Add Flux controller types to the default Kubernetes Scheme so Events can be
 	// logged for controller types.
-	klog.V(4).Info("Creating event broadcaster")
+	logV(4).Info("Creating event broadcaster")
 	eventBroadcaster := record.NewBroadcaster()
 
-	gitlabClient, _ := gitlab.NewClient(gitlabToken, gitlab.WithBaseURL(fmt.Sprintf("https://%s/api/v4", gitlabHostname)))
+	tokens := newTokenTransport(gitlabToken, gitlabTransport())
+	gitlabClient, _ := newGitlabClient(tokens)
 
 	eventBroadcaster.StartLogging(klog.Infof)
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
 
 	controller := &Controller{
-		kubeclientset: kubeclientset,
-		secretsLister: secretInformer.Lister(),
-		secretsSynced: secretInformer.Informer().HasSynced,
-		workqueue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Secrets"),
-		gitlabClient:  gitlabClient,
-		recorder:      recorder,
+		kubeclientset:   kubeclientset,
+		secretsLister:   secretInformer.Lister(),
+		secretsSynced:   secretInformer.Informer().HasSynced,
+		workqueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Secrets"),
+		deletionqueue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "DeletedSecrets"),
+		gitlabClient:    gitlabClient,
+		gitlabToken:     tokens,
+		recorder:        newAsyncRecorder(newDedupRecorder(decisionRecorder{recorder, cluster})),
+		projects:        &projectLocks{},
+		missingProjects: newMissingProjects(),
+		cluster:         cluster,
 	}
+	controller.list = controller.listSecrets
+
+	if err := secretInformer.Informer().AddIndexers(cache.Indexers{projectPathIndex: indexByProjectPath}); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to index the secrets by project path: %s", err.Error()))
+	}
+	controller.forProject = secretsByIndex(secretInformer.Informer().GetIndexer())
 
 	klog.Info("Setting up event handlers")
 	// Set up an event handler for when Flux secret changes resources change
@@ -126,9 +542,18 @@ func NewController(
 	secretInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: controller.handleObject,
 		UpdateFunc: func(old, new interface{}) {
+			// The label selector turns the update that adds the marker label
+			// to an existing secret into an Add, but should one get here it's
+			// synced as a new secret all the same
+			if !hasMarkerLabel(old) && hasMarkerLabel(new) {
+				logV(4).Info("Secret was labeled, syncing it as a new secret")
+			}
+			if !materialChange(old, new) {
+				return
+			}
 			controller.handleObject(new)
 		},
-		DeleteFunc: controller.handleObject,
+		DeleteFunc: controller.handleDeletedObject,
 	})
 
 	return controller
@@ -141,6 +566,7 @@ func NewController(
 func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
 	defer c.workqueue.ShutDown()
+	defer c.deletionqueue.ShutDown()
 
 	// Start the informer factories to begin populating the informer caches
 	klog.Info("Starting Secret controller")
@@ -151,10 +577,30 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
+	if reconcileOnStart {
+		if err := c.enqueueAll(); err != nil {
+			return err
+		}
+	}
+
+	if startupDelay > 0 {
+		klog.Infof("Waiting %s before starting workers", startupDelay)
+		select {
+		case <-time.After(startupDelay):
+		case <-stopCh:
+			return nil
+		}
+	}
+
 	klog.Info("Starting workers")
-	// Launch two workers to process Secret resources
-	for i := 0; i < threadiness; i++ {
-		go wait.Until(c.runWorker, time.Second, stopCh)
+	c.markProgress()
+	go c.startWorkers(threadiness, stopCh)
+	for i := 0; i < deletionWorkers; i++ {
+		go wait.Until(func() { c.runWorker(c.deletionqueue, stopCh) }, time.Second, stopCh)
+	}
+	// The secrets of the remote clusters are checked along with the local ones
+	if orphanScanInterval > 0 && c.cluster == "" {
+		go c.runOrphanScan(stopCh)
 	}
 
 	klog.Info("Started workers")
@@ -164,24 +610,80 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	return nil
 }
 
+// startWorkers launches the workers processing Secret resources, the first
+// one right away and the others spread evenly over -startup-ramp
+func (c *Controller) startWorkers(threadiness int, stopCh <-chan struct{}) {
+	for i := 0; i < threadiness; i++ {
+		if i > 0 && startupRamp > 0 {
+			select {
+			case <-time.After(startupRamp / time.Duration(threadiness-1)):
+			case <-stopCh:
+				return
+			}
+			logV(4).Infof("Starting worker %d of %d", i+1, threadiness)
+		}
+		go wait.Until(func() { c.runWorker(c.workqueue, stopCh) }, time.Second, stopCh)
+	}
+}
+
+// markProgress records that the workers made progress
+func (c *Controller) markProgress() {
+	atomic.StoreInt64(&c.lastProgress, time.Now().UnixNano())
+}
+
+// checkProgress returns an error when Secrets are queued but none was synced
+// successfully within -progress-window, e.g. the workers are deadlocked or
+// gitlab is down. Before the workers start, the cache sync is the readiness
+// to go by.
+func (c *Controller) checkProgress() error {
+	last := atomic.LoadInt64(&c.lastProgress)
+	if last == 0 {
+		return nil
+	}
+	queued := c.workqueue.Len() + c.deletionqueue.Len()
+	if queued == 0 {
+		return nil
+	}
+	if since := time.Since(time.Unix(0, last)); since > progressWindow {
+		return fmt.Errorf("%d secrets queued but none synced for %s", queued, since.Round(time.Second))
+	}
+	return nil
+}
+
+// enqueueAll enqueues every Secret in the informer cache, so they converge
+// after a downtime whatever the resync period. It runs before the workers
+// start, so the Secrets are still queued from the informer replay and the
+// workqueue deduplicates them rather than processing them twice.
+func (c *Controller) enqueueAll() error {
+	secrets, err := c.listSecrets()
+	if err != nil {
+		return fmt.Errorf("failed to list secrets to reconcile on start: %s", err.Error())
+	}
+	klog.Infof("Reconciling %d secrets on start", len(secrets))
+	for _, secret := range secrets {
+		c.handleObject(secret)
+	}
+	return nil
+}
+
 // runWorker is a long-running function that will continually call the
 // processNextWorkItem function in order to read and process a message on the
-// workqueue.
-func (c *Controller) runWorker() {
-	for c.processNextWorkItem() {
+// queue. Workers don't dequeue anything while the throttle is paused.
+func (c *Controller) runWorker(queue workqueue.RateLimitingInterface, stopCh <-chan struct{}) {
+	for c.throttle.wait(stopCh) && c.processNextWorkItem(queue) {
 	}
 }
 
-// processNextWorkItem will read a single work item off the workqueue and
+// processNextWorkItem will read a single work item off the queue and
 // attempt to process it, by calling the syncHandler.
-func (c *Controller) processNextWorkItem() bool {
-	obj, shutdown := c.workqueue.Get()
+func (c *Controller) processNextWorkItem(queue workqueue.RateLimitingInterface) bool {
+	obj, shutdown := queue.Get()
 
 	if shutdown {
 		return false
 	}
 
-	// We wrap this block in a func so we can defer c.workqueue.Done.
+	// We wrap this block in a func so we can defer queue.Done.
 	err := func(obj interface{}) error {
 		// We call Done here so the workqueue knows we have finished
 		// processing this item. We also must remember to call Forget if we
@@ -189,7 +691,7 @@ func (c *Controller) processNextWorkItem() bool {
 		// not call Forget if a transient error occurs, instead the item is
 		// put back on the workqueue and attempted again after a back-off
 		// period.
-		defer c.workqueue.Done(obj)
+		defer queue.Done(obj)
 		var key *corev1.Secret
 		var ok bool
 		// We expect Secrets to come off the workqueue. These are of the
@@ -201,20 +703,60 @@ func (c *Controller) processNextWorkItem() bool {
 			// As the item in the workqueue is actually invalid, we call
 			// Forget here else we'd go into a loop of attempting to
 			// process a work item that is invalid.
-			c.workqueue.Forget(obj)
+			queue.Forget(obj)
 			utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
 			return nil
 		}
-		// Run the syncHandler, passing it the namespace/name string of the
-		// Secret resource to be synced.
-		if err := c.syncHandler(key); err != nil {
+		if queue == c.workqueue {
+			// The Secret was queued before its backoff started, its retry
+			// is already scheduled
+			if after, held := c.holds.remaining(key); held {
+				queue.Forget(obj)
+				logV(4).Infof("Skipping secret %s/%s, it's backing off for %s", key.Namespace, key.Name, after.Round(time.Second))
+				return nil
+			}
+		}
+		// Run the syncHandler, or the deletionHandler for the deleted
+		// Secrets, passing it the Secret resource to be synced.
+		handler := c.syncHandler
+		if queue == c.deletionqueue {
+			handler = c.deletionHandler
+		}
+		if err := c.syncWithTimeout(handler, key); err != nil {
+			source := errorSource(err)
+			secretSyncs.WithLabelValues(c.clusterLabel(), "error").Inc()
+			syncErrors.WithLabelValues(c.clusterLabel(), source).Inc()
+			if err == errReconcileTimeout && c.reconcileTimedOut(key, queue == c.deletionqueue) {
+				queue.Forget(obj)
+				return fmt.Errorf("error syncing '%s': %s, dead-lettered", key, err.Error())
+			}
+			if after, ok := c.backoff(key, err); ok {
+				// Retrying soon won't help, wait before trying again
+				queue.Forget(obj)
+				if queue == c.workqueue {
+					c.holds.hold(key, after)
+				}
+				queue.AddAfter(key, after)
+				return fmt.Errorf("%s error syncing '%s': %s, requeuing in %s", source, key, err.Error(), after)
+			}
 			// Put the item back on the workqueue to handle any transient errors.
-			c.workqueue.AddRateLimited(key)
-			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
+			queue.AddRateLimited(key)
+			return fmt.Errorf("%s error syncing '%s': %s, requeuing", source, key, err.Error())
 		}
 		// Finally, if no error occurs we Forget this item so it does not
 		// get queued again until another change happens.
-		c.workqueue.Forget(obj)
+		queue.Forget(obj)
+		if queue == c.workqueue {
+			c.holds.release(key)
+			if after, ok := c.verifyRequeue(key); ok {
+				queue.AddAfter(key, after)
+			}
+			c.markSynced(key)
+		}
+		secretSyncs.WithLabelValues(c.clusterLabel(), "success").Inc()
+		c.markProgress()
+		c.throttle.reset()
+		lastSuccessfulSync.SetToCurrentTime()
 		klog.Infof("Successfully synced '%s'", key)
 		return nil
 	}(obj)
@@ -227,128 +769,1867 @@ func (c *Controller) processNextWorkItem() bool {
 	return true
 }
 
+// backoff returns how long to wait before retrying a Secret whose sync failed
+// with err, for the errors the rate limited requeue would only hot-loop on.
+func (c *Controller) backoff(secret *corev1.Secret, err error) (time.Duration, bool) {
+	var delayed *deletionDelayed
+	if goerrors.As(err, &delayed) {
+		return delayed.after, true
+	}
+	var graced *deletionGraced
+	if goerrors.As(err, &graced) {
+		return graced.after, true
+	}
+	if err == errDeletionsHalted {
+		return deletionHaltBackoff, true
+	}
+	if err == errReconcileTimeout {
+		return reconcileTimeoutBackoff, true
+	}
+
+	status := gitlabStatus(err)
+	if status != 0 && status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		// gitlab answered, it's neither rate limiting the controller nor
+		// in maintenance anymore
+		c.throttle.reset()
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrGitLabAuth, MessageGitLabAuth, status, projectPath(secret))
+		if status == http.StatusUnauthorized {
+			changed, err := c.gitlabToken.reload()
+			if err != nil {
+				utilruntime.HandleError(fmt.Errorf("failed to reload the gitlab token: %s", err.Error()))
+			} else if changed {
+				// The token was rotated, the regular requeue retries with it
+				klog.Info("Reloaded the gitlab token")
+				return 0, false
+			}
+		}
+		return authErrorBackoff, true
+	case http.StatusTooManyRequests:
+		delay := retryAfter(err, rateLimitBackoff)
+		if delay > max429Backoff {
+			delay = max429Backoff
+		}
+		c.throttle.rateLimited(delay)
+		return delay, true
+	case http.StatusServiceUnavailable:
+		// GitLab is most likely in maintenance, every Secret would fail
+		// alike until it's over
+		c.throttle.unavailable(maintenancePause)
+		return maintenancePause, true
+	}
+	return 0, false
+}
+
 // syncHandler compares the actual state with the desired, and attempts to
 // converge the two. It then updates the deployKeyId block of the Secret resource
 // with the current status of the resource.
-func (c *Controller) syncHandler(secret *corev1.Secret) error {
-
+func (c *Controller) syncHandler(ctx context.Context, secret *corev1.Secret) error {
 	// Get the Secret resource with this namespace/name
-	_, err := c.secretsLister.Secrets(secret.Namespace).Get(secret.Name)
+	current, err := c.secretsLister.Secrets(secret.Namespace).Get(secret.Name)
+	if errors.IsNotFound(err) {
+		// The deletion queue removes the deploy key of the deleted Secret
+		logV(4).Infof("Secret '%s' in work queue no longer exists", secret.Name)
+		return nil
+	}
 	if err != nil {
-		// The Secret resource may no longer exist, in which case we stop
-		// processing.
-		if errors.IsNotFound(err) {
-			utilruntime.HandleError(fmt.Errorf("secret '%s' in work queue no longer exists", secret.Name))
-			deployKey, err := strconv.Atoi(secret.Annotations[deployKeyLabelName])
-			if err != nil {
-				return err
-			}
-			klog.V(4).Infof("Deleting deploy key %d", deployKey)
-			project := strings.TrimPrefix(secret.Annotations[gitUrlLabelName], fmt.Sprintf("git@%s:", gitlabHostname))
-			// Removes .git in the URL if present
-			projectBase := strings.TrimSuffix(project, ".git")
+		return err
+	}
+	if current.UID != secret.UID || current.DeletionTimestamp != nil {
+		// The queued Secret was deleted, the deletion queue removes its
+		// deploy key, and a Secret created in its place is queued itself
+		logV(4).Infof("Secret '%s' in work queue was deleted, not syncing it", secret.Name)
+		return nil
+	}
 
-			c.gitlabClient.DeployKeys.DeleteDeployKey(projectBase, deployKey)
-			return nil
+	if c.verifyDue(current) {
+		// The queued Secret predates the annotations of its new deploy key
+		return c.syncSecret(ctx, current)
+	}
+	return c.syncSecret(ctx, secret)
+}
+
+// deletionHandler removes the deploy key of a Secret of the deletion queue
+// once it's gone, replaced by another Secret of the same name or being
+// deleted. It never syncs the Secret, the lister still has the terminating
+// ones.
+func (c *Controller) deletionHandler(ctx context.Context, secret *corev1.Secret) error {
+	current, err := c.secretsLister.Secrets(secret.Namespace).Get(secret.Name)
+	if errors.IsNotFound(err) {
+		c.invalidTimeouts.forget(secret)
+		if err := c.deleteDeployKey(ctx, secret); err != nil {
+			return err
 		}
+		// The Secret may only have been unlabeled
+		return c.forgetDeployKey(ctx, secret)
+	}
+	if err != nil {
+		return err
+	}
+	if current.UID == secret.UID && current.DeletionTimestamp == nil {
+		// The Secret was labeled again since, it keeps its key
+		logV(4).Infof("Secret '%s' in deletion queue still exists, keeping its deploy key", secret.Name)
+		return nil
+	}
+	return c.deleteDeployKey(ctx, secret)
+}
 
+// deleteDeployKey removes the deploy key of a deleted Secret from gitlab once
+// -delete-grace-period is over, unless the Secret was recreated with the same
+// identity meanwhile
+func (c *Controller) deleteDeployKey(ctx context.Context, secret *corev1.Secret) error {
+	if deleteGracePeriod > 0 {
+		if after, ok := c.pending.remaining(secret); ok {
+			return &deletionGraced{after: after}
+		}
+		if c.recreated(ctx, secret) {
+			klog.Infof("Secret %s/%s was recreated with the same identity, keeping its deploy key", secret.Namespace, secret.Name)
+			c.pending.done(secret)
+			return nil
+		}
+		if c.adoptedByRename(secret) {
+			klog.Infof("Secret %s/%s was recreated under another name, keeping its deploy key", secret.Namespace, secret.Name)
+			c.pending.done(secret)
+			return nil
+		}
+	}
+	secret = c.state.overlay(secret)
+	if err := c.removeDeployKey(ctx, secret); err != nil {
 		return err
 	}
+	c.pending.done(secret)
+	return c.state.forget(ctx, secret)
+}
+
+// removeDeployKey removes the deploy key of a deleted Secret from gitlab
+func (c *Controller) removeDeployKey(ctx context.Context, secret *corev1.Secret) error {
+	c.forgetVerified(secret)
 
-	if _, found := secret.Annotations[gitUrlLabelName]; !found {
-		klog.V(4).Infof("Secret %s is not a flux secret", secret.GetName())
+	if !isGitlabSecret(secret) {
+		// The annotations are another provider's, their ids aren't gitlab's
 		return nil
 	}
 
-	// We could make the controller check if the key exist in the gitlab API
-	// and re-create it if missing but I'm a bit concerned about the amount of
-	// pressure that it could put into the API
-	if _, ok := secret.Annotations[deployKeyLabelName]; ok {
-		klog.V(4).Infof("Secret %s already has deployKey, no need to update", secret.GetName())
+	if _, ok := secret.Annotations[deployKeyIdsLabelName]; ok {
+		return c.deleteIdentityPairKeys(ctx, secret)
+	}
+
+	_, hasKey := secret.Annotations[deployKeyLabelName]
+	_, hasToken := secret.Annotations[deployTokenLabelName]
+	if (hasKey || hasToken) && !allowedProject(projectPath(secret)) {
+		klog.Warningf("Project %s of secret %s isn't in the project allowlist, leaving its deploy key in place", projectPath(secret), secret.GetName())
 		return nil
 	}
 
-	project := strings.TrimPrefix(secret.Annotations[gitUrlLabelName], fmt.Sprintf("git@%s:", gitlabHostname))
-	// Removes .git in the URL if present
-	projectBase := strings.TrimSuffix(project, ".git")
+	if value, ok := secret.Annotations[deployTokenLabelName]; ok {
+		return c.deleteDeployToken(ctx, secret, value)
+	}
 
-	p, _, err := c.gitlabClient.Projects.GetProject(projectBase, nil)
+	value, ok := secret.Annotations[deployKeyLabelName]
+	deployKey, err := strconv.Atoi(value)
+	if !ok || err != nil {
+		return c.deleteDeployKeyByFingerprint(ctx, secret)
+	}
+	if noDelete {
+		klog.Infof("Not deleting deploy key %d of project %s, deletion is disabled", deployKey, projectPath(secret))
+		c.recorder.Eventf(secret, corev1.EventTypeNormal, SkippedDelete, MessageSkippedDelete, deployKey, projectPath(secret))
+		return nil
+	}
 
-	if err != nil {
+	if err := c.deletions.allow(); err != nil {
 		return err
 	}
 
-	repoKey := secret.Data["identity"]
-	k, err := ssh.ParseRawPrivateKey(repoKey)
+	ctx, cancel := c.gitlabContext(ctx, secret)
+	defer cancel()
 
+	logV(4).Infof("Deleting deploy key %d", deployKey)
+	deleteKey := func(pid interface{}) (*gitlab.Response, error) {
+		return c.gitlabClient.DeployKeys.DeleteDeployKey(pid, deployKey, gitlab.WithContext(ctx))
+	}
+	projectID, _ := projectRef(secret)
+	resp, err := deleteKey(projectID)
+	resp, err = c.retryOnStaleProject(ctx, secret, resp, err, deleteKey)
+	if isNotFound(resp) {
+		// The key is already gone, there's nothing left to delete
+		logV(4).Infof("Deploy key %d of project %s is already gone", deployKey, projectPath(secret))
+		return nil
+	}
 	if err != nil {
+		// The key is still in gitlab, the deletion is retried
 		return err
 	}
+	audit.record(auditDeleteDeployKey, projectPath(secret), deployKey, secret.Annotations[createdTitleLabelName], secret)
+	c.recorder.Eventf(secret, corev1.EventTypeNormal, DeployKeyDeleted, MessageDeployKeyDeleted, deployKey, projectPath(secret))
+	return nil
+}
 
-	rsaKey, _ := k.(*rsa.PrivateKey)
+// deleteDeployKeyByFingerprint deletes the deploy key of a deleted Secret
+// whose id annotation is missing or corrupted, e.g. by a manual edit, looking
+// it up by the recorded fingerprint or else by the Secret's public key. It
+// leaves alone the Secrets without any other deploy key annotation, which
+// never had a key, and the ones whose key is known to be missing.
+func (c *Controller) deleteDeployKeyByFingerprint(ctx context.Context, secret *corev1.Secret) error {
+	_, missing := secret.Annotations[deployKeyMissingLabelName]
+	keyFingerprint, ok := secret.Annotations[deployKeyFingerprintLabelName]
+	if !ok && (missing || !hasKeyAnnotations(secret)) {
+		logV(4).Infof("Secret %s has no deployKey, nothing to delete", secret.GetName())
+		return nil
+	}
+	if !ok {
+		sshKey, err := publicKey(secret)
+		if err != nil {
+			klog.Warningf("Secret %s has neither a deployKey id nor fingerprint nor identity, can't find its deploy key: %s", secret.GetName(), err.Error())
+			return nil
+		}
+		keyFingerprint = ssh.FingerprintSHA256(sshKey)
+	}
+	if _, found := gitURL(secret); !found {
+		klog.Warningf("Secret %s has no git url, can't find its deploy key %s", secret.GetName(), keyFingerprint)
+		return nil
+	}
+	if !allowedProject(projectPath(secret)) {
+		klog.Warningf("Project %s of secret %s isn't in the project allowlist, leaving its deploy key in place", projectPath(secret), secret.GetName())
+		return nil
+	}
+	if c.keyInUse(secret, keyFingerprint) {
+		klog.Infof("Deploy key %s of project %s is recorded by another secret, leaving it in place", keyFingerprint, projectPath(secret))
+		return nil
+	}
 
-	sshKey, err := ssh.NewPublicKey(rsaKey.Public())
+	ctx, cancel := c.gitlabContext(ctx, secret)
+	defer cancel()
 
+	project, err := c.getProject(ctx, secret)
 	if err != nil {
 		return err
 	}
-
-	keyResp, _, err := c.gitlabClient.DeployKeys.AddDeployKey(p.ID, &gitlab.AddDeployKeyOptions{Title: gitlab.String("Flux deployment key"), Key: gitlab.String(string(ssh.MarshalAuthorizedKey(sshKey))), CanPush: gitlab.Bool(true)})
+	key, err := c.findDeployKey(ctx, project.ID, keyFingerprint)
+	if goerrors.Is(err, errDeployKeyNotFound) {
+		logV(4).Infof("Secret %s deployKey %s is already gone, nothing to delete", secret.GetName(), keyFingerprint)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	klog.V(4).Infof("Adding deploy key %d", keyResp.ID)
+	if noDelete {
+		klog.Infof("Not deleting deploy key %d of project %s, deletion is disabled", key.ID, projectPath(secret))
+		c.recorder.Eventf(secret, corev1.EventTypeNormal, SkippedDelete, MessageSkippedDelete, key.ID, projectPath(secret))
+		return nil
+	}
 
-	// Finally, we update the status block of the Secret resource to reflect the
-	// current state of the world
-	err = c.updateSecretStatus(secret, strconv.Itoa(keyResp.ID))
-	if err != nil {
+	if err := c.deletions.allow(); err != nil {
 		return err
 	}
-
-	c.recorder.Event(secret, corev1.EventTypeNormal, SuccessSynced, MessageResourceSynced)
+	klog.Infof("Deleting deploy key %d of secret %s by its fingerprint %s", key.ID, secret.GetName(), keyFingerprint)
+	resp, err := c.gitlabClient.DeployKeys.DeleteDeployKey(project.ID, key.ID, gitlab.WithContext(ctx))
+	if err != nil && !isNotFound(resp) {
+		return err
+	}
+	if err == nil {
+		audit.record(auditDeleteDeployKey, project.PathWithNamespace, key.ID, key.Title, secret)
+		c.recorder.Eventf(secret, corev1.EventTypeNormal, DeployKeyDeleted, MessageDeployKeyDeleted, key.ID, projectPath(secret))
+	}
 	return nil
 }
 
-func (c *Controller) updateSecretStatus(secret *corev1.Secret, deployKeyId string) error {
-	// NEVER modify objects from the store. It's a read-only, local cache.
-	// You can use DeepCopy() to make a deep copy of original object and modify this copy
-	// Or create a copy manually for better performance
-	secretCopy := secret.DeepCopy()
-	secretCopy.Annotations[deployKeyLabelName] = deployKeyId
-	// If the CustomResourceSubresources feature gate is not enabled,
-	// we must use Update instead of UpdateStatus to update the Status block of the Secret resource.
-	// UpdateStatus will not allow changes to the Spec of the resource,
-	// which is ideal for ensuring nothing other than resource status has been updated.
-	_, err := c.kubeclientset.CoreV1().Secrets(secret.Namespace).Update(context.TODO(), secretCopy, metav1.UpdateOptions{})
-	return err
+// hasKeyAnnotations reports whether the Secret has any of the annotations
+// recorded along with its deploy key id
+func hasKeyAnnotations(secret *corev1.Secret) bool {
+	for _, key := range []string{deployKeyFingerprintLabelName, createdTitleLabelName, projectIdLabelName, projectPathLabelName, createdAtLabelName} {
+		if _, ok := secret.Annotations[key]; ok {
+			return true
+		}
+	}
+	return false
 }
 
-// enqueue takes a Secret resource and converts it into a namespace/name
-// string which is then put onto the work queue. This method should *not* be
-// passed resources of any type other than Secret.
-func (c *Controller) enqueue(obj interface{}) {
-	c.workqueue.Add(obj)
+// forgetDeployKey removes the deploy key annotations of a Secret that only
+// left the informer because its marker label was removed. Otherwise, labeling
+// it again would find the annotation of the deleted key and never recreate it.
+func (c *Controller) forgetDeployKey(ctx context.Context, secret *corev1.Secret) error {
+	if noDelete {
+		// The key was left in place, so the annotation still holds
+		return nil
+	}
+	if c.state != nil {
+		return c.state.forget(ctx, c.state.overlay(secret))
+	}
+
+	current, err := c.kubeclientset.CoreV1().Secrets(secret.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, hasKey := current.Annotations[deployKeyLabelName]
+	_, hasToken := current.Annotations[deployTokenLabelName]
+	_, hasPairs := current.Annotations[deployKeyIdsLabelName]
+	if !hasKey && !hasToken && !hasPairs {
+		return nil
+	}
+
+	logV(4).Infof("Secret %s was unlabeled, removing its deployKey annotations", secret.GetName())
+	return c.updateSecret(ctx, current, func(secret *corev1.Secret) {
+		delete(secret.Annotations, deployKeyLabelName)
+		delete(secret.Annotations, deployKeyFingerprintLabelName)
+		delete(secret.Annotations, deployKeyIdsLabelName)
+		if hasToken {
+			delete(secret.Annotations, deployTokenLabelName)
+			delete(secret.Data, deployTokenUsernameKey)
+			delete(secret.Data, deployTokenPasswordKey)
+		}
+	})
 }
 
-// It enqueues the Secret resource to be processed.
-func (c *Controller) handleObject(obj interface{}) {
-	var object metav1.Object
-	var ok bool
-	if object, ok = obj.(metav1.Object); !ok {
-		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
-		if !ok {
-			utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type"))
-			return
+// syncSecret makes sure an existing Secret has its deploy key in gitlab. It
+// doesn't depend on how the Secret was retrieved, so both the workqueue loop
+// and the controller-runtime reconciler use it.
+func (c *Controller) syncSecret(ctx context.Context, secret *corev1.Secret) error {
+	secret = c.state.overlay(secret)
+	secret, err := c.withOwnerGitURL(ctx, secret)
+	if err != nil {
+		return err
+	}
+
+	if !isGitlabSecret(secret) {
+		logV(4).Infof("Secret %s is for another provider", secret.GetName())
+		skippedSecrets.WithLabelValues("other_provider").Inc()
+		return nil
+	}
+
+	ctx, cancel := c.gitlabContext(ctx, secret)
+	defer cancel()
+
+	if pairs := identityPairs(secret); len(pairs) > 0 {
+		if isSuspended(secret) {
+			logV(4).Infof("Secret %s is suspended, no need to update", secret.GetName())
+			return nil
 		}
-		object, ok = tombstone.Obj.(metav1.Object)
-		if !ok {
-			utilruntime.HandleError(fmt.Errorf("error decoding object tombstone, invalid type"))
-			return
+		return c.syncIdentityPairs(ctx, secret, pairs)
+	}
+
+	if _, found := gitURL(secret); !found {
+		if _, ok := identity(secret); ok && requireGitURL {
+			c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrMissingGitURL, MessageMissingGitURL, gitUrlLabelName)
+		}
+		logV(4).Infof("Secret %s is not a flux secret", secret.GetName())
+		skippedSecrets.WithLabelValues("missing_git_url").Inc()
+		return nil
+	}
+
+	if !allowedProject(projectPath(secret)) {
+		c.recorder.Eventf(secret, corev1.EventTypeWarning, ProjectNotAllowed, MessageProjectNotAllowed, projectPath(secret))
+		skippedSecrets.WithLabelValues("project_not_allowed").Inc()
+		return nil
+	}
+
+	// Another Secret of the project could otherwise create the same key
+	// between the lookup and the creation of this one
+	unlock := c.projects.lock(projectPath(secret))
+	defer unlock()
+
+	if _, ok := secret.Annotations[deployKeyMissingLabelName]; ok {
+		logV(4).Infof("Secret %s deployKey is missing and recreation is disabled, no need to update", secret.GetName())
+		return nil
+	}
+
+	// Pinned keys are managed outside of the controller, which only deletes
+	// them along with the secret
+	if isPinned(secret) {
+		logV(4).Infof("Secret %s has a pinned deployKey, no need to update", secret.GetName())
+		skippedSecrets.WithLabelValues("skip_annotation").Inc()
+		return nil
+	}
+
+	if isSuspended(secret) {
+		return c.suspendDeployKey(ctx, secret)
+	}
+
+	if isDeployToken(secret) {
+		return c.syncDeployToken(ctx, secret)
+	}
+
+	if _, ok := secret.Annotations[deployKeyLabelName]; ok && populateKnownHosts {
+		if err := c.populateKnownHosts(ctx, secret); err != nil {
+			return fmt.Errorf("failed to populate the known hosts: %s", err.Error())
+		}
+	}
+
+	// A deploy key a rotation retired is deleted before anything else, the
+	// secret no longer uses it
+	if _, ok := secret.Annotations[retiredKeyLabelName]; ok {
+		if err := c.deleteRetiredKey(ctx, secret); err != nil {
+			return err
+		}
+		secret = secret.DeepCopy()
+		delete(secret.Annotations, retiredKeyLabelName)
+	}
+
+	rotate := false
+	if _, ok := secret.Annotations[deployKeyLabelName]; ok && reconcileOnIdentityChange {
+		if rotate = identityChanged(secret); rotate {
+			if err := c.deleteRotatedKey(ctx, secret); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, ok := secret.Annotations[deployKeyLabelName]; ok && !rotate && keyTooOld(secret) {
+		return c.rotateAgedKey(ctx, secret)
+	}
+
+	// Checking that the key still exists in the gitlab API puts some pressure
+	// on it, so it's only done when verify mode is on
+	if _, ok := secret.Annotations[deployKeyLabelName]; ok && !rotate {
+		// A newly created key is verified once -verify-after-create elapsed
+		// whether verify mode is on or not
+		due := c.verifyDue(secret)
+		if !verifyKeys && !due {
+			logV(4).Infof("Secret %s already has deployKey, no need to update", secret.GetName())
+			return nil
+		}
+		// Only a sample of the keys is verified on each resync to bound the
+		// load, drift of the others is caught on a later one
+		if !due && rand.Float64() >= verifySampleFraction {
+			logV(4).Infof("Secret %s not sampled for verification on this resync", secret.GetName())
+			return nil
+		}
+		if !due && c.recentlyVerified(secret) {
+			logV(4).Infof("Secret %s deployKey was verified recently, no need to verify it again", secret.GetName())
+			return nil
+		}
+		recreate, err := c.verifyDeployKey(ctx, secret)
+		if err == nil {
+			c.verifiedCreated(secret)
+		}
+		if err != nil || !recreate {
+			if err == nil {
+				c.markVerified(secret)
+			}
+			return err
 		}
-		klog.V(4).Infof("Recovered deleted object '%s' from tombstone", object.GetName())
 	}
 
-	klog.V(4).Infof("Processing object: %s", object.GetName())
+	sshKey, err := publicKey(secret)
+	if err == errMissingIdentity {
+		// Nothing to retry until the secret is updated with an identity
+		c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrMissingIdentity, MessageMissingIdentity, identityKeys)
+		skippedSecrets.WithLabelValues("missing_identity").Inc()
+		return nil
+	}
+	if err != nil {
+		skippedSecrets.WithLabelValues("parse_error").Inc()
+		return err
+	}
+	if !c.checkKeyPolicy(secret, sshKey) {
+		// Nothing to retry until the secret is updated with another identity
+		return nil
+	}
+
+	if !c.belowKeyLimit(secret) {
+		return nil
+	}
+
+	project, err := c.getProject(ctx, secret)
+	if err != nil {
+		return err
+	}
+
+	readOnly := projectReadOnly(project)
+	if readOnly == "" && isMirror(secret) {
+		readOnly = readOnlyMirror
+	} else if readOnly == "" && isArchived(secret) {
+		readOnly = readOnlyArchived
+	} else if readOnly == "" && !pushAllowed(projectPath(secret)) {
+		readOnly = readOnlyPolicy
+	}
+	if !c.checkPushRequired(secret, readOnly) {
+		return nil
+	}
+
+	if !c.belowProjectKeyLimit(ctx, secret, project) {
+		return nil
+	}
+
+	title, canPush := desiredKey(secret)
+	if !canPush && requestedPush(secret) && !pushAllowed(projectPath(secret)) {
+		c.recorder.Eventf(secret, corev1.EventTypeWarning, PushPolicyDenied, MessagePushPolicyDenied, projectPath(secret))
+	}
+	annotations := map[string]string{}
+	sequence := keySequence(secret)
+	if rotate {
+		// The previous key is gone already, the sequence keeps the history
+		// of the rotations in the title
+		sequence++
+		annotations[keySequenceLabelName] = strconv.Itoa(sequence)
+	}
+	title = sequencedTitle(title, sequence)
+	if project.Mirror && !isMirror(secret) {
+		// Gitlab rejects push keys on pull mirrors, the annotation keeps the
+		// key read-only when it's verified later on
+		annotations[mirrorLabelName] = "true"
+		if canPush {
+			c.recorder.Eventf(secret, corev1.EventTypeNormal, ReadOnlyMirror, MessageReadOnlyMirror, projectPath(secret))
+		}
+		canPush = false
+	}
+	if project.Archived && !isArchived(secret) {
+		// Archived projects are read-only, the annotation keeps the key
+		// read-only when it's verified later on
+		annotations[archivedLabelName] = "true"
+		if canPush {
+			c.recorder.Eventf(secret, corev1.EventTypeNormal, ReadOnlyArchived, MessageReadOnlyArchived, projectPath(secret))
+		}
+		canPush = false
+	}
+	if titleEmbedHash {
+		title = embedTitleHash(title, project.PathWithNamespace, ssh.FingerprintSHA256(sshKey), canPush)
+	}
+
+	opts := &gitlab.AddDeployKeyOptions{Title: gitlab.String(title), Key: gitlab.String(c.authorizedKey(secret, sshKey)), CanPush: gitlab.Bool(canPush)}
+	keyResp, _, err := c.gitlabClient.DeployKeys.AddDeployKey(project.ID, opts, gitlab.WithContext(ctx))
+	if isTitleTaken(err) && titleUniqueness != titleUniqueNone {
+		// Another cluster already uses this title in the project
+		opts.Title = gitlab.String(disambiguateTitle(title, secret))
+		logV(4).Infof("Deploy key title %q is taken, retrying with %q", title, *opts.Title)
+		keyResp, _, err = c.gitlabClient.DeployKeys.AddDeployKey(project.ID, opts, gitlab.WithContext(ctx))
+	}
+	if isProjectKeyLimit(err) {
+		// Retrying won't help until keys are removed from the project, the
+		// next resync tries again
+		c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrProjectKeyLimit, MessageProjectKeyLimit, projectPath(secret), err.Error())
+		return nil
+	}
+	adopted := false
+	if isKeyTaken(err) {
+		// The key already is a deploy key of the project, e.g. it was added
+		// by hand before the secret was labeled, adopt it
+		var existing *gitlab.DeployKey
+		if existing, err = c.findDeployKey(ctx, project.ID, ssh.FingerprintSHA256(sshKey)); err == nil {
+			keyResp, opts.Title, adopted = existing, &existing.Title, true
+		}
+	}
+	if err != nil {
+		return err
+	}
+	var renamedFrom *corev1.Secret
+	if adopted && deleteGracePeriod > 0 {
+		// The key may be the one of a Secret deleted within the grace period,
+		// the Secret was renamed and the key only needs a new title
+		if deleted, ok := c.pending.renamed(project.PathWithNamespace, ssh.FingerprintSHA256(sshKey)); ok {
+			_, _, err := updateDeployKey(c.gitlabClient, project.ID, keyResp.ID, &updateDeployKeyOptions{Title: gitlab.String(title), CanPush: gitlab.Bool(canPush)}, gitlab.WithContext(ctx))
+			if err != nil {
+				// The title is fixed when the key is verified
+				klog.Warningf("Failed to retitle deploy key %d of renamed secret %s: %s", keyResp.ID, secret.GetName(), err.Error())
+			} else {
+				audit.record(auditUpdateDeployKey, project.PathWithNamespace, keyResp.ID, title, secret)
+				opts.Title = gitlab.String(title)
+			}
+			renamedFrom = deleted
+		}
+	}
+	if adopted && renamedFrom == nil {
+		var recreated bool
+		if keyResp, recreated, err = c.reconcileAdoptedPush(ctx, secret, project, keyResp, opts); err != nil {
+			return err
+		}
+		// A recreated key is the controller's own
+		adopted = !recreated
+	}
+	if adopted {
+		logV(4).Infof("Adopting deploy key %d", keyResp.ID)
+		deployKeysAdopted.Inc()
+	} else {
+		logV(4).Infof("Adding deploy key %d", keyResp.ID)
+		deployKeysCreated.Inc()
+		audit.record(auditCreateDeployKey, project.PathWithNamespace, keyResp.ID, keyResp.Title, secret)
+		c.markCreated(secret)
+	}
+
+	// Finally, we update the status block of the Secret resource to reflect the
+	// current state of the world
+	annotations[deployKeyLabelName] = strconv.Itoa(keyResp.ID)
+	annotations[deployKeyFingerprintLabelName] = ssh.FingerprintSHA256(sshKey)
+	annotations[createdTitleLabelName] = *opts.Title
+	annotations[projectIdLabelName] = strconv.Itoa(project.ID)
+	annotations[projectPathLabelName] = project.PathWithNamespace
+	annotations[createdAtLabelName] = time.Now().UTC().Format(time.RFC3339)
+
+	// The known hosts are written along with the annotations, so the Secret
+	// gets a single write per sync
+	var knownHosts map[string][]byte
+	var knownHostsErr error
+	if populateKnownHosts {
+		knownHosts, knownHostsErr = c.missingKnownHosts(secret)
+	}
+	if len(knownHosts) > 0 {
+		err = c.patchSecret(ctx, secret, annotations, knownHosts)
+	} else {
+		err = c.updateSecretStatus(ctx, secret, annotations)
+	}
+	if isNamespaceTerminating(err) {
+		// Retrying won't help, and a key the secret doesn't record would
+		// outlive it
+		c.recorder.Eventf(secret, corev1.EventTypeNormal, NamespaceTerminating, MessageNamespaceTerminating, keyResp.ID)
+		if adopted || noDelete {
+			return nil
+		}
+		if err := c.deletions.allow(); err != nil {
+			return err
+		}
+		logV(4).Infof("Deleting deploy key %d of secret %s, its namespace is terminating", keyResp.ID, secret.GetName())
+		resp, err := c.gitlabClient.DeployKeys.DeleteDeployKey(project.ID, keyResp.ID, gitlab.WithContext(ctx))
+		if err != nil && !isNotFound(resp) {
+			return err
+		}
+		if err == nil {
+			audit.record(auditDeleteDeployKey, project.PathWithNamespace, keyResp.ID, keyResp.Title, secret)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if knownHostsErr != nil {
+		// The key is created, a later sync fills the known hosts in
+		return fmt.Errorf("failed to populate the known hosts: %s", knownHostsErr.Error())
+	}
+
+	if canPush {
+		c.checkPushProtection(ctx, secret, project)
+	}
+
+	if renamedFrom != nil {
+		c.recorder.Eventf(secret, corev1.EventTypeNormal, DeployKeyRenamed, MessageDeployKeyRenamed, keyResp.ID, renamedFrom.Namespace, renamedFrom.Name, *opts.Title)
+		return nil
+	}
+	if adopted {
+		c.recorder.Eventf(secret, corev1.EventTypeNormal, DeployKeyAdopted, MessageDeployKeyAdopted, keyResp.ID, deployKeysURL(projectPath(secret)))
+		return nil
+	}
+	c.recorder.Eventf(secret, corev1.EventTypeNormal, SuccessSynced, MessageDeployKeyCreated, keyResp.ID, deployKeysURL(projectPath(secret)))
+	return nil
+}
+
+// forEachDeployKey calls fn with every deploy key of the project, going
+// through the pages of -gitlab-page-size keys until fn returns false or the
+// last page
+func (c *Controller) forEachDeployKey(ctx context.Context, projectID interface{}, fn func(*gitlab.DeployKey) bool) error {
+	opt := &gitlab.ListProjectDeployKeysOptions{PerPage: gitlabPageSize}
+	for {
+		keys, resp, err := c.gitlabClient.DeployKeys.ListProjectDeployKeys(projectID, opt, gitlab.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if !fn(key) {
+				return nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// findDeployKey returns the deploy key of the project with the fingerprint
+func (c *Controller) findDeployKey(ctx context.Context, projectID int, keyFingerprint string) (*gitlab.DeployKey, error) {
+	var found *gitlab.DeployKey
+	err := c.forEachDeployKey(ctx, projectID, func(key *gitlab.DeployKey) bool {
+		if f, err := fingerprint(key.Key); err == nil && f == keyFingerprint {
+			found = key
+		}
+		return found == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w %s in project %d", errDeployKeyNotFound, keyFingerprint, projectID)
+	}
+	return found, nil
+}
+
+// belowProjectKeyLimit reports whether the project can take another deploy
+// key under -project-key-limit, recording a Warning event when it can't or
+// nears the limit. Failing to count the keys doesn't hold the creation, gitlab
+// rejecting it is handled all the same.
+func (c *Controller) belowProjectKeyLimit(ctx context.Context, secret *corev1.Secret, project *gitlab.Project) bool {
+	if projectKeyLimit <= 0 {
+		return true
+	}
+	count, err := c.countDeployKeys(ctx, project.ID)
+	if err != nil {
+		klog.Warningf("Failed to count the deploy keys of project %s: %s", projectPath(secret), err.Error())
+		return true
+	}
+	if count >= projectKeyLimit {
+		c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrProjectKeyLimit, MessageProjectKeyLimit, projectPath(secret), fmt.Sprintf("%d of %d", count, projectKeyLimit))
+		return false
+	}
+	if count >= projectKeyLimit*9/10 {
+		c.recorder.Eventf(secret, corev1.EventTypeWarning, ProjectKeyLimitNear, MessageProjectKeyLimitNear, projectPath(secret), count, projectKeyLimit)
+	}
+	return true
+}
+
+// countDeployKeys returns the number of deploy keys of the project
+func (c *Controller) countDeployKeys(ctx context.Context, projectID int) (int, error) {
+	count := 0
+	err := c.forEachDeployKey(ctx, projectID, func(*gitlab.DeployKey) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+// checkPushProtection warns with an event when the push key of the secret
+// won't be able to push to the project's default branch because of its
+// protection. Failing to check doesn't fail the sync.
+func (c *Controller) checkPushProtection(ctx context.Context, secret *corev1.Secret, project *gitlab.Project) {
+	if project.DefaultBranch == "" {
+		return
+	}
+	branch, resp, err := c.gitlabClient.ProtectedBranches.GetProtectedBranch(project.ID, project.DefaultBranch, gitlab.WithContext(ctx))
+	if isNotFound(resp) {
+		// The branch isn't protected
+		return
+	}
+	if err != nil {
+		klog.Warningf("Failed to check the protection of branch %s of project %s: %s", project.DefaultBranch, projectPath(secret), err.Error())
+		return
+	}
+	for _, level := range branch.PushAccessLevels {
+		if level.AccessLevel > gitlab.NoPermissions {
+			return
+		}
+	}
+	c.recorder.Eventf(secret, corev1.EventTypeWarning, PushProtected, MessagePushProtected, project.DefaultBranch, projectPath(secret))
+}
+
+// belowKeyLimit reports whether a new deploy key can be created without
+// going over -max-managed-keys. Reaching the limit stops the creation of new
+// keys, which guards against a creation loop, the existing ones are still
+// managed.
+func (c *Controller) belowKeyLimit(secret *corev1.Secret) bool {
+	if maxManagedKeys <= 0 {
+		return true
+	}
+	secrets, err := c.list()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to count the managed keys: %s", err.Error()))
+		return false
+	}
+	managed := 0
+	for _, s := range secrets {
+		if _, ok := s.Annotations[deployKeyLabelName]; ok {
+			managed++
+		}
+		if keys, err := pairDeployKeys(s); err == nil {
+			managed += len(keys)
+		}
+	}
+	if managed < maxManagedKeys {
+		keyLimitReached.Set(0)
+		return true
+	}
+
+	klog.Errorf("MANAGED KEYS LIMIT REACHED: the controller manages %d deploy keys, not creating one for secret %s/%s", managed, secret.Namespace, secret.Name)
+	keyLimitReached.Set(1)
+	c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrKeyLimitReached, MessageKeyLimitReached, managed)
+	return false
+}
+
+// markSynced records that the Secret was just synced successfully
+func (c *Controller) markSynced(secret *corev1.Secret) {
+	c.syncedMu.Lock()
+	defer c.syncedMu.Unlock()
+	if c.synced == nil {
+		c.synced = map[string]time.Time{}
+	}
+	c.synced[secret.Namespace+"/"+secret.Name] = time.Now()
+}
+
+// lastSynced returns the time of the last successful sync of the Secret
+func (c *Controller) lastSynced(secret *corev1.Secret) (time.Time, bool) {
+	c.syncedMu.Lock()
+	defer c.syncedMu.Unlock()
+	synced, ok := c.synced[secret.Namespace+"/"+secret.Name]
+	return synced, ok
+}
+
+// listSecrets lists the Secrets in the informer cache
+func (c *Controller) listSecrets() ([]*corev1.Secret, error) {
+	return c.secretsLister.List(labels.Everything())
+}
+
+// recentlyVerified reports whether the Secret's deploy key was verified
+// within the verify cache TTL
+func (c *Controller) recentlyVerified(secret *corev1.Secret) bool {
+	c.verifiedMu.Lock()
+	defer c.verifiedMu.Unlock()
+	v, ok := c.verified[secret.Namespace+"/"+secret.Name]
+	return ok && v.deployKey == secret.Annotations[deployKeyLabelName] && time.Now().Before(v.until)
+}
+
+// markVerified records that the Secret's deploy key was just verified
+func (c *Controller) markVerified(secret *corev1.Secret) {
+	if verifyCacheTTL <= 0 {
+		return
+	}
+	c.verifiedMu.Lock()
+	defer c.verifiedMu.Unlock()
+	if c.verified == nil {
+		c.verified = map[string]verification{}
+	}
+	c.verified[secret.Namespace+"/"+secret.Name] = verification{
+		deployKey: secret.Annotations[deployKeyLabelName],
+		until:     time.Now().Add(verifyCacheTTL),
+	}
+}
+
+// forgetVerified drops the verification and sync time of a deleted Secret
+func (c *Controller) forgetVerified(secret *corev1.Secret) {
+	c.verifiedMu.Lock()
+	delete(c.verified, secret.Namespace+"/"+secret.Name)
+	c.verifiedMu.Unlock()
+
+	c.syncedMu.Lock()
+	delete(c.synced, secret.Namespace+"/"+secret.Name)
+	c.syncedMu.Unlock()
+
+	c.createdMu.Lock()
+	delete(c.created, secret.Namespace+"/"+secret.Name)
+	c.createdMu.Unlock()
+}
+
+// markCreated schedules the -verify-after-create verification of the deploy
+// key just created for the Secret
+func (c *Controller) markCreated(secret *corev1.Secret) {
+	if verifyAfterCreate <= 0 {
+		return
+	}
+	c.createdMu.Lock()
+	defer c.createdMu.Unlock()
+	if c.created == nil {
+		c.created = map[string]time.Time{}
+	}
+	c.created[secret.Namespace+"/"+secret.Name] = time.Now().Add(verifyAfterCreate)
+}
+
+// verifyRequeue returns how long to wait before syncing the Secret again to
+// verify its newly created deploy key, false if it has none waiting
+func (c *Controller) verifyRequeue(secret *corev1.Secret) (time.Duration, bool) {
+	c.createdMu.Lock()
+	defer c.createdMu.Unlock()
+	due, ok := c.created[secret.Namespace+"/"+secret.Name]
+	if !ok || !time.Now().Before(due) {
+		return 0, false
+	}
+	return time.Until(due), true
+}
+
+// verifyDue reports whether the newly created deploy key of the Secret is due
+// for its verification
+func (c *Controller) verifyDue(secret *corev1.Secret) bool {
+	c.createdMu.Lock()
+	defer c.createdMu.Unlock()
+	due, ok := c.created[secret.Namespace+"/"+secret.Name]
+	return ok && !time.Now().Before(due)
+}
+
+// verifiedCreated records that the newly created deploy key of the Secret
+// was verified
+func (c *Controller) verifiedCreated(secret *corev1.Secret) {
+	c.createdMu.Lock()
+	defer c.createdMu.Unlock()
+	delete(c.created, secret.Namespace+"/"+secret.Name)
+}
+
+// verifyDeployKey checks the deploy key recorded in the secret against the
+// gitlab API. It reports whether the key has to be created again.
+func (c *Controller) verifyDeployKey(ctx context.Context, secret *corev1.Secret) (bool, error) {
+	deployKey, err := strconv.Atoi(secret.Annotations[deployKeyLabelName])
+	if err != nil {
+		return false, err
+	}
+	projectID, _ := projectRef(secret)
+
+	key, resp, err := c.gitlabClient.DeployKeys.GetDeployKey(projectID, deployKey, gitlab.WithContext(ctx))
+	if isNotFound(resp) {
+		if !verifyRecreate {
+			return false, c.clearMissingKey(ctx, secret, deployKey)
+		}
+		logV(4).Infof("Deploy key %d of secret %s is missing, recreating it", deployKey, secret.GetName())
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// The recorded fingerprint tells whether the key id still points to the
+	// key derived from the secret identity
+	if recorded, ok := secret.Annotations[deployKeyFingerprintLabelName]; ok {
+		if fp, err := fingerprint(key.Key); err != nil || fp != recorded {
+			if !verifyRecreate {
+				klog.Warningf("Deploy key %d doesn't match the fingerprint of secret %s, leaving it as recreation is disabled", deployKey, secret.GetName())
+				return false, nil
+			}
+			logV(4).Infof("Deploy key %d doesn't match the fingerprint of secret %s, recreating it", deployKey, secret.GetName())
+			return true, nil
+		}
+	}
+
+	return c.reconcileKeyMetadata(ctx, secret, projectID, key)
+}
+
+// identityChanged reports whether the secret identity no longer matches the
+// fingerprint recorded along with its deploy key
+func identityChanged(secret *corev1.Secret) bool {
+	recorded, ok := secret.Annotations[deployKeyFingerprintLabelName]
+	if !ok {
+		return false
+	}
+	sshKey, err := publicKey(secret)
+	if err != nil {
+		return false
+	}
+	return ssh.FingerprintSHA256(sshKey) != recorded
+}
+
+// deleteRotatedKey deletes the deploy key of the previous identity of the
+// secret, which is about to get a key for its new one
+func (c *Controller) deleteRotatedKey(ctx context.Context, secret *corev1.Secret) error {
+	deployKey, err := strconv.Atoi(secret.Annotations[deployKeyLabelName])
+	if err != nil {
+		return err
+	}
+	klog.Infof("Identity of secret %s/%s changed, replacing deploy key %d", secret.Namespace, secret.Name, deployKey)
+	c.recorder.Eventf(secret, corev1.EventTypeNormal, IdentityRotated, MessageIdentityRotated, deployKey)
+	if noDelete {
+		return nil
+	}
+	if err := c.deletions.allow(); err != nil {
+		return err
+	}
+	projectID, _ := projectRef(secret)
+	resp, err := c.gitlabClient.DeployKeys.DeleteDeployKey(projectID, deployKey, gitlab.WithContext(ctx))
+	if err != nil && !isNotFound(resp) {
+		return err
+	}
+	if err == nil {
+		audit.record(auditDeleteDeployKey, projectPath(secret), deployKey, secret.Annotations[createdTitleLabelName], secret)
+	}
+	return nil
+}
+
+// suspendDeployKey deletes the deploy key of a suspended Secret and clears
+// its annotations, so a key is created again once the suspension is lifted
+func (c *Controller) suspendDeployKey(ctx context.Context, secret *corev1.Secret) error {
+	value, ok := secret.Annotations[deployKeyLabelName]
+	if !ok {
+		logV(4).Infof("Secret %s is suspended, no need to update", secret.GetName())
+		skippedSecrets.WithLabelValues("skip_annotation").Inc()
+		return nil
+	}
+	deployKey, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if noDelete {
+		klog.Infof("Not deleting deploy key %d of suspended secret %s/%s, deletion is disabled", deployKey, secret.Namespace, secret.Name)
+		return nil
+	}
+	if err := c.deletions.allow(); err != nil {
+		return err
+	}
+
+	projectID, _ := projectRef(secret)
+	resp, err := c.gitlabClient.DeployKeys.DeleteDeployKey(projectID, deployKey, gitlab.WithContext(ctx))
+	if err != nil && !isNotFound(resp) {
+		return err
+	}
+	if err == nil {
+		audit.record(auditDeleteDeployKey, projectPath(secret), deployKey, secret.Annotations[createdTitleLabelName], secret)
+	}
+
+	err = c.updateSecret(ctx, secret, func(secret *corev1.Secret) {
+		delete(secret.Annotations, deployKeyLabelName)
+		delete(secret.Annotations, deployKeyFingerprintLabelName)
+		delete(secret.Annotations, createdTitleLabelName)
+		delete(secret.Annotations, createdAtLabelName)
+	})
+	if err != nil {
+		return err
+	}
+	c.forgetVerified(secret)
+	c.recorder.Eventf(secret, corev1.EventTypeNormal, DeployKeySuspended, MessageDeployKeySuspended, deployKey, projectPath(secret))
+	return nil
+}
+
+// clearMissingKey replaces the deploy key annotations of a Secret whose key
+// was deleted in gitlab with the deployKeyMissing annotation, so the Secret
+// doesn't claim a key it no longer has while recreation is disabled
+func (c *Controller) clearMissingKey(ctx context.Context, secret *corev1.Secret, deployKey int) error {
+	klog.Infof("Deploy key %d of secret %s/%s is missing, clearing its annotation", deployKey, secret.Namespace, secret.Name)
+	err := c.updateSecret(ctx, secret, func(secret *corev1.Secret) {
+		delete(secret.Annotations, deployKeyLabelName)
+		delete(secret.Annotations, deployKeyFingerprintLabelName)
+		secret.Annotations[deployKeyMissingLabelName] = strconv.Itoa(deployKey)
+	})
+	if err != nil {
+		return err
+	}
+	c.recorder.Eventf(secret, corev1.EventTypeWarning, DeployKeyMissing, MessageDeployKeyMissing, deployKey, projectPath(secret))
+	return nil
+}
+
+// The -adopt-push-mismatch behaviors when an adopted deploy key's push
+// permission differs from the one the Secret asks for
+const (
+	// adoptPushUpdate updates the key, or recreates it on gitlab versions
+	// that can't update deploy keys
+	adoptPushUpdate = "update"
+	// adoptPushKeep keeps the key as it is
+	adoptPushKeep = "keep"
+)
+
+// reconcileAdoptedPush gives the adopted deploy key the push permission of
+// opts with -adopt-push-mismatch=update. It returns the key the Secret gets,
+// and whether it was recreated because gitlab can't update deploy keys.
+func (c *Controller) reconcileAdoptedPush(ctx context.Context, secret *corev1.Secret, project *gitlab.Project, key *gitlab.DeployKey, opts *gitlab.AddDeployKeyOptions) (*gitlab.DeployKey, bool, error) {
+	canPush := *opts.CanPush
+	if adoptPushMismatch != adoptPushUpdate || key.CanPush == nil || *key.CanPush == canPush {
+		return key, false, nil
+	}
+
+	logV(4).Infof("Updating the push permission of adopted deploy key %d of secret %s", key.ID, secret.GetName())
+	_, resp, err := updateDeployKey(c.gitlabClient, project.ID, key.ID, &updateDeployKeyOptions{CanPush: gitlab.Bool(canPush)}, gitlab.WithContext(ctx))
+	if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed) {
+		// Older gitlab versions can't update deploy keys
+		if noDelete {
+			klog.Infof("Not recreating adopted deploy key %d of project %s, deletion is disabled", key.ID, project.PathWithNamespace)
+			c.recorder.Eventf(secret, corev1.EventTypeNormal, SkippedDelete, MessageSkippedDelete, key.ID, project.PathWithNamespace)
+			return key, false, nil
+		}
+		if err := c.deletions.allow(); err != nil {
+			return nil, false, err
+		}
+		logV(4).Infof("Deploy key %d can't be updated, deleting it to recreate it", key.ID)
+		if _, err := c.gitlabClient.DeployKeys.DeleteDeployKey(project.ID, key.ID, gitlab.WithContext(ctx)); err != nil {
+			return nil, false, err
+		}
+		audit.record(auditDeleteDeployKey, project.PathWithNamespace, key.ID, key.Title, secret)
+		// The next sync creates the key should this fail
+		recreated, _, err := c.gitlabClient.DeployKeys.AddDeployKey(project.ID, opts, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, false, err
+		}
+		c.recorder.Eventf(secret, corev1.EventTypeNormal, AdoptedPushMismatch, MessageAdoptedPushRecreated, key.ID, *key.CanPush, recreated.ID, canPush)
+		return recreated, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	audit.record(auditUpdateDeployKey, project.PathWithNamespace, key.ID, key.Title, secret)
+
+	c.recorder.Eventf(secret, corev1.EventTypeNormal, AdoptedPushMismatch, MessageAdoptedPushUpdated, key.ID, *key.CanPush, canPush)
+	key.CanPush = gitlab.Bool(canPush)
+	return key, false, nil
+}
+
+// reconcileKeyMetadata updates the title and push permission of the deploy
+// key when they drifted from the ones the secret asks for. Keys that can't be
+// updated in place are deleted and it reports that they have to be recreated,
+// unless deletion is disabled.
+func (c *Controller) reconcileKeyMetadata(ctx context.Context, secret *corev1.Secret, projectID interface{}, key *gitlab.DeployKey) (bool, error) {
+	title, canPush := desiredKey(secret)
+	title = sequencedTitle(title, keySequence(secret))
+	if titleEmbedHash {
+		if fp, err := fingerprint(key.Key); err == nil {
+			project := keyProject(secret)
+			if titleDrifted(key.Title, project, fp, key.CanPush != nil && *key.CanPush) {
+				c.recorder.Eventf(secret, corev1.EventTypeWarning, TitleDrift, MessageTitleDrift, key.ID, key.Title)
+			}
+			title = embedTitleHash(title, project, fp, canPush)
+		}
+	}
+	sameTitle := key.Title == title || key.Title == disambiguateTitle(title, secret)
+	if sameTitle && key.CanPush != nil && *key.CanPush == canPush {
+		return false, nil
+	}
+
+	logV(4).Infof("Updating deploy key %d of secret %s", key.ID, secret.GetName())
+	_, resp, err := updateDeployKey(c.gitlabClient, projectID, key.ID, &updateDeployKeyOptions{Title: gitlab.String(title), CanPush: gitlab.Bool(canPush)}, gitlab.WithContext(ctx))
+	if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed) {
+		// Older gitlab versions can't update deploy keys
+		if noDelete {
+			klog.Infof("Not recreating drifted deploy key %d of project %s, deletion is disabled", key.ID, projectPath(secret))
+			c.recorder.Eventf(secret, corev1.EventTypeNormal, SkippedDelete, MessageSkippedDelete, key.ID, projectPath(secret))
+			return false, nil
+		}
+		if err := c.deletions.allow(); err != nil {
+			return false, err
+		}
+		logV(4).Infof("Deploy key %d can't be updated, deleting it to recreate it", key.ID)
+		if _, err := c.gitlabClient.DeployKeys.DeleteDeployKey(projectID, key.ID, gitlab.WithContext(ctx)); err != nil {
+			return false, err
+		}
+		audit.record(auditDeleteDeployKey, projectPath(secret), key.ID, key.Title, secret)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	audit.record(auditUpdateDeployKey, projectPath(secret), key.ID, title, secret)
+
+	c.recorder.Event(secret, corev1.EventTypeNormal, SuccessUpdated, MessageResourceUpdated)
+	return false, nil
+}
+
+// The -title-uniqueness scopes of the suffix of a title another deploy key
+// of the project already has
+const (
+	// titleUniqueSecret suffixes it with a hash of the secret
+	// namespace/name, so the same secret in two clusters gets the same title
+	titleUniqueSecret = "secret"
+	// titleUniqueCluster suffixes it with a hash of the -cluster-name and
+	// the secret namespace/name, so every cluster gets its own title
+	titleUniqueCluster = "cluster"
+	// titleUniqueNone doesn't suffix it, the key isn't created
+	titleUniqueNone = "none"
+)
+
+// disambiguateTitle suffixes the title with a short hash scoped by
+// -title-uniqueness, for when another deploy key of the project has the title
+func disambiguateTitle(title string, secret *corev1.Secret) string {
+	scope := secret.GetNamespace() + "/" + secret.GetName()
+	switch titleUniqueness {
+	case titleUniqueNone:
+		return title
+	case titleUniqueCluster:
+		scope = clusterName + "/" + scope
+	}
+	h := fnv.New32a()
+	h.Write([]byte(scope))
+	suffix := fmt.Sprintf(" (%08x)", h.Sum32())
+	if len(title)+len(suffix) > maxDeployKeyTitleLength {
+		title = title[:maxDeployKeyTitleLength-len(suffix)]
+	}
+	return title + suffix
+}
+
+// isMirror reports whether the secret's project is marked as a pull mirror
+func isMirror(secret *corev1.Secret) bool {
+	mirror, _ := strconv.ParseBool(secret.Annotations[mirrorLabelName])
+	return mirror
+}
+
+// isArchived reports whether the secret's project is marked as archived
+func isArchived(secret *corev1.Secret) bool {
+	archived, _ := strconv.ParseBool(secret.Annotations[archivedLabelName])
+	return archived
+}
+
+// The reasons a project can't have push keys
+const (
+	readOnlyMirror   = "a pull mirror"
+	readOnlyArchived = "archived"
+	readOnlyPolicy   = "not allowed push keys by the push policy"
+)
+
+// projectReadOnly returns why the deploy keys of the project can't push as
+// gitlab reports it, empty when they can
+func projectReadOnly(project *gitlab.Project) string {
+	switch {
+	case project.Mirror:
+		return readOnlyMirror
+	case project.Archived:
+		return readOnlyArchived
+	}
+	return ""
+}
+
+// isGitlabSecret reports whether the secret's provider is gitlab
+func isGitlabSecret(secret *corev1.Secret) bool {
+	provider, ok := secret.Annotations[providerLabelName]
+	if !ok {
+		provider = defaultProvider
+	}
+	return strings.EqualFold(provider, gitlabProvider)
+}
+
+// isPinned reports whether the secret's deploy key is pinned
+func isPinned(secret *corev1.Secret) bool {
+	pinned, _ := strconv.ParseBool(secret.Annotations[deployKeyPinnedLabelName])
+	return pinned
+}
+
+// isSuspended reports whether the secret's deploy key is suspended
+func isSuspended(secret *corev1.Secret) bool {
+	suspended, _ := strconv.ParseBool(secret.Annotations[suspendLabelName])
+	return suspended
+}
+
+// pushRequired reports whether the secret requires a deploy key that can push
+func pushRequired(secret *corev1.Secret) bool {
+	required, _ := strconv.ParseBool(secret.Annotations[pushRequiredLabelName])
+	return required
+}
+
+// checkPushRequired reports whether the deploy key of the secret can be
+// created, recording a Warning event when the secret requires push but the
+// key can't push to its project, readOnly telling why when it can't
+func (c *Controller) checkPushRequired(secret *corev1.Secret, readOnly string) bool {
+	if !pushRequired(secret) {
+		return true
+	}
+	if !allowPushKeys {
+		c.recorder.Event(secret, corev1.EventTypeWarning, ErrPushRequired, MessagePushNotAllowed)
+		return false
+	}
+	if readOnly != "" {
+		c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrPushRequired, MessagePushRequiredReadOnly, projectPath(secret), readOnly)
+		return false
+	}
+	return true
+}
+
+// desiredKey returns the title and push permission the secret's deploy key
+// should have. The secret annotations take precedence over the defaults of
+// its namespace, which take precedence over the -deploy-key-title and
+// -deploy-key-can-push flags.
+func desiredKey(secret *corev1.Secret) (string, bool) {
+	namespaceDefaults := defaults.get(secret.Namespace)
+
+	title := deployKeyTitle
+	if value, ok := namespaceDefaults.titleOf(secret); ok {
+		title = value
+	}
+	if value, ok := secret.Annotations[deployKeyTitleLabelName]; ok && value != "" {
+		title = value
+	}
+	// Tell apart the keys of the different kinds of flux sources
+	if kind, ok := secret.Annotations[sourceKindLabelName]; ok && kind != "" {
+		title = fmt.Sprintf("%s %s/%s", title, kind, secret.GetName())
+	}
+	title = truncateTitle(title)
+
+	canPush := requestedPush(secret)
+	// Pull mirrors and archived projects can't have push keys, nor can any
+	// with -allow-push-keys disabled or outside of the -push-policy
+	if isMirror(secret) || isArchived(secret) || !allowPushKeys || !pushAllowed(projectPath(secret)) {
+		canPush = false
+	}
+	// A required push permission is never downgraded, the key isn't created
+	// at all when it can't push
+	if pushRequired(secret) {
+		canPush = true
+	}
+
+	return title, canPush
+}
+
+// requestedPush returns the push permission asked for the secret's deploy
+// key by its annotations, or else the defaults of its namespace or the
+// -deploy-key-can-push flag, whether or not its project allows it
+func requestedPush(secret *corev1.Secret) bool {
+	canPush := deployKeyCanPush
+	if namespaceDefaults := defaults.get(secret.Namespace); namespaceDefaults != nil && namespaceDefaults.CanPush != nil {
+		canPush = *namespaceDefaults.CanPush
+	}
+	if value, ok := secret.Annotations[deployKeyCanPushLabelName]; ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			canPush = b
+		} else {
+			logV(4).Infof("Ignoring invalid %s annotation %q of secret %s", deployKeyCanPushLabelName, value, secret.GetName())
+		}
+	}
+	return canPush
+}
+
+// truncateTitle cuts the title to the length gitlab accepts
+func truncateTitle(title string) string {
+	if len(title) > maxDeployKeyTitleLength {
+		return title[:maxDeployKeyTitleLength]
+	}
+	return title
+}
+
+// gitlabContext returns the context of the gitlab calls made to sync the
+// Secret, which times out after the request timeout. Cancelling it records how
+// many calls were made.
+func (c *Controller) gitlabContext(ctx context.Context, secret *corev1.Secret) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, c.requestTimeout(secret))
+	ctx, requests := withRequestCounter(ctx)
+	return ctx, func() {
+		cancel()
+		if n := atomic.LoadInt32(requests); n > 0 {
+			gitlabRequestsPerSync.Observe(float64(n))
+		}
+	}
+}
+
+// requestTimeout returns the timeout of the secret's gitlab calls, falling
+// back to the global timeout when the annotation is invalid
+func (c *Controller) requestTimeout(secret *corev1.Secret) time.Duration {
+	timeout, err := parseRequestTimeout(secret)
+	if err != nil {
+		if c.invalidTimeouts.warn(secret) {
+			c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrInvalidRequestTimeout, MessageInvalidRequestTimeout, secret.Annotations[requestTimeoutLabelName], requestTimeout)
+		}
+		return requestTimeout
+	}
+	c.invalidTimeouts.forget(secret)
+	return timeout
+}
+
+// invalidTimeouts records, by Secret UID, the invalid request timeout
+// annotation value last warned about, so each value is only warned about
+// once rather than on every sync and gitlab call
+type invalidTimeouts struct {
+	mu     sync.Mutex
+	warned map[types.UID]string
+}
+
+// warn reports whether the invalid request timeout of the Secret wasn't
+// warned about yet, and records it
+func (t *invalidTimeouts) warn(secret *corev1.Secret) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	value := secret.Annotations[requestTimeoutLabelName]
+	if warned, ok := t.warned[secret.UID]; ok && warned == value {
+		return false
+	}
+	if t.warned == nil {
+		t.warned = map[types.UID]string{}
+	}
+	t.warned[secret.UID] = value
+	return true
+}
+
+// forget forgets the Secret once its request timeout is valid again
+func (t *invalidTimeouts) forget(secret *corev1.Secret) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.warned, secret.UID)
+}
+
+// parseRequestTimeout returns the timeout of the secret's gitlab calls, which
+// is the global timeout unless the secret overrides it
+func parseRequestTimeout(secret *corev1.Secret) (time.Duration, error) {
+	value, ok := secret.Annotations[requestTimeoutLabelName]
+	if !ok {
+		return requestTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("request timeout must be positive, got %s", timeout)
+	}
+	return timeout, nil
+}
+
+// identity returns the secret's private key, read from the first of the
+// identity keys present in the secret data
+func identity(secret *corev1.Secret) ([]byte, bool) {
+	for _, selector := range strings.Split(identityKeys, ",") {
+		key, fieldPath := splitIdentitySelector(selector)
+		data, ok := secret.Data[key]
+		if !ok {
+			continue
+		}
+		if fieldPath == "" {
+			return data, true
+		}
+		if value, ok := selectField(data, fieldPath); ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// splitIdentitySelector splits an -identity-keys entry into the data key and
+// the optional field path within it, e.g. config.yaml#ssh.privateKey
+func splitIdentitySelector(selector string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(selector), "#", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// selectField returns the string at the dot separated field path of a YAML
+// or JSON document
+func selectField(data []byte, fieldPath string) ([]byte, bool) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, false
+	}
+	for _, field := range strings.Split(fieldPath, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[field]; !ok {
+			return nil, false
+		}
+	}
+	s, ok := value.(string)
+	return []byte(s), ok && s != ""
+}
+
+// validateIdentityKeys checks the -identity-keys selectors
+func validateIdentityKeys(keys string) error {
+	for _, selector := range strings.Split(keys, ",") {
+		key, fieldPath := splitIdentitySelector(selector)
+		if key == "" {
+			return fmt.Errorf("empty data key in %q", selector)
+		}
+		if strings.Contains(selector, "#") && (fieldPath == "" || strings.Contains(fieldPath, "..") || strings.HasPrefix(fieldPath, ".") || strings.HasSuffix(fieldPath, ".")) {
+			return fmt.Errorf("invalid field path in %q", selector)
+		}
+	}
+	return nil
+}
+
+// publicKey derives the public deploy key from the secret's private identity
+func publicKey(secret *corev1.Secret) (ssh.PublicKey, error) {
+	data, ok := identity(secret)
+	if !ok {
+		return nil, errMissingIdentity
+	}
+	return parsePublicKey(data)
+}
+
+// parsePublicKey derives the public deploy key from a private identity
+func parsePublicKey(data []byte) (ssh.PublicKey, error) {
+	k, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity is a %T, only RSA keys are supported", k)
+	}
+
+	return ssh.NewPublicKey(rsaKey.Public())
+}
+
+// getProject returns the gitlab project of the secret's git url, preferring
+// the project id recorded in the secret to its path
+func (c *Controller) getProject(ctx context.Context, secret *corev1.Secret) (*gitlab.Project, error) {
+	projectID, cached := projectRef(secret)
+	if !cached {
+		return c.lookupProject(ctx, secret)
+	}
+
+	p, resp, err := getProject(ctx, c.gitlabClient, projectID)
+	if isNotFound(resp) {
+		// The recorded project id is stale, look the project up again by path
+		logV(4).Infof("Project %v recorded in secret %s no longer exists", projectID, secret.GetName())
+		return c.refreshProjectID(ctx, secret)
+	}
+	c.checkEmptyProject(secret, err)
+	return p, err
+}
+
+// refreshProjectID looks the project of the secret up by path after gitlab
+// answered its recorded project id with a 404, and rewrites the recorded id
+// with the one the path resolves to, or removes it when gitlab has no project
+// at the path either, so the stale id isn't tried again
+func (c *Controller) refreshProjectID(ctx context.Context, secret *corev1.Secret) (*gitlab.Project, error) {
+	project, err := c.lookupProject(ctx, secret)
+	if err != nil && !isProjectMissing(err) {
+		return nil, err
+	}
+	if err == nil && secret.Annotations[projectIdLabelName] == strconv.Itoa(project.ID) {
+		return project, nil
+	}
+
+	updateErr := c.updateSecret(ctx, secret, func(secret *corev1.Secret) {
+		if project != nil {
+			secret.Annotations[projectIdLabelName] = strconv.Itoa(project.ID)
+		} else {
+			delete(secret.Annotations, projectIdLabelName)
+		}
+	})
+	// A secret already deleted has no annotation left to fix
+	if updateErr != nil && !errors.IsNotFound(updateErr) {
+		return nil, fmt.Errorf("failed to update the project id of secret %s: %w", secret.GetName(), updateErr)
+	}
+	return project, err
+}
+
+// retryOnStaleProject retries a request gitlab answered with a 404 for the
+// project id recorded in the secret against the project its path resolves
+// to, when that's another project. The project id is refreshed on the way.
+func (c *Controller) retryOnStaleProject(ctx context.Context, secret *corev1.Secret, resp *gitlab.Response, err error, request func(pid interface{}) (*gitlab.Response, error)) (*gitlab.Response, error) {
+	projectID, cached := projectRef(secret)
+	if !cached || !isNotFound(resp) {
+		return resp, err
+	}
+	project, lookupErr := c.refreshProjectID(ctx, secret)
+	switch {
+	case lookupErr == nil && project.ID != projectID:
+		return request(project.ID)
+	case lookupErr == nil || isProjectMissing(lookupErr):
+		// The project is the recorded one or is gone, the 404 stands
+		return resp, err
+	default:
+		return nil, lookupErr
+	}
+}
+
+// lookupProject returns the gitlab project of the secret's git url by path
+func (c *Controller) lookupProject(ctx context.Context, secret *corev1.Secret) (*gitlab.Project, error) {
+	path := projectPath(secret)
+	if err, ok := c.missingProjects.get(path); ok {
+		logV(4).Infof("Project %s of secret %s was recently not found, not looking it up again", path, secret.GetName())
+		return nil, err
+	}
+	p, resp, err := getProject(ctx, c.gitlabClient, projectIDOrPath(path))
+	if isNotFound(resp) {
+		c.missingProjects.add(path, err)
+	}
+	c.checkEmptyProject(secret, err)
+	return p, err
+}
+
+// checkEmptyProject records a Warning event when gitlab answered the project
+// request of the secret with an empty project
+func (c *Controller) checkEmptyProject(secret *corev1.Secret, err error) {
+	if goerrors.Is(err, errEmptyProject) {
+		c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrEmptyProject, MessageEmptyProject, projectPath(secret))
+	}
+}
+
+// managedAnnotations are the annotations the controller writes. They're
+// always part of its apply patches, as server-side apply removes the fields a
+// field manager stops applying.
+var managedAnnotations = []string{
+	deployKeyLabelName,
+	deployKeyFingerprintLabelName,
+	createdTitleLabelName,
+	projectIdLabelName,
+	projectPathLabelName,
+	createdAtLabelName,
+	keySequenceLabelName,
+	retiredKeyLabelName,
+	mirrorLabelName,
+	archivedLabelName,
+	deployTokenLabelName,
+	deployKeyIdsLabelName,
+}
+
+// updateSecretStatus sets the annotations on the Secret with a server-side
+// apply under the controller field manager, so it only owns its own
+// annotations and doesn't conflict with Flux re-applying the Secret. The
+// patch carries no resource version, so it doesn't fail when the Secret
+// changed since it was read either.
+func (c *Controller) updateSecretStatus(ctx context.Context, secret *corev1.Secret, annotations map[string]string) error {
+	if c.state != nil {
+		return kubernetesError(c.state.update(ctx, secret, func(secret *corev1.Secret) {
+			for key, value := range annotations {
+				secret.Annotations[key] = value
+			}
+		}))
+	}
+	patch, err := statusPatch(secret, annotations)
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = c.kubeclientset.CoreV1().Secrets(secret.Namespace).Patch(ctx, secret.Name, types.ApplyPatchType, patch, metav1.PatchOptions{
+		FieldManager: fieldManager,
+		Force:        &force,
+	})
+	return kubernetesError(err)
+}
+
+// updateSecret updates the Secret with the changes mutate makes to a copy of
+// it. On a conflict with a concurrent change, mutate is applied again to the
+// latest version of the Secret, rather than requeuing it for a full sync.
+// Unlike updateSecretStatus, it can remove annotations and set data. The copy
+// mutate gets always has an annotations map, even when the Secret has none.
+func (c *Controller) updateSecret(ctx context.Context, secret *corev1.Secret, mutate func(*corev1.Secret)) error {
+	if c.state != nil {
+		return kubernetesError(c.state.update(ctx, secret, mutate))
+	}
+	current := secret
+	return kubernetesError(retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secretCopy := current.DeepCopy()
+		if secretCopy.Annotations == nil {
+			secretCopy.Annotations = map[string]string{}
+		}
+		mutate(secretCopy)
+		_, err := c.kubeclientset.CoreV1().Secrets(secret.Namespace).Update(ctx, secretCopy, metav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			logV(4).Infof("Secret %s changed since it was read, retrying its update", secret.GetName())
+			latest, getErr := c.kubeclientset.CoreV1().Secrets(secret.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			current = latest
+		}
+		return err
+	}))
+}
+
+// statusPatch returns the apply patch setting the annotations on the Secret,
+// along with the managed annotations it already has
+func statusPatch(secret *corev1.Secret, annotations map[string]string) ([]byte, error) {
+	applied := map[string]string{}
+	for _, key := range managedAnnotations {
+		if value, ok := secret.Annotations[key]; ok {
+			applied[key] = value
+		}
+	}
+	for key, value := range annotations {
+		applied[key] = value
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":        secret.Name,
+			"namespace":   secret.Namespace,
+			"annotations": applied,
+		},
+	})
+}
+
+// gitURL returns the git url of the secret, derived from its namespace and
+// name with the -git-url-from-name template when it has no git url annotation
+func gitURL(secret *corev1.Secret) (string, bool) {
+	if url, ok := secret.Annotations[gitUrlLabelName]; ok {
+		return url, true
+	}
+	if gitURLTemplate == nil {
+		return "", false
+	}
+	path, err := projectPathFromName(secret.Namespace, secret.Name)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to derive the git url of secret %s/%s: %s", secret.Namespace, secret.Name, err.Error()))
+		return "", false
+	}
+	return fmt.Sprintf("git@%s:%s.git", gitSSHHost, path), true
+}
+
+// projectPathFromName executes the -git-url-from-name template
+func projectPathFromName(namespace, name string) (string, error) {
+	var path strings.Builder
+	err := gitURLTemplate.Execute(&path, struct{ Namespace, Name string }{namespace, name})
+	if err != nil {
+		return "", err
+	}
+	if path.Len() == 0 {
+		return "", fmt.Errorf("the template produced an empty project path")
+	}
+	return strings.Trim(path.String(), "/"), nil
+}
+
+// projectPath returns the gitlab project path of the secret's git url
+func projectPath(secret *corev1.Secret) string {
+	url, _ := gitURL(secret)
+	return pathFromURL(url)
+}
+
+// pathFromURL returns the gitlab project path of a git url
+func pathFromURL(url string) string {
+	project := strings.TrimPrefix(url, fmt.Sprintf("git@%s:", gitSSHHost))
+	// Deploy tokens are used with HTTPS urls
+	project = strings.TrimPrefix(project, fmt.Sprintf("https://%s/", gitlabHostname))
+	// Flux v2 GitRepositories use ssh:// urls
+	project = strings.TrimPrefix(project, fmt.Sprintf("ssh://git@%s/", gitSSHHost))
+	// Removes a ?ref= or #branch suffix copied along with the URL
+	if i := strings.IndexAny(project, "?#"); i >= 0 {
+		project = project[:i]
+	}
+	// Removes .git in the URL if present
+	return strings.TrimSuffix(project, ".git")
+}
+
+// projectRef returns the project id recorded in the secret if there is one,
+// falling back to the project path. The boolean reports whether the recorded
+// id was used.
+func projectRef(secret *corev1.Secret) (interface{}, bool) {
+	if id, err := strconv.Atoi(secret.Annotations[projectIdLabelName]); err == nil {
+		return id, true
+	}
+	return projectIDOrPath(projectPath(secret)), false
+}
+
+// isNotFound reports whether a gitlab response is a 404
+func isNotFound(resp *gitlab.Response) bool {
+	return resp != nil && resp.StatusCode == http.StatusNotFound
+}
+
+// isNamespaceTerminating reports whether a write was rejected because the
+// namespace is being deleted
+func isNamespaceTerminating(err error) bool {
+	var status *errors.StatusError
+	return goerrors.As(err, &status) && errors.HasStatusCause(status, corev1.NamespaceTerminatingCause)
+}
+
+// hasMarkerLabel reports whether obj is an object with the flux marker label
+func hasMarkerLabel(obj interface{}) bool {
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		return false
+	}
+	_, found := object.GetLabels()[fluxSecretLabelFilter]
+	return found
+}
+
+// materialChange reports whether an update changed anything the sync reads:
+// the marker label, the annotations, the owner references, the identity and
+// the identities of its pairs or, for the manager, the deletion state.
+// Periodic resyncs, which don't bump the resourceVersion, always count as a
+// change so deploy keys keep being verified.
+func materialChange(old, new interface{}) bool {
+	oldSecret, ok := old.(*corev1.Secret)
+	if !ok {
+		return true
+	}
+	newSecret, ok := new.(*corev1.Secret)
+	if !ok {
+		return true
+	}
+	if oldSecret.ResourceVersion == newSecret.ResourceVersion {
+		return true
+	}
+	if hasMarkerLabel(oldSecret) != hasMarkerLabel(newSecret) {
+		return true
+	}
+	if newSecret.DeletionTimestamp != nil || !reflect.DeepEqual(oldSecret.Finalizers, newSecret.Finalizers) {
+		return true
+	}
+	if !reflect.DeepEqual(oldSecret.Annotations, newSecret.Annotations) {
+		return true
+	}
+	if !reflect.DeepEqual(oldSecret.OwnerReferences, newSecret.OwnerReferences) {
+		return true
+	}
+	if !reflect.DeepEqual(pairIdentities(oldSecret), pairIdentities(newSecret)) {
+		return true
+	}
+	oldIdentity, _ := identity(oldSecret)
+	newIdentity, _ := identity(newSecret)
+	return !bytes.Equal(oldIdentity, newIdentity)
+}
+
+// inNamespaceScope reports whether the object namespace matches the
+// namespace pattern, if there is one
+func inNamespaceScope(object metav1.Object) bool {
+	return namespaceRegexp == nil || namespaceRegexp.MatchString(object.GetNamespace())
+}
+
+// hasNamePrefix reports whether the object name starts with the -name-prefix
+func hasNamePrefix(object metav1.Object) bool {
+	return strings.HasPrefix(object.GetName(), namePrefix)
+}
+
+// allowedProject reports whether the project path matches one of the
+// patterns of the project allowlist, if there is one
+func allowedProject(project string) bool {
+	if len(projectAllowlist) == 0 {
+		return true
+	}
+	for _, pattern := range projectAllowlist {
+		if ok, _ := path.Match(pattern, project); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// inShard reports whether the object is processed by this instance. Objects
+// are spread across shards by a stable hash of their namespace/name.
+func inShard(object metav1.Object) bool {
+	h := fnv.New32a()
+	h.Write([]byte(object.GetNamespace() + "/" + object.GetName()))
+	return int(h.Sum32()%uint32(shardCount)) == shardIndex
+}
+
+// enqueue takes a Secret resource and converts it into a namespace/name
+// string which is then put onto the work queue. This method should *not* be
+// passed resources of any type other than Secret.
+func (c *Controller) enqueue(obj interface{}) {
+	if object, ok := obj.(metav1.Object); ok {
+		if after, held := c.holds.remaining(object); held {
+			logV(4).Infof("Not enqueuing object %s, it's backing off for %s", object.GetName(), after.Round(time.Second))
+			return
+		}
+	}
+	c.workqueue.Add(obj)
+}
+
+// It enqueues the Secret resource to be processed.
+func (c *Controller) handleObject(obj interface{}) {
+	c.handle(obj, false)
+}
+
+// handleDeletedObject enqueues a deleted Secret resource on the deletion
+// queue.
+func (c *Controller) handleDeletedObject(obj interface{}) {
+	c.handle(obj, true)
+}
+
+// handle filters the Secret resource and enqueues it, on the deletion queue
+// if it's deleted or being deleted.
+func (c *Controller) handle(obj interface{}, deleted bool) {
+	var object metav1.Object
+	var ok bool
+	if object, ok = obj.(metav1.Object); !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type"))
+			return
+		}
+		object, ok = tombstone.Obj.(metav1.Object)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object tombstone, invalid type"))
+			return
+		}
+		logV(4).Infof("Recovered deleted object '%s' from tombstone", object.GetName())
+	}
+
+	if !inNamespaceScope(object) {
+		logV(4).Infof("Skipping object %s, namespace %s doesn't match the namespace pattern", object.GetName(), object.GetNamespace())
+		return
+	}
+
+	if !hasNamePrefix(object) {
+		logV(4).Infof("Skipping object %s, its name doesn't start with %q", object.GetName(), namePrefix)
+		return
+	}
+
+	if !inShard(object) {
+		logV(4).Infof("Skipping object %s, it belongs to another shard", object.GetName())
+		return
+	}
+
+	logV(4).Infof("Processing object: %s", object.GetName())
+	if deleted || object.GetDeletionTimestamp() != nil {
+		// The secret recovered from a tombstone is enqueued, the workers
+		// only process Secrets
+		c.deletionqueue.Add(object)
+		return
+	}
+	if c.timeouts.isDeadLettered(object) {
+		logV(4).Infof("Skipping object %s, it's dead-lettered until it changes", object.GetName())
+		return
+	}
 	c.enqueue(obj)
 }
@@ -0,0 +1,1761 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestMain(m *testing.M) {
+	// main defaults the git ssh host to the gitlab hostname
+	gitSSHHost = gitlabHostname
+	os.Exit(m.Run())
+}
+
+// unannotatedSecret returns a Secret without any annotation, as created by
+// hand before the controller ever synced it
+func unannotatedSecret() *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux", Name: "flux-git-deploy"},
+		Data:       map[string][]byte{"identity": []byte("identity")},
+	}
+}
+
+func TestUpdateSecretNilAnnotations(t *testing.T) {
+	secret := unannotatedSecret()
+	client := fake.NewSimpleClientset(secret)
+	c := &Controller{kubeclientset: client}
+
+	err := c.updateSecret(context.Background(), secret, func(secret *corev1.Secret) {
+		secret.Annotations[deployKeyLabelName] = "1"
+	})
+	if err != nil {
+		t.Fatalf("updateSecret: %s", err.Error())
+	}
+	updated, err := client.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := updated.Annotations[deployKeyLabelName]; got != "1" {
+		t.Errorf("deploy key annotation = %q, want %q", got, "1")
+	}
+}
+
+func TestUpdateSecretStatusNilAnnotations(t *testing.T) {
+	secret := unannotatedSecret()
+	client := fake.NewSimpleClientset(secret)
+	// The fake clientset doesn't implement server-side apply, the patch is
+	// checked instead
+	var patch []byte
+	client.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch = action.(k8stesting.PatchAction).GetPatch()
+		return true, secret, nil
+	})
+	c := &Controller{kubeclientset: client}
+
+	if err := c.updateSecretStatus(context.Background(), secret, map[string]string{deployKeyLabelName: "1"}); err != nil {
+		t.Fatalf("updateSecretStatus: %s", err.Error())
+	}
+	var applied corev1.Secret
+	if err := json.Unmarshal(patch, &applied); err != nil {
+		t.Fatalf("invalid patch %s: %s", patch, err.Error())
+	}
+	if got := applied.Annotations[deployKeyLabelName]; got != "1" {
+		t.Errorf("patched deploy key annotation = %q, want %q", got, "1")
+	}
+}
+
+func TestStateStoreNilAnnotations(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	state, err := newStateStore(client, "flux/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := unannotatedSecret()
+	c := &Controller{kubeclientset: client, state: state}
+
+	if err := c.updateSecretStatus(context.Background(), secret, map[string]string{deployKeyLabelName: "1"}); err != nil {
+		t.Fatalf("updateSecretStatus: %s", err.Error())
+	}
+	if err := c.updateSecret(context.Background(), secret, func(secret *corev1.Secret) {
+		secret.Annotations[createdTitleLabelName] = "title"
+	}); err != nil {
+		t.Fatalf("updateSecret: %s", err.Error())
+	}
+	overlaid := state.overlay(secret)
+	if overlaid.Annotations[deployKeyLabelName] != "1" || overlaid.Annotations[createdTitleLabelName] != "title" {
+		t.Errorf("state annotations = %v, want the deploy key and title", overlaid.Annotations)
+	}
+}
+
+func TestPathFromURL(t *testing.T) {
+	defer func(host, sshHost string) { gitlabHostname, gitSSHHost = host, sshHost }(gitlabHostname, gitSSHHost)
+	gitlabHostname, gitSSHHost = "gitlab.example.com", "git.example.com"
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"git@git.example.com:group/app.git", "group/app"},
+		{"git@git.example.com:group/app", "group/app"},
+		{"git@git.example.com:group/subgroup/app.git", "group/subgroup/app"},
+		{"ssh://git@git.example.com/group/app.git", "group/app"},
+		{"ssh://git@git.example.com/group/app", "group/app"},
+		{"https://gitlab.example.com/group/app.git", "group/app"},
+		{"https://gitlab.example.com/group/app", "group/app"},
+		{"git@git.example.com:group/app.git?ref=main", "group/app"},
+		{"https://gitlab.example.com/group/app.git?ref=v1.0.0", "group/app"},
+		{"git@git.example.com:group/app.git#main", "group/app"},
+		{"ssh://git@git.example.com/group/app#feature/x", "group/app"},
+		{"group/app.git", "group/app"},
+	}
+	for _, test := range tests {
+		if got := pathFromURL(test.url); got != test.want {
+			t.Errorf("pathFromURL(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestProjectPath(t *testing.T) {
+	defer func(host string) { gitSSHHost = host }(gitSSHHost)
+	gitSSHHost = "git.example.com"
+
+	secret := unannotatedSecret()
+	if got := projectPath(secret); got != "" {
+		t.Errorf("projectPath of a secret without git url = %q, want none", got)
+	}
+	secret.Annotations = map[string]string{gitUrlLabelName: "git@git.example.com:group/app.git?ref=main"}
+	if got := projectPath(secret); got != "group/app" {
+		t.Errorf("projectPath = %q, want %q", got, "group/app")
+	}
+}
+
+func TestRequestTimeoutWarnsOnce(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{recorder: recorder}
+	secret := unannotatedSecret()
+	secret.UID = "uid"
+	secret.Annotations = map[string]string{requestTimeoutLabelName: "soon"}
+
+	for i := 0; i < 3; i++ {
+		if got := c.requestTimeout(secret); got != requestTimeout {
+			t.Fatalf("requestTimeout = %s, want the default %s", got, requestTimeout)
+		}
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("got %d events for the same invalid timeout, want 1", len(recorder.Events))
+	}
+
+	secret.Annotations[requestTimeoutLabelName] = "-1s"
+	c.requestTimeout(secret)
+	if len(recorder.Events) != 2 {
+		t.Fatalf("got %d events after the timeout changed, want 2", len(recorder.Events))
+	}
+
+	secret.Annotations[requestTimeoutLabelName] = "1m"
+	if got := c.requestTimeout(secret); got != time.Minute {
+		t.Errorf("requestTimeout = %s, want 1m", got)
+	}
+	secret.Annotations[requestTimeoutLabelName] = "soon"
+	c.requestTimeout(secret)
+	if len(recorder.Events) != 3 {
+		t.Errorf("got %d events once the timeout was invalid again, want 3", len(recorder.Events))
+	}
+}
+
+func TestInShard(t *testing.T) {
+	defer func(index, count int) { shardIndex, shardCount = index, count }(shardIndex, shardCount)
+
+	secrets := make([]*corev1.Secret, 100)
+	for i := range secrets {
+		secrets[i] = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "flux", Name: fmt.Sprintf("secret-%d", i)}}
+	}
+
+	shardIndex, shardCount = 0, 1
+	for _, secret := range secrets {
+		if !inShard(secret) {
+			t.Fatalf("secret %s isn't in the only shard", secret.Name)
+		}
+	}
+
+	shardCount = 3
+	for _, secret := range secrets {
+		shards := 0
+		for shardIndex = 0; shardIndex < shardCount; shardIndex++ {
+			if inShard(secret) {
+				shards++
+			}
+		}
+		if shards != 1 {
+			t.Errorf("secret %s is in %d shards, want exactly 1", secret.Name, shards)
+		}
+	}
+
+	// The shard only depends on the namespace/name
+	shardIndex = 0
+	other := secrets[0].DeepCopy()
+	other.UID = "other"
+	other.Labels = map[string]string{"app": "other"}
+	if inShard(secrets[0]) != inShard(other) {
+		t.Errorf("the shard of a secret changed with its uid and labels")
+	}
+}
+
+func TestReconcileKeyMetadata(t *testing.T) {
+	secret := unannotatedSecret()
+	secret.Annotations = map[string]string{deployKeyCanPushLabelName: "false"}
+	title, _ := desiredKey(secret)
+
+	t.Run("unchanged", func(t *testing.T) {
+		c := &Controller{recorder: record.NewFakeRecorder(10), gitlabClient: unusedGitlab(t)}
+		key := &gitlab.DeployKey{ID: 1, Title: title, CanPush: gitlab.Bool(false)}
+		if recreate, err := c.reconcileKeyMetadata(context.Background(), secret, 10, key); err != nil || recreate {
+			t.Errorf("reconcileKeyMetadata = %v, %v, want false, nil", recreate, err)
+		}
+	})
+
+	t.Run("drifted", func(t *testing.T) {
+		var update map[string]interface{}
+		c := &Controller{recorder: record.NewFakeRecorder(10), gitlabClient: newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPut || r.URL.Path != "/api/v4/projects/10/deploy_keys/1" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+			json.NewDecoder(r.Body).Decode(&update)
+			fmt.Fprint(w, `{"id": 1}`)
+		}))}
+		key := &gitlab.DeployKey{ID: 1, Title: "old title", CanPush: gitlab.Bool(true)}
+		if recreate, err := c.reconcileKeyMetadata(context.Background(), secret, 10, key); err != nil || recreate {
+			t.Errorf("reconcileKeyMetadata = %v, %v, want false, nil", recreate, err)
+		}
+		if update["title"] != title || update["can_push"] != false {
+			t.Errorf("update = %v, want title %q and can_push false", update, title)
+		}
+	})
+
+	t.Run("not updatable", func(t *testing.T) {
+		deleted := false
+		c := &Controller{recorder: record.NewFakeRecorder(10), gitlabClient: newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPut:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			case http.MethodDelete:
+				deleted = true
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))}
+		key := &gitlab.DeployKey{ID: 1, Title: title, CanPush: gitlab.Bool(true)}
+		if recreate, err := c.reconcileKeyMetadata(context.Background(), secret, 10, key); err != nil || !recreate {
+			t.Errorf("reconcileKeyMetadata = %v, %v, want true, nil", recreate, err)
+		}
+		if !deleted {
+			t.Errorf("the deploy key gitlab can't update wasn't deleted")
+		}
+	})
+
+	for _, test := range []struct {
+		name     string
+		noDelete bool
+		halted   bool
+	}{
+		{"not updatable without deletion", true, false},
+		{"not updatable with deletions halted", false, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer func(disabled bool) { noDelete = disabled }(noDelete)
+			noDelete = test.noDelete
+			setDeletionLimits(t, 0, 1, time.Minute)
+			recorder := record.NewFakeRecorder(10)
+			c := &Controller{recorder: recorder, gitlabClient: newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodDelete {
+					t.Errorf("the deploy key was deleted")
+				}
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}))}
+			c.deletions.halted = test.halted
+			key := &gitlab.DeployKey{ID: 1, Title: title, CanPush: gitlab.Bool(true)}
+			recreate, err := c.reconcileKeyMetadata(context.Background(), secret, 10, key)
+			if recreate {
+				t.Errorf("reconcileKeyMetadata reports the kept key has to be recreated")
+			}
+			if test.halted && err != errDeletionsHalted {
+				t.Errorf("reconcileKeyMetadata = %v, want errDeletionsHalted", err)
+			}
+			if test.noDelete && (err != nil || !strings.Contains(<-recorder.Events, SkippedDelete)) {
+				t.Errorf("reconcileKeyMetadata = %v, want nil and a %s event", err, SkippedDelete)
+			}
+		})
+	}
+}
+
+// fluxSecret returns a flux Secret of the group/app project with a deploy key
+func fluxSecret() *corev1.Secret {
+	secret := unannotatedSecret()
+	secret.UID = "uid"
+	secret.Labels = map[string]string{fluxSecretLabelFilter: "true"}
+	secret.Annotations = map[string]string{
+		gitUrlLabelName:    fmt.Sprintf("git@%s:group/app.git", gitSSHHost),
+		deployKeyLabelName: "1",
+	}
+	return secret
+}
+
+func TestPinnedKey(t *testing.T) {
+	secret := fluxSecret()
+	secret.Annotations[deployKeyPinnedLabelName] = "true"
+
+	c := &Controller{recorder: record.NewFakeRecorder(10), projects: &projectLocks{}, gitlabClient: unusedGitlab(t)}
+	if err := c.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+
+	// The pinned key is still deleted along with the secret
+	var deleted string
+	c.gitlabClient = newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted = r.Method + " " + r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	if err := c.removeDeployKey(context.Background(), secret); err != nil {
+		t.Fatalf("removeDeployKey: %s", err.Error())
+	}
+	if want := "DELETE /api/v4/projects/group/app/deploy_keys/1"; deleted != want {
+		t.Errorf("request %q, want %q", deleted, want)
+	}
+}
+
+func TestVerifyDeployKeyFingerprint(t *testing.T) {
+	defer func(recreate bool) { verifyRecreate = recreate }(verifyRecreate)
+	verifyRecreate = true
+
+	_, recorded := testKey(t, 2048)
+	_, other := testKey(t, 2048)
+	secret := fluxSecret()
+	secret.Annotations[deployKeyFingerprintLabelName] = ssh.FingerprintSHA256(recorded)
+	secret.Annotations[deployKeyCanPushLabelName] = "false"
+	title, _ := desiredKey(secret)
+
+	for _, test := range []struct {
+		name     string
+		key      ssh.PublicKey
+		recreate bool
+	}{
+		{"same key", recorded, false},
+		{"other key", other, true},
+	} {
+		c := &Controller{recorder: record.NewFakeRecorder(10), gitlabClient: newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "title": title, "can_push": false, "key": string(ssh.MarshalAuthorizedKey(test.key))})
+		}))}
+		if recreate, err := c.verifyDeployKey(context.Background(), secret); err != nil || recreate != test.recreate {
+			t.Errorf("%s: verifyDeployKey = %v, %v, want %v, nil", test.name, recreate, err, test.recreate)
+		}
+	}
+}
+
+func TestVerifyMissingKeyWithoutRecreate(t *testing.T) {
+	defer func(recreate bool) { verifyRecreate = recreate }(verifyRecreate)
+	verifyRecreate = false
+
+	secret := fluxSecret()
+	s := newTestSync(t, newFakeGitlab(), secret)
+	if recreate, err := s.verifyDeployKey(context.Background(), secret); err != nil || recreate {
+		t.Fatalf("verifyDeployKey = %v, %v, want false, nil", recreate, err)
+	}
+	annotations := s.secret(t, secret).Annotations
+	if _, ok := annotations[deployKeyLabelName]; ok || annotations[deployKeyMissingLabelName] != "1" {
+		t.Errorf("annotations = %v, want the deploy key recorded as missing", annotations)
+	}
+	if !hasEvent(s.events(), DeployKeyMissing) {
+		t.Errorf("no %s event", DeployKeyMissing)
+	}
+
+	// The missing key isn't recreated until the annotation is removed
+	requests := len(s.gitlab.requested())
+	if err := s.syncSecret(context.Background(), s.secret(t, secret)); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if len(s.gitlab.keys) != 0 || len(s.gitlab.requested()) != requests {
+		t.Errorf("the missing key was recreated, requests %v", s.gitlab.requested()[requests:])
+	}
+}
+
+func TestDesiredKeyTitle(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+	}{
+		{"default", nil, deployKeyTitle},
+		{"annotation", map[string]string{deployKeyTitleLabelName: "Custom"}, "Custom"},
+		{"source kind", map[string]string{sourceKindLabelName: "GitRepository"}, deployKeyTitle + " GitRepository/flux-git-deploy"},
+		{"annotation and source kind", map[string]string{deployKeyTitleLabelName: "Custom", sourceKindLabelName: "HelmRepository"}, "Custom HelmRepository/flux-git-deploy"},
+		{"empty source kind", map[string]string{sourceKindLabelName: ""}, deployKeyTitle},
+		{"too long", map[string]string{deployKeyTitleLabelName: strings.Repeat("a", maxDeployKeyTitleLength+10)}, strings.Repeat("a", maxDeployKeyTitleLength)},
+	}
+	for _, test := range tests {
+		secret := unannotatedSecret()
+		secret.Annotations = test.annotations
+		if got, _ := desiredKey(secret); got != test.want {
+			t.Errorf("%s: title = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// countingGitlab returns a gitlab client answering every request with the
+// deploy key of the fluxSecret, and the number of requests it got
+func countingGitlab(t *testing.T) (*gitlab.Client, *int) {
+	requests := 0
+	title, _ := desiredKey(fluxSecret())
+	return newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "title": title, "can_push": true})
+	})), &requests
+}
+
+func TestVerifySampleFraction(t *testing.T) {
+	defer func(verify bool, fraction float64) { verifyKeys, verifySampleFraction = verify, fraction }(verifyKeys, verifySampleFraction)
+	verifyKeys = true
+
+	for _, test := range []struct {
+		fraction float64
+		verified bool
+	}{
+		{0, false},
+		{1, true},
+	} {
+		verifySampleFraction = test.fraction
+		client, requests := countingGitlab(t)
+		c := &Controller{recorder: record.NewFakeRecorder(10), projects: &projectLocks{}, gitlabClient: client}
+		if err := c.syncSecret(context.Background(), fluxSecret()); err != nil {
+			t.Fatalf("syncSecret: %s", err.Error())
+		}
+		if verified := *requests > 0; verified != test.verified {
+			t.Errorf("sample fraction %v: verified = %v, want %v", test.fraction, verified, test.verified)
+		}
+	}
+}
+
+func TestInNamespaceScope(t *testing.T) {
+	defer func(pattern *regexp.Regexp) { namespaceRegexp = pattern }(namespaceRegexp)
+
+	secret := unannotatedSecret()
+	namespaceRegexp = nil
+	if !inNamespaceScope(secret) {
+		t.Errorf("secret out of scope without a namespace pattern")
+	}
+
+	namespaceRegexp = regexp.MustCompile("^tenant-")
+	for namespace, want := range map[string]bool{"tenant-a": true, "tenant-": true, "flux": false, "my-tenant-a": false} {
+		secret.Namespace = namespace
+		if got := inNamespaceScope(secret); got != want {
+			t.Errorf("inNamespaceScope(%s) = %v, want %v", namespace, got, want)
+		}
+	}
+}
+
+func TestNamePrefix(t *testing.T) {
+	defer func(prefix string) { namePrefix = prefix }(namePrefix)
+	c := &Controller{
+		workqueue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		deletionqueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+
+	namePrefix = ""
+	if !hasNamePrefix(fluxSecret()) {
+		t.Errorf("a secret is filtered out without -name-prefix")
+	}
+	namePrefix = "flux-"
+	other := fluxSecret()
+	other.Name = "git-deploy"
+	c.handle(other, false)
+	c.handle(other, true)
+	c.handle(fluxSecret(), false)
+	if c.workqueue.Len() != 1 || c.deletionqueue.Len() != 0 {
+		t.Errorf("queued %d secrets to sync and %d to delete, want only the prefixed one", c.workqueue.Len(), c.deletionqueue.Len())
+	}
+}
+
+func TestForgetDeployKey(t *testing.T) {
+	secret := fluxSecret()
+	secret.Labels = nil
+	secret.Annotations[deployKeyFingerprintLabelName] = "SHA256:abc"
+	client := fake.NewSimpleClientset(secret)
+	c := &Controller{kubeclientset: client}
+
+	if err := c.forgetDeployKey(context.Background(), secret); err != nil {
+		t.Fatalf("forgetDeployKey: %s", err.Error())
+	}
+	updated, err := client.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{deployKeyLabelName, deployKeyFingerprintLabelName} {
+		if _, ok := updated.Annotations[key]; ok {
+			t.Errorf("annotation %s of the unlabeled secret wasn't removed", key)
+		}
+	}
+	if _, ok := updated.Annotations[gitUrlLabelName]; !ok {
+		t.Errorf("the git url annotation was removed")
+	}
+
+	// A deleted secret has nothing left to forget
+	if err := c.forgetDeployKey(context.Background(), &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "flux", Name: "deleted"}}); err != nil {
+		t.Errorf("forgetDeployKey of a deleted secret: %s", err.Error())
+	}
+}
+
+func TestHasMarkerLabel(t *testing.T) {
+	if !hasMarkerLabel(fluxSecret()) {
+		t.Errorf("labeled secret has no marker label")
+	}
+	if hasMarkerLabel(unannotatedSecret()) {
+		t.Errorf("unlabeled secret has a marker label")
+	}
+	if hasMarkerLabel("flux/flux-git-deploy") {
+		t.Errorf("a string has a marker label")
+	}
+}
+
+func TestDisambiguateTitle(t *testing.T) {
+	defer func(uniqueness string) { titleUniqueness = uniqueness }(titleUniqueness)
+	titleUniqueness = titleUniqueSecret
+
+	secret := unannotatedSecret()
+	title := disambiguateTitle("Flux", secret)
+	if !strings.HasPrefix(title, "Flux (") || title == "Flux" {
+		t.Errorf("disambiguateTitle = %q, want a suffixed title", title)
+	}
+	if again := disambiguateTitle("Flux", secret.DeepCopy()); again != title {
+		t.Errorf("disambiguateTitle isn't stable: %q then %q", title, again)
+	}
+	other := secret.DeepCopy()
+	other.Name = "other"
+	if got := disambiguateTitle("Flux", other); got == title {
+		t.Errorf("two secrets got the same title %q", got)
+	}
+	if got := disambiguateTitle(strings.Repeat("a", maxDeployKeyTitleLength), secret); len(got) != maxDeployKeyTitleLength {
+		t.Errorf("disambiguated title is %d long, want %d", len(got), maxDeployKeyTitleLength)
+	}
+}
+
+func TestTitleUniqueness(t *testing.T) {
+	defer func(uniqueness, cluster string) { titleUniqueness, clusterName = uniqueness, cluster }(titleUniqueness, clusterName)
+	secret := unannotatedSecret()
+
+	titleUniqueness = titleUniqueSecret
+	bySecret := disambiguateTitle("Flux", secret)
+	titleUniqueness = titleUniqueCluster
+	clusterName = "a"
+	clusterA := disambiguateTitle("Flux", secret)
+	clusterName = "b"
+	clusterB := disambiguateTitle("Flux", secret)
+	if clusterA == clusterB || clusterA == bySecret {
+		t.Errorf("the titles of the clusters aren't unique: %q, %q and %q by secret", clusterA, clusterB, bySecret)
+	}
+
+	titleUniqueness = titleUniqueNone
+	if got := disambiguateTitle("Flux", secret); got != "Flux" {
+		t.Errorf("disambiguateTitle = %q, want the title as is", got)
+	}
+}
+
+func TestIsTitleTaken(t *testing.T) {
+	badRequest := func(message string) error {
+		return &gitlab.ErrorResponse{Response: &http.Response{StatusCode: http.StatusBadRequest}, Message: message}
+	}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{badRequest("{title: [has already been taken]}"), true},
+		{badRequest("{deploy_key.fingerprint: [has already been taken]}"), false},
+		{&gitlab.ErrorResponse{Response: &http.Response{StatusCode: http.StatusNotFound}, Message: "title has already been taken"}, false},
+		{errors.New("title has already been taken"), false},
+	}
+	for _, test := range tests {
+		if got := isTitleTaken(test.err); got != test.want {
+			t.Errorf("isTitleTaken(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// testSync is a Controller syncing Secrets of a fake clientset against a
+// fake gitlab API
+type testSync struct {
+	*Controller
+	gitlab   *fakeGitlab
+	client   *fake.Clientset
+	recorder *record.FakeRecorder
+}
+
+// newTestSync returns a Controller syncing the secrets against the fake
+// gitlab API. The fake clientset doesn't implement server-side apply, the
+// annotations and data of the apply patches are written as they are.
+func newTestSync(t *testing.T, gl *fakeGitlab, secrets ...*corev1.Secret) *testSync {
+	var objects []runtime.Object
+	for _, secret := range secrets {
+		objects = append(objects, secret)
+	}
+	client := fake.NewSimpleClientset(objects...)
+	client.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		var applied corev1.Secret
+		if err := json.Unmarshal(patch.GetPatch(), &applied); err != nil {
+			return true, nil, err
+		}
+		obj, err := client.Tracker().Get(corev1.SchemeGroupVersion.WithResource("secrets"), patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		secret := obj.(*corev1.Secret).DeepCopy()
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		for key, value := range applied.Annotations {
+			secret.Annotations[key] = value
+		}
+		for key, value := range applied.Data {
+			secret.Data[key] = value
+		}
+		return true, secret, client.Tracker().Update(corev1.SchemeGroupVersion.WithResource("secrets"), secret, secret.Namespace)
+	})
+	recorder := record.NewFakeRecorder(100)
+	return &testSync{
+		Controller: &Controller{
+			kubeclientset:   client,
+			gitlabClient:    gl.client(t),
+			recorder:        recorder,
+			projects:        &projectLocks{},
+			missingProjects: newMissingProjects(),
+			list:            func() ([]*corev1.Secret, error) { return secrets, nil },
+		},
+		gitlab:   gl,
+		client:   client,
+		recorder: recorder,
+	}
+}
+
+// secret returns the current version of the secret
+func (s *testSync) secret(t *testing.T, secret *corev1.Secret) *corev1.Secret {
+	t.Helper()
+	current, err := s.client.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return current
+}
+
+// events returns the events recorded since the last call
+func (s *testSync) events() []string {
+	var events []string
+	for {
+		select {
+		case event := <-s.recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// hasEvent reports whether one of the events has the reason
+func hasEvent(events []string, reason string) bool {
+	for _, event := range events {
+		if strings.Contains(event, " "+reason+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// identitySecret returns a flux Secret of the group/app project with an
+// identity and no deploy key yet
+func identitySecret(t *testing.T) *corev1.Secret {
+	secret := fluxSecret()
+	delete(secret.Annotations, deployKeyLabelName)
+	secret.Data["identity"], _ = testKey(t, 2048)
+	return secret
+}
+
+func TestSyncCreatesDeployKey(t *testing.T) {
+	secret := identitySecret(t)
+	s := newTestSync(t, newFakeGitlab(), secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	annotations := s.secret(t, secret).Annotations
+	if annotations[deployKeyLabelName] != "1" || annotations[projectIdLabelName] != "10" || annotations[projectPathLabelName] != "group/app" {
+		t.Errorf("annotations = %v, want deploy key 1 of project 10", annotations)
+	}
+	if key := s.gitlab.keys[1]; key == nil || key.CanPush == nil || !*key.CanPush {
+		t.Errorf("deploy key = %+v, want a push key", key)
+	}
+}
+
+func TestSyncRecordsProjectPath(t *testing.T) {
+	// gitlab still answers the old path of a renamed project
+	gl := newFakeGitlab()
+	gl.project.PathWithNamespace = "group/renamed"
+	secret := identitySecret(t)
+	s := newTestSync(t, gl, secret)
+	s.gitlabClient = newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.RawPath = strings.Replace(r.URL.EscapedPath(), "group%2Fapp", "10", 1)
+		r.URL.Path, _ = url.PathUnescape(r.URL.RawPath)
+		gl.ServeHTTP(w, r)
+	}))
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if got := s.secret(t, secret).Annotations[projectPathLabelName]; got != "group/renamed" {
+		t.Errorf("project path annotation = %q, want the path gitlab answered", got)
+	}
+}
+
+func TestSyncMirrorReadOnly(t *testing.T) {
+	gl := newFakeGitlab()
+	gl.project.Mirror = true
+	secret := identitySecret(t)
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if key := gl.keys[1]; key == nil || key.CanPush == nil || *key.CanPush {
+		t.Errorf("deploy key = %+v, want a read-only key", key)
+	}
+	if got := s.secret(t, secret).Annotations[mirrorLabelName]; got != "true" {
+		t.Errorf("mirror annotation = %q, want true", got)
+	}
+	if !hasEvent(s.events(), ReadOnlyMirror) {
+		t.Errorf("no %s event", ReadOnlyMirror)
+	}
+
+	// The recorded mirror keeps the key read-only once verified
+	if _, canPush := desiredKey(s.secret(t, secret)); canPush {
+		t.Errorf("the deploy key of a mirror should be read-only")
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	defer func(verify bool, ttl time.Duration) { verifyKeys, verifyCacheTTL = verify, ttl }(verifyKeys, verifyCacheTTL)
+	verifyKeys, verifyCacheTTL = true, time.Hour
+
+	client, requests := countingGitlab(t)
+	c := &Controller{recorder: record.NewFakeRecorder(10), projects: &projectLocks{}, gitlabClient: client}
+	secret := fluxSecret()
+	for i := 0; i < 3; i++ {
+		if err := c.syncSecret(context.Background(), secret); err != nil {
+			t.Fatalf("syncSecret: %s", err.Error())
+		}
+	}
+	if *requests != 1 {
+		t.Errorf("%d gitlab requests for 3 syncs, want a single verification", *requests)
+	}
+
+	// Another deploy key is verified again
+	secret.Annotations[deployKeyLabelName] = "2"
+	if c.recentlyVerified(secret) {
+		t.Errorf("another deploy key counts as recently verified")
+	}
+	secret.Annotations[deployKeyLabelName] = "1"
+	c.forgetVerified(secret)
+	if c.recentlyVerified(secret) {
+		t.Errorf("a forgotten secret counts as recently verified")
+	}
+}
+
+func TestMaterialChange(t *testing.T) {
+	defer func(prefix string) { multiIdentityPrefix = prefix }(multiIdentityPrefix)
+	multiIdentityPrefix = "identity-"
+
+	old := fluxSecret()
+	old.ResourceVersion = "1"
+	old.Data["identity-a"] = []byte("a")
+
+	tests := []struct {
+		name   string
+		change func(*corev1.Secret)
+		want   bool
+	}{
+		{"resync", func(s *corev1.Secret) { s.ResourceVersion = "1" }, true},
+		{"nothing material", func(s *corev1.Secret) { s.Data["other"] = []byte("other") }, false},
+		{"marker label", func(s *corev1.Secret) { s.Labels = nil }, true},
+		{"annotation", func(s *corev1.Secret) { s.Annotations[deployKeyTitleLabelName] = "Custom" }, true},
+		{"identity", func(s *corev1.Secret) { s.Data["identity"] = []byte("new") }, true},
+		{"pair identity", func(s *corev1.Secret) { s.Data["identity-a"] = []byte("new") }, true},
+		{"new pair identity", func(s *corev1.Secret) { s.Data["identity-b"] = []byte("b") }, true},
+		{"owner references", func(s *corev1.Secret) {
+			s.OwnerReferences = []metav1.OwnerReference{{APIVersion: "source.toolkit.fluxcd.io/v1beta1", Kind: "GitRepository", Name: "app"}}
+		}, true},
+		{"finalizers", func(s *corev1.Secret) { s.Finalizers = []string{deployKeyFinalizer} }, true},
+		{"deletion", func(s *corev1.Secret) { s.DeletionTimestamp = &metav1.Time{Time: time.Now()} }, true},
+	}
+	for _, test := range tests {
+		updated := old.DeepCopy()
+		updated.ResourceVersion = "2"
+		test.change(updated)
+		if got := materialChange(old, updated); got != test.want {
+			t.Errorf("%s: materialChange = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPathFromURLVanitySSHHost(t *testing.T) {
+	defer func(host, sshHost string) { gitlabHostname, gitSSHHost = host, sshHost }(gitlabHostname, gitSSHHost)
+	gitlabHostname, gitSSHHost = "gitlab.example.com", "ssh.example.com"
+
+	if got := pathFromURL("git@ssh.example.com:group/app.git"); got != "group/app" {
+		t.Errorf("path of a vanity ssh host url = %q, want group/app", got)
+	}
+	// The HTTPS urls still use the gitlab hostname
+	if got := pathFromURL("https://gitlab.example.com/group/app.git"); got != "group/app" {
+		t.Errorf("path of an https url = %q, want group/app", got)
+	}
+	// The git urls of the API host aren't the controller's
+	if got := pathFromURL("git@gitlab.example.com:group/app.git"); got == "group/app" {
+		t.Errorf("the ssh url of the API host resolved to %q", got)
+	}
+}
+
+// withLister sets the lister of the controller to one holding the secrets
+func (s *testSync) withLister(secrets ...*corev1.Secret) *testSync {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, secret := range secrets {
+		indexer.Add(secret)
+	}
+	s.secretsLister = corelisters.NewSecretLister(indexer)
+	return s
+}
+
+func TestHandleRoutesDeletions(t *testing.T) {
+	c := &Controller{
+		workqueue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		deletionqueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	deleting := fluxSecret()
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+
+	c.handle(fluxSecret(), false)
+	c.handle(fluxSecret(), true)
+	c.handle(deleting, false)
+	c.handle(cache.DeletedFinalStateUnknown{Key: "flux/flux-git-deploy", Obj: fluxSecret()}, true)
+	if c.workqueue.Len() != 1 || c.deletionqueue.Len() != 3 {
+		t.Fatalf("queued %d secrets to sync and %d to delete, want 1 and 3", c.workqueue.Len(), c.deletionqueue.Len())
+	}
+	for c.deletionqueue.Len() > 0 {
+		item, _ := c.deletionqueue.Get()
+		if _, ok := item.(*corev1.Secret); !ok {
+			t.Errorf("deletion queue item is a %T, want a Secret", item)
+		}
+		c.deletionqueue.Done(item)
+	}
+}
+
+func TestDeletionHandler(t *testing.T) {
+	deleted := func(gl *fakeGitlab) bool { _, ok := gl.keys[1]; return !ok }
+	keyedGitlab := func() *fakeGitlab {
+		gl := newFakeGitlab()
+		gl.addKey(&gitlab.DeployKey{Title: "Flux"})
+		return gl
+	}
+	secret := fluxSecret()
+
+	gl := keyedGitlab()
+	s := newTestSync(t, gl).withLister()
+	if err := s.deletionHandler(context.Background(), secret); err != nil || !deleted(gl) {
+		t.Errorf("deleted secret: err %v, key deleted %v, want it deleted", err, deleted(gl))
+	}
+
+	gl = keyedGitlab()
+	s = newTestSync(t, gl).withLister(secret)
+	if err := s.deletionHandler(context.Background(), secret); err != nil || deleted(gl) {
+		t.Errorf("secret labeled again: err %v, key deleted %v, want it kept", err, deleted(gl))
+	}
+
+	recreated := secret.DeepCopy()
+	recreated.UID = "recreated"
+	gl = keyedGitlab()
+	s = newTestSync(t, gl).withLister(recreated)
+	if err := s.deletionHandler(context.Background(), secret); err != nil || !deleted(gl) {
+		t.Errorf("secret recreated under the same name: err %v, key deleted %v, want it deleted", err, deleted(gl))
+	}
+
+	// The sync of a deleted secret's queued item is left to the deletion
+	// queue
+	gl = keyedGitlab()
+	s = newTestSync(t, gl).withLister(recreated)
+	if err := s.syncHandler(context.Background(), secret); err != nil || len(gl.requested()) > 0 {
+		t.Errorf("syncHandler of a deleted secret: err %v, requests %v, want none", err, gl.requested())
+	}
+}
+
+func TestSyncWarnsAboutPushProtection(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		level  gitlab.AccessLevelValue
+		warned bool
+	}{
+		{"no one can push", gitlab.NoPermissions, true},
+		{"maintainers can push", gitlab.MaintainerPermissions, false},
+	} {
+		gl := newFakeGitlab()
+		gl.protected = map[string]*gitlab.ProtectedBranch{"main": {
+			Name:             "main",
+			PushAccessLevels: []*gitlab.BranchAccessDescription{{AccessLevel: test.level}},
+		}}
+		secret := identitySecret(t)
+		s := newTestSync(t, gl, secret)
+		if err := s.syncSecret(context.Background(), secret); err != nil {
+			t.Fatalf("%s: syncSecret: %s", test.name, err.Error())
+		}
+		if warned := hasEvent(s.events(), PushProtected); warned != test.warned {
+			t.Errorf("%s: %s event = %v, want %v", test.name, PushProtected, warned, test.warned)
+		}
+	}
+
+	// The protection doesn't matter to read-only keys
+	gl := newFakeGitlab()
+	secret := identitySecret(t)
+	secret.Annotations[deployKeyCanPushLabelName] = "false"
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	for _, request := range gl.requested() {
+		if strings.Contains(request, "protected_branches") {
+			t.Errorf("the protection was checked for a read-only key: %s", request)
+		}
+	}
+}
+
+func TestStatusPatch(t *testing.T) {
+	secret := fluxSecret()
+	secret.Annotations[createdTitleLabelName] = "Flux"
+	secret.Annotations["example.com/other"] = "other"
+
+	data, err := statusPatch(secret, map[string]string{deployKeyLabelName: "2", projectIdLabelName: "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patch corev1.Secret
+	if err := json.Unmarshal(data, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if patch.APIVersion != "v1" || patch.Kind != "Secret" || patch.Namespace != secret.Namespace || patch.Name != secret.Name {
+		t.Errorf("patch of %s/%s %s/%s, want the v1 Secret %s/%s", patch.APIVersion, patch.Kind, patch.Namespace, patch.Name, secret.Namespace, secret.Name)
+	}
+	want := map[string]string{deployKeyLabelName: "2", projectIdLabelName: "10", createdTitleLabelName: "Flux"}
+	if !reflect.DeepEqual(patch.Annotations, want) {
+		t.Errorf("patched annotations = %v, want the new and already managed ones %v", patch.Annotations, want)
+	}
+	if len(patch.Data) > 0 || len(patch.Labels) > 0 {
+		t.Errorf("the patch sets fields the controller doesn't own: %s", data)
+	}
+}
+
+func TestGitURLFromName(t *testing.T) {
+	defer func(tmpl *template.Template, host string) { gitURLTemplate, gitSSHHost = tmpl, host }(gitURLTemplate, gitSSHHost)
+	gitSSHHost = "git.example.com"
+	gitURLTemplate = template.Must(template.New("git-url-from-name").Option("missingkey=error").Parse("{{.Namespace}}/{{.Name}}/"))
+
+	secret := unannotatedSecret()
+	if url, ok := gitURL(secret); !ok || url != "git@git.example.com:flux/flux-git-deploy.git" {
+		t.Errorf("gitURL = %q, %v, want the url derived from the name", url, ok)
+	}
+	if got := projectPath(secret); got != "flux/flux-git-deploy" {
+		t.Errorf("projectPath = %q, want flux/flux-git-deploy", got)
+	}
+
+	// The annotation takes precedence
+	secret.Annotations = map[string]string{gitUrlLabelName: "git@git.example.com:group/app.git"}
+	if got := projectPath(secret); got != "group/app" {
+		t.Errorf("projectPath = %q, want the annotation's group/app", got)
+	}
+
+	gitURLTemplate = template.Must(template.New("git-url-from-name").Parse("{{if false}}x{{end}}"))
+	if _, err := projectPathFromName("flux", "flux-git-deploy"); err == nil {
+		t.Errorf("a template producing an empty path didn't fail")
+	}
+}
+
+func TestAllowedProject(t *testing.T) {
+	defer func(allowlist []string) { projectAllowlist = allowlist }(projectAllowlist)
+
+	projectAllowlist = nil
+	if !allowedProject("any/project") {
+		t.Errorf("project not allowed without an allowlist")
+	}
+
+	projectAllowlist = []string{"group/app", "platform/*"}
+	for project, want := range map[string]bool{"group/app": true, "platform/flux": true, "platform/sub/flux": false, "group/other": false} {
+		if got := allowedProject(project); got != want {
+			t.Errorf("allowedProject(%s) = %v, want %v", project, got, want)
+		}
+	}
+
+	gl := newFakeGitlab()
+	secret := identitySecret(t)
+	secret.Annotations[gitUrlLabelName] = "git@" + gitSSHHost + ":group/other.git"
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if len(gl.requested()) > 0 || !hasEvent(s.events(), ProjectNotAllowed) {
+		t.Errorf("secret of a project out of the allowlist made requests %v, want none and a %s event", gl.requested(), ProjectNotAllowed)
+	}
+}
+
+func TestLookupProjectEmpty(t *testing.T) {
+	s := newTestSync(t, newFakeGitlab())
+	s.gitlabClient = newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	if _, err := s.lookupProject(context.Background(), fluxSecret()); !errors.Is(err, errEmptyProject) {
+		t.Errorf("lookupProject of an empty project = %v, want errEmptyProject", err)
+	}
+	if !hasEvent(s.events(), ErrEmptyProject) {
+		t.Errorf("events = %v, want an %s event", s.events(), ErrEmptyProject)
+	}
+}
+
+func TestKeyLimit(t *testing.T) {
+	defer func(max int) { maxManagedKeys = max }(maxManagedKeys)
+	maxManagedKeys = 2
+
+	secret := identitySecret(t)
+	managed := fluxSecret()
+	managed.Name = "managed"
+	s := newTestSync(t, newFakeGitlab(), secret, managed)
+	if !s.belowKeyLimit(secret) || testutil.ToFloat64(keyLimitReached) != 0 {
+		t.Errorf("the key limit is reached with a single managed key")
+	}
+
+	// The keys of the identity pairs count too
+	paired := fluxSecret()
+	delete(paired.Annotations, deployKeyLabelName)
+	paired.Annotations[deployKeyIdsLabelName] = `{"a": 2}`
+	s.list = func() ([]*corev1.Secret, error) { return []*corev1.Secret{secret, managed, paired}, nil }
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if len(s.gitlab.keys) != 0 {
+		t.Errorf("a deploy key was created past the limit")
+	}
+	if !hasEvent(s.events(), ErrKeyLimitReached) || testutil.ToFloat64(keyLimitReached) != 1 {
+		t.Errorf("reaching the key limit wasn't reported")
+	}
+
+	maxManagedKeys = 0
+	if !s.belowKeyLimit(secret) {
+		t.Errorf("the key limit is reached without -max-managed-keys")
+	}
+}
+
+func TestIdentitySelectors(t *testing.T) {
+	defer func(keys string) { identityKeys = keys }(identityKeys)
+	identityKeys = "identity, config.yaml#ssh.privateKey"
+
+	secret := unannotatedSecret()
+	secret.Data = map[string][]byte{"config.yaml": []byte("ssh:\n  privateKey: key\n")}
+	if data, ok := identity(secret); !ok || string(data) != "key" {
+		t.Errorf("identity = %q, %v, want the field of the YAML data key", data, ok)
+	}
+	secret.Data["config.yaml"] = []byte(`{"ssh": {"privateKey": "json"}}`)
+	if data, ok := identity(secret); !ok || string(data) != "json" {
+		t.Errorf("identity = %q, %v, want the field of the JSON data key", data, ok)
+	}
+	for _, invalid := range []string{`{"ssh": {"privateKey": ""}}`, `{"ssh": {"privateKey": 1}}`, `{"ssh": "key"}`, "{invalid"} {
+		secret.Data["config.yaml"] = []byte(invalid)
+		if data, ok := identity(secret); ok {
+			t.Errorf("identity of %s = %q, want none", invalid, data)
+		}
+	}
+	secret.Data["identity"] = []byte("first")
+	if data, _ := identity(secret); string(data) != "first" {
+		t.Errorf("identity = %q, want the first data key present", data)
+	}
+
+	for keys, valid := range map[string]bool{
+		"identity,ssh-privatekey": true,
+		"config.yaml#ssh.key":     true,
+		"identity,":               false,
+		"#ssh.key":                false,
+		"config.yaml#":            false,
+		"config.yaml#ssh..key":    false,
+		"config.yaml#.ssh":        false,
+	} {
+		if err := validateIdentityKeys(keys); (err == nil) != valid {
+			t.Errorf("validateIdentityKeys(%q) = %v", keys, err)
+		}
+	}
+}
+
+func TestSyncIdentityChanged(t *testing.T) {
+	defer func(reconcile bool) { reconcileOnIdentityChange = reconcile }(reconcileOnIdentityChange)
+	reconcileOnIdentityChange = true
+
+	_, previous := testKey(t, 2048)
+	gl := newFakeGitlab()
+	gl.addKey(&gitlab.DeployKey{Title: deployKeyTitle, Key: string(ssh.MarshalAuthorizedKey(previous))})
+	secret := identitySecret(t)
+	secret.Annotations[deployKeyLabelName] = "1"
+	secret.Annotations[deployKeyFingerprintLabelName] = ssh.FingerprintSHA256(previous)
+	if !identityChanged(secret) {
+		t.Fatalf("the identity of a secret with another recorded fingerprint didn't change")
+	}
+
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if _, ok := gl.keys[1]; ok {
+		t.Errorf("the deploy key of the previous identity wasn't deleted")
+	}
+	updated := s.secret(t, secret)
+	if updated.Annotations[deployKeyLabelName] != "2" || identityChanged(updated) {
+		t.Errorf("annotations = %v, want the deploy key of the new identity", updated.Annotations)
+	}
+	if !hasEvent(s.events(), IdentityRotated) {
+		t.Errorf("no %s event", IdentityRotated)
+	}
+}
+
+// terminatingSync returns a testSync whose Secrets can't be updated, their
+// namespace terminating
+func terminatingSync(t *testing.T, secret *corev1.Secret) *testSync {
+	s := newTestSync(t, newFakeGitlab(), secret)
+	s.client.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, &apierrors.StatusError{ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Details: &metav1.StatusDetails{Causes: []metav1.StatusCause{{Type: corev1.NamespaceTerminatingCause}}},
+		}}
+	})
+	return s
+}
+
+func TestSyncNamespaceTerminating(t *testing.T) {
+	secret := identitySecret(t)
+	s := terminatingSync(t, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret = %s, want no retry", err.Error())
+	}
+	if len(s.gitlab.keys) != 0 {
+		t.Errorf("the deploy key the secret can't record wasn't deleted")
+	}
+	if !hasEvent(s.events(), NamespaceTerminating) {
+		t.Errorf("no %s event", NamespaceTerminating)
+	}
+}
+
+func TestSyncNamespaceTerminatingDeletionsHalted(t *testing.T) {
+	setDeletionLimits(t, 0, 1, time.Minute)
+	secret := identitySecret(t)
+	s := terminatingSync(t, secret)
+	s.deletions.halted = true
+	if err := s.syncSecret(context.Background(), secret); err != errDeletionsHalted {
+		t.Fatalf("syncSecret = %v, want errDeletionsHalted", err)
+	}
+	if len(s.gitlab.keys) != 1 {
+		t.Errorf("the deploy key was deleted while the deletions are halted")
+	}
+}
+
+func TestVerifyAfterCreate(t *testing.T) {
+	defer func(after time.Duration, verify bool) { verifyAfterCreate, verifyKeys = after, verify }(verifyAfterCreate, verifyKeys)
+	verifyAfterCreate = time.Hour
+	verifyKeys = false
+
+	secret := identitySecret(t)
+	s := newTestSync(t, newFakeGitlab(), secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if after, ok := s.verifyRequeue(secret); !ok || after <= 59*time.Minute {
+		t.Errorf("verifyRequeue = %v, %v, want a requeue in an hour", after, ok)
+	}
+	if s.verifyDue(secret) {
+		t.Errorf("the new deploy key is due for verification right away")
+	}
+
+	s.created[secret.Namespace+"/"+secret.Name] = time.Now().Add(-time.Second)
+	if _, ok := s.verifyRequeue(secret); ok || !s.verifyDue(secret) {
+		t.Fatalf("the new deploy key isn't due for verification once -verify-after-create elapsed")
+	}
+	requests := len(s.gitlab.requested())
+	if err := s.syncSecret(context.Background(), s.secret(t, secret)); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if !reflect.DeepEqual(s.gitlab.requested()[requests:], []string{"GET /api/v4/projects/10/deploy_keys/1"}) {
+		t.Errorf("requests = %v, want the verification of the deploy key", s.gitlab.requested()[requests:])
+	}
+	if s.verifyDue(secret) {
+		t.Errorf("the verified deploy key is still due for verification")
+	}
+}
+
+func TestProjectKeyLimit(t *testing.T) {
+	defer func(limit int) { projectKeyLimit = limit }(projectKeyLimit)
+
+	tests := []struct {
+		limit   int
+		created bool
+		reason  string
+	}{
+		{2, false, ErrProjectKeyLimit},
+		{3, true, ProjectKeyLimitNear},
+		{0, true, ""},
+	}
+	for _, test := range tests {
+		projectKeyLimit = test.limit
+		gl := newFakeGitlab()
+		gl.addKey(&gitlab.DeployKey{Title: "other"})
+		gl.addKey(&gitlab.DeployKey{Title: "another"})
+		secret := identitySecret(t)
+		s := newTestSync(t, gl, secret)
+		if err := s.syncSecret(context.Background(), secret); err != nil {
+			t.Fatalf("limit %d: syncSecret: %s", test.limit, err.Error())
+		}
+		if created := len(gl.keys) == 3; created != test.created {
+			t.Errorf("limit %d: created = %v, want %v", test.limit, created, test.created)
+		}
+		if events := s.events(); test.reason != "" && !hasEvent(events, test.reason) {
+			t.Errorf("limit %d: events = %v, want a %s event", test.limit, events, test.reason)
+		}
+	}
+
+	// gitlab rejecting the key for its own limit isn't retried
+	projectKeyLimit = 0
+	gl := newFakeGitlab()
+	gl.addError, gl.addMessage = http.StatusBadRequest, "Deploy keys limit exceeded"
+	secret := identitySecret(t)
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Errorf("syncSecret = %s, want no retry", err.Error())
+	}
+	if !hasEvent(s.events(), ErrProjectKeyLimit) {
+		t.Errorf("no %s event", ErrProjectKeyLimit)
+	}
+}
+
+func TestOtherProvider(t *testing.T) {
+	defer func(provider string) { defaultProvider = provider }(defaultProvider)
+	defaultProvider = gitlabProvider
+
+	secret := identitySecret(t)
+	secret.Annotations[providerLabelName] = "github"
+	s := newTestSync(t, newFakeGitlab(), secret)
+	s.gitlabClient = unusedGitlab(t)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Errorf("syncSecret: %s", err.Error())
+	}
+	secret.Annotations[deployKeyLabelName] = "1"
+	if err := s.removeDeployKey(context.Background(), secret); err != nil {
+		t.Errorf("removeDeployKey: %s", err.Error())
+	}
+
+	// The secrets without the annotation are the -provider's
+	delete(secret.Annotations, providerLabelName)
+	if !isGitlabSecret(secret) {
+		t.Errorf("a secret without a provider isn't a gitlab secret")
+	}
+	defaultProvider = "github"
+	secret.Annotations[providerLabelName] = "GitLab"
+	if !isGitlabSecret(secret) {
+		t.Errorf("a secret of the GitLab provider isn't a gitlab secret")
+	}
+	delete(secret.Annotations, providerLabelName)
+	if isGitlabSecret(secret) {
+		t.Errorf("a secret without a provider isn't the -provider's")
+	}
+}
+
+func TestUpdateSecretConflict(t *testing.T) {
+	secret := fluxSecret()
+	s := newTestSync(t, newFakeGitlab(), secret)
+	conflicts := 0
+	s.client.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		// Someone else changed the secret since it was read
+		changed := secret.DeepCopy()
+		changed.Annotations["other"] = "value"
+		if err := s.client.Tracker().Update(corev1.SchemeGroupVersion.WithResource("secrets"), changed, changed.Namespace); err != nil {
+			return true, nil, err
+		}
+		return true, nil, apierrors.NewConflict(corev1.Resource("secrets"), secret.Name, fmt.Errorf("the object has been modified"))
+	})
+
+	err := s.updateSecret(context.Background(), secret, func(secret *corev1.Secret) {
+		secret.Annotations[deployKeyLabelName] = "2"
+	})
+	if err != nil {
+		t.Fatalf("updateSecret: %s", err.Error())
+	}
+	annotations := s.secret(t, secret).Annotations
+	if annotations[deployKeyLabelName] != "2" || annotations["other"] != "value" {
+		t.Errorf("annotations = %v, want the update made on the latest secret", annotations)
+	}
+}
+
+func TestRemoveDeployKeyByFingerprint(t *testing.T) {
+	_, other := testKey(t, 2048)
+	tests := []struct {
+		name     string
+		mutate   func(secret *corev1.Secret, fingerprint string)
+		deleted  bool
+		requests bool
+	}{
+		{"corrupted id", func(secret *corev1.Secret, fingerprint string) {
+			secret.Annotations[deployKeyLabelName] = "corrupted"
+			secret.Annotations[deployKeyFingerprintLabelName] = fingerprint
+		}, true, true},
+		{"identity", func(secret *corev1.Secret, fingerprint string) {
+			secret.Annotations[projectPathLabelName] = "group/app"
+		}, true, true},
+		{"never had a key", func(secret *corev1.Secret, fingerprint string) {}, false, false},
+		{"missing key", func(secret *corev1.Secret, fingerprint string) {
+			secret.Annotations[projectPathLabelName] = "group/app"
+			secret.Annotations[deployKeyMissingLabelName] = "2"
+		}, false, false},
+	}
+	for _, test := range tests {
+		secret := identitySecret(t)
+		sshKey, err := publicKey(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.mutate(secret, ssh.FingerprintSHA256(sshKey))
+		gl := newFakeGitlab()
+		gl.addKey(&gitlab.DeployKey{Title: "other", Key: string(ssh.MarshalAuthorizedKey(other))})
+		gl.addKey(&gitlab.DeployKey{Title: deployKeyTitle, Key: string(ssh.MarshalAuthorizedKey(sshKey))})
+		s := newTestSync(t, gl, secret)
+
+		if err := s.removeDeployKey(context.Background(), secret); err != nil {
+			t.Errorf("%s: removeDeployKey: %s", test.name, err.Error())
+		}
+		if _, ok := gl.keys[2]; ok == test.deleted {
+			t.Errorf("%s: deleted = %v, want %v", test.name, !ok, test.deleted)
+		}
+		if _, ok := gl.keys[1]; !ok {
+			t.Errorf("%s: the deploy key of another fingerprint was deleted", test.name)
+		}
+		if requested := len(gl.requested()) > 0; requested != test.requests {
+			t.Errorf("%s: requests = %v", test.name, gl.requested())
+		}
+	}
+}
+
+func TestRemoveDeployKeyByFingerprintNoDelete(t *testing.T) {
+	defer func(disabled bool) { noDelete = disabled }(noDelete)
+	noDelete = true
+
+	secret := identitySecret(t)
+	secret.Annotations[projectPathLabelName] = "group/app"
+	sshKey, err := publicKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gl := newFakeGitlab()
+	gl.addKey(&gitlab.DeployKey{Title: deployKeyTitle, Key: string(ssh.MarshalAuthorizedKey(sshKey))})
+	s := newTestSync(t, gl, secret)
+	if err := s.removeDeployKey(context.Background(), secret); err != nil {
+		t.Fatalf("removeDeployKey: %s", err.Error())
+	}
+	if _, ok := gl.keys[1]; !ok {
+		t.Errorf("the deploy key was deleted with -no-delete")
+	}
+	if events := s.events(); !hasEvent(events, SkippedDelete) {
+		t.Errorf("events = %v, want %s", events, SkippedDelete)
+	}
+}
+
+func TestSyncPushRequired(t *testing.T) {
+	defer func(allow, canPush bool) { allowPushKeys, deployKeyCanPush = allow, canPush }(allowPushKeys, deployKeyCanPush)
+	deployKeyCanPush = false
+
+	tests := []struct {
+		name     string
+		allow    bool
+		mirror   bool
+		required bool
+		created  bool
+		canPush  bool
+	}{
+		{"required", true, false, true, true, true},
+		{"push keys disallowed", false, false, true, false, false},
+		{"mirror", true, true, true, false, false},
+		{"not required with push keys disallowed", false, false, false, true, false},
+	}
+	for _, test := range tests {
+		allowPushKeys = test.allow
+		gl := newFakeGitlab()
+		gl.project.Mirror = test.mirror
+		secret := identitySecret(t)
+		if test.required {
+			secret.Annotations[pushRequiredLabelName] = "true"
+		}
+		s := newTestSync(t, gl, secret)
+		if err := s.syncSecret(context.Background(), secret); err != nil {
+			t.Fatalf("%s: syncSecret: %s", test.name, err.Error())
+		}
+		key, created := gl.keys[1]
+		if created != test.created {
+			t.Fatalf("%s: created = %v, want %v", test.name, created, test.created)
+		}
+		if created && *key.CanPush != test.canPush {
+			t.Errorf("%s: can push = %v, want %v", test.name, *key.CanPush, test.canPush)
+		}
+		if !created && !hasEvent(s.events(), ErrPushRequired) {
+			t.Errorf("%s: no %s event", test.name, ErrPushRequired)
+		}
+	}
+}
+
+func TestStartWorkers(t *testing.T) {
+	defer func(ramp time.Duration) { startupRamp = ramp }(startupRamp)
+
+	for _, test := range []struct {
+		ramp    time.Duration
+		workers int
+	}{
+		{0, 3},
+		{time.Hour, 1},
+	} {
+		startupRamp = test.ramp
+		var secrets []*corev1.Secret
+		for i := 0; i < 3; i++ {
+			secret := identitySecret(t)
+			secret.Name = fmt.Sprintf("secret-%d", i)
+			secret.UID = types.UID(secret.Name)
+			secret.Annotations[gitUrlLabelName] = fmt.Sprintf("git@%s:group/app-%d.git", gitSSHHost, i)
+			secrets = append(secrets, secret)
+		}
+		s := newTestSync(t, newFakeGitlab(), secrets...).withLister(secrets...)
+		s.workqueue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		// Every sync blocks on its first gitlab request until released
+		started := make(chan struct{}, len(secrets))
+		release := make(chan struct{})
+		s.gitlabClient = newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		for _, secret := range secrets {
+			s.workqueue.Add(secret)
+		}
+
+		stopCh := make(chan struct{})
+		go s.startWorkers(3, stopCh)
+		for i := 0; i < test.workers; i++ {
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("ramp %s: %d syncs started, want %d", test.ramp, i, test.workers)
+			}
+		}
+		select {
+		case <-started:
+			t.Errorf("ramp %s: more than %d syncs started", test.ramp, test.workers)
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(stopCh)
+		s.workqueue.ShutDown()
+		close(release)
+	}
+}
+
+func TestSyncRequireGitURL(t *testing.T) {
+	defer func(require bool) { requireGitURL = require }(requireGitURL)
+
+	for _, require := range []bool{false, true} {
+		requireGitURL = require
+		secret := identitySecret(t)
+		delete(secret.Annotations, gitUrlLabelName)
+		s := newTestSync(t, newFakeGitlab(), secret)
+		s.gitlabClient = unusedGitlab(t)
+		if err := s.syncSecret(context.Background(), secret); err != nil {
+			t.Errorf("syncSecret: %s", err.Error())
+		}
+		if got := hasEvent(s.events(), ErrMissingGitURL); got != require {
+			t.Errorf("-require-git-url=%v: %s event = %v", require, ErrMissingGitURL, got)
+		}
+	}
+}
+
+func TestSyncArchivedReadOnly(t *testing.T) {
+	gl := newFakeGitlab()
+	gl.project.Archived = true
+	secret := identitySecret(t)
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if key := gl.keys[1]; key == nil || key.CanPush == nil || *key.CanPush {
+		t.Errorf("deploy key = %+v, want a read-only key", key)
+	}
+	if got := s.secret(t, secret).Annotations[archivedLabelName]; got != "true" {
+		t.Errorf("archived annotation = %q, want true", got)
+	}
+	if !hasEvent(s.events(), ReadOnlyArchived) {
+		t.Errorf("no %s event", ReadOnlyArchived)
+	}
+	if _, canPush := desiredKey(s.secret(t, secret)); canPush {
+		t.Errorf("the deploy key of an archived project should be read-only")
+	}
+
+	// A secret requiring push gets no key
+	gl = newFakeGitlab()
+	gl.project.Archived = true
+	secret = identitySecret(t)
+	secret.Annotations[pushRequiredLabelName] = "true"
+	s = newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if len(gl.keys) != 0 || !hasEvent(s.events(), ErrPushRequired) {
+		t.Errorf("a key was created for an archived project although push is required")
+	}
+}
+
+func TestSyncSuspended(t *testing.T) {
+	gl := newFakeGitlab()
+	gl.addKey(&gitlab.DeployKey{Title: deployKeyTitle})
+	secret := identitySecret(t)
+	secret.Annotations[deployKeyLabelName] = "1"
+	secret.Annotations[suspendLabelName] = "true"
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if len(gl.keys) != 0 {
+		t.Errorf("the deploy key of the suspended secret wasn't deleted")
+	}
+	if _, ok := s.secret(t, secret).Annotations[deployKeyLabelName]; ok {
+		t.Errorf("the deploy key annotation of the suspended secret wasn't removed")
+	}
+	if !hasEvent(s.events(), DeployKeySuspended) {
+		t.Errorf("no %s event", DeployKeySuspended)
+	}
+
+	// No key is created while suspended
+	if err := s.syncSecret(context.Background(), s.secret(t, secret)); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if len(gl.keys) != 0 {
+		t.Errorf("a deploy key was created for the suspended secret")
+	}
+
+	// Lifting the suspension creates a key again
+	lifted := s.secret(t, secret)
+	delete(lifted.Annotations, suspendLabelName)
+	if err := s.syncSecret(context.Background(), lifted); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if len(gl.keys) != 1 {
+		t.Errorf("no deploy key was created once the suspension was lifted")
+	}
+}
+
+func TestForEachDeployKeyPages(t *testing.T) {
+	defer func(size int) { gitlabPageSize = size }(gitlabPageSize)
+	gitlabPageSize = 2
+
+	var keys []*gitlab.DeployKey
+	for id := 1; id <= 5; id++ {
+		_, publicKey := testKey(t, 1024)
+		keys = append(keys, &gitlab.DeployKey{ID: id, Key: string(ssh.MarshalAuthorizedKey(publicKey))})
+	}
+	var pages []string
+	s := newTestSync(t, newFakeGitlab())
+	s.gitlabClient = newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, perPage := r.URL.Query().Get("page"), r.URL.Query().Get("per_page")
+		pages = append(pages, perPage+"/"+page)
+		start := 0
+		if page != "" {
+			fmt.Sscan(page, &start)
+			start = (start - 1) * gitlabPageSize
+		}
+		end := start + gitlabPageSize
+		if end < len(keys) {
+			w.Header().Set("X-Next-Page", fmt.Sprint(end/gitlabPageSize+1))
+		} else {
+			end = len(keys)
+		}
+		json.NewEncoder(w).Encode(keys[start:end])
+	}))
+
+	ctx := context.Background()
+	if count, err := s.countDeployKeys(ctx, 10); err != nil || count != 5 {
+		t.Errorf("countDeployKeys = %d, %v, want the 5 keys of every page", count, err)
+	}
+	if want := []string{"2/", "2/2", "2/3"}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+
+	pages = nil
+	want, _ := fingerprint(keys[2].Key)
+	if key, err := s.findDeployKey(ctx, 10, want); err != nil || key.ID != 3 {
+		t.Errorf("findDeployKey = %+v, %v, want key 3", key, err)
+	}
+	if len(pages) != 2 {
+		t.Errorf("findDeployKey listed the pages %v, want it to stop at the page of the key", pages)
+	}
+	if _, err := s.findDeployKey(ctx, 10, "SHA256:missing"); !errors.Is(err, errDeployKeyNotFound) {
+		t.Errorf("findDeployKey of a missing key = %v, want errDeployKeyNotFound", err)
+	}
+}
+
+// adoptableSecret returns a secret whose key already is the read-only deploy
+// key 1 of the fake gitlab, which rejects adding it again
+func adoptableSecret(t *testing.T, gl *fakeGitlab) *corev1.Secret {
+	secret := identitySecret(t)
+	sshKey, err := publicKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gl.addKey(&gitlab.DeployKey{Title: "added by hand", Key: string(ssh.MarshalAuthorizedKey(sshKey)), CanPush: gitlab.Bool(false)})
+	gl.addError, gl.addMessage = http.StatusBadRequest, "fingerprint has already been taken"
+	return secret
+}
+
+func TestSyncAdoptedPushMismatch(t *testing.T) {
+	defer func(mismatch string) { adoptPushMismatch = mismatch }(adoptPushMismatch)
+
+	adoptPushMismatch = adoptPushUpdate
+	gl := newFakeGitlab()
+	secret := adoptableSecret(t, gl)
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if key := gl.keys[1]; key.CanPush == nil || !*key.CanPush {
+		t.Errorf("deploy key = %+v, want the adopted key updated to push", key)
+	}
+	if events := s.events(); !hasEvent(events, AdoptedPushMismatch) || !hasEvent(events, DeployKeyAdopted) {
+		t.Errorf("events = %v, want %s and %s", events, AdoptedPushMismatch, DeployKeyAdopted)
+	}
+
+	adoptPushMismatch = adoptPushKeep
+	gl = newFakeGitlab()
+	secret = adoptableSecret(t, gl)
+	s = newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if key := gl.keys[1]; key.CanPush == nil || *key.CanPush {
+		t.Errorf("deploy key = %+v, want the adopted key kept read-only", key)
+	}
+	if hasEvent(s.events(), AdoptedPushMismatch) {
+		t.Errorf("a %s event with -adopt-push-mismatch=keep", AdoptedPushMismatch)
+	}
+}
+
+func TestSyncAdoptedPushRecreated(t *testing.T) {
+	defer func(mismatch string) { adoptPushMismatch = mismatch }(adoptPushMismatch)
+	adoptPushMismatch = adoptPushUpdate
+
+	gl := newFakeGitlab()
+	secret := adoptableSecret(t, gl)
+	s := newTestSync(t, gl, secret)
+	// An older gitlab that can't update deploy keys
+	s.gitlabClient = newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		case http.MethodDelete:
+			// The key is added again once deleted
+			gl.mu.Lock()
+			gl.addError = 0
+			gl.mu.Unlock()
+		}
+		gl.ServeHTTP(w, r)
+	}))
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if _, ok := gl.keys[1]; ok {
+		t.Errorf("the adopted deploy key wasn't deleted")
+	}
+	if key := gl.keys[2]; key == nil || key.CanPush == nil || !*key.CanPush {
+		t.Errorf("deploy key 2 = %+v, want the key recreated with push", key)
+	}
+	if got := s.secret(t, secret).Annotations[deployKeyLabelName]; got != "2" {
+		t.Errorf("deploy key annotation = %q, want the recreated key 2", got)
+	}
+	events := s.events()
+	if !hasEvent(events, AdoptedPushMismatch) || hasEvent(events, DeployKeyAdopted) {
+		t.Errorf("events = %v, want %s and the key created rather than adopted", events, AdoptedPushMismatch)
+	}
+}
+
+func TestSyncAdoptedPushNoDelete(t *testing.T) {
+	defer func(mismatch string, disabled bool) { adoptPushMismatch, noDelete = mismatch, disabled }(adoptPushMismatch, noDelete)
+	adoptPushMismatch, noDelete = adoptPushUpdate, true
+
+	gl := newFakeGitlab()
+	secret := adoptableSecret(t, gl)
+	s := newTestSync(t, gl, secret)
+	// An older gitlab that can't update deploy keys
+	s.gitlabClient = newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		gl.ServeHTTP(w, r)
+	}))
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if _, ok := gl.keys[1]; !ok {
+		t.Errorf("the adopted deploy key was deleted with -no-delete")
+	}
+	if got := s.secret(t, secret).Annotations[deployKeyLabelName]; got != "1" {
+		t.Errorf("deploy key annotation = %q, want the adopted key 1", got)
+	}
+	if events := s.events(); !hasEvent(events, SkippedDelete) || !hasEvent(events, DeployKeyAdopted) {
+		t.Errorf("events = %v, want %s and %s", events, SkippedDelete, DeployKeyAdopted)
+	}
+}
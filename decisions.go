@@ -0,0 +1,116 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// decisionLabelName is the label used to record, on every event, the
+// decision the controller made for the Secret as a code the tooling watching
+// the events can rely on, unlike the messages
+const decisionLabelName = "fluxcd.io/decision"
+
+// The decision codes of the events
+const (
+	decisionCreated = "created"
+	decisionAdopted = "adopted"
+	decisionUpdated = "updated"
+	decisionRotated = "rotated"
+	decisionDeleted = "deleted"
+	decisionSkipped = "skipped"
+	decisionMissing = "missing"
+	decisionNotice  = "notice"
+	decisionError   = "error"
+)
+
+// decisions are the decision codes of the event reasons
+var decisions = map[string]string{
+	SuccessSynced:            decisionCreated,
+	DeployKeyAdopted:         decisionAdopted,
+	DeployKeyRenamed:         decisionAdopted,
+	AdoptedPushMismatch:      decisionUpdated,
+	SuccessUpdated:           decisionUpdated,
+	IdentityRotated:          decisionRotated,
+	KeyAgeRotated:            decisionRotated,
+	IdentityReplaced:         decisionRotated,
+	DeployKeyDeleted:         decisionDeleted,
+	DeployKeySuspended:       decisionDeleted,
+	NamespaceTerminating:     decisionDeleted,
+	ProjectNotAllowed:        decisionSkipped,
+	SkippedDelete:            decisionSkipped,
+	DeployKeyMissing:         decisionMissing,
+	ReadOnlyMirror:           decisionNotice,
+	ReadOnlyArchived:         decisionNotice,
+	PushPolicyDenied:         decisionNotice,
+	PushProtected:            decisionNotice,
+	ProjectKeyLimitNear:      decisionNotice,
+	TitleDrift:               decisionNotice,
+	ErrResourceExists:        decisionError,
+	ErrInvalidRequestTimeout: decisionError,
+	ErrGitLabAuth:            decisionError,
+	ErrKeyLimitReached:       decisionError,
+	ErrPushRequired:          decisionError,
+	ErrProjectKeyLimit:       decisionError,
+	ErrEmptyProject:          decisionError,
+	ErrMissingIdentity:       decisionError,
+	ErrKeyPolicy:             decisionError,
+	ErrMissingGitURL:         decisionError,
+	ErrInvalidTokenScopes:    decisionError,
+	ReconcileTimeout:         decisionError,
+	ReconcileDeadLettered:    decisionError,
+}
+
+// decisionRecorder annotates the events it records with the decision code of
+// their reason, and the name of their -remote-kubeconfigs cluster if any
+type decisionRecorder struct {
+	record.EventRecorder
+	cluster string
+}
+
+// annotations returns the annotations with the decision code of the reason
+// and the cluster added
+func (r decisionRecorder) annotations(annotations map[string]string, reason string) map[string]string {
+	decision, ok := decisions[reason]
+	if !ok && r.cluster == "" {
+		return annotations
+	}
+	annotated := map[string]string{}
+	if ok {
+		annotated[decisionLabelName] = decision
+	}
+	if r.cluster != "" {
+		annotated[clusterLabelName] = r.cluster
+	}
+	for key, value := range annotations {
+		annotated[key] = value
+	}
+	return annotated
+}
+
+func (r decisionRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.EventRecorder.AnnotatedEventf(object, r.annotations(nil, reason), eventtype, reason, "%s", message)
+}
+
+func (r decisionRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.EventRecorder.AnnotatedEventf(object, r.annotations(nil, reason), eventtype, reason, messageFmt, args...)
+}
+
+func (r decisionRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.EventRecorder.AnnotatedEventf(object, r.annotations(annotations, reason), eventtype, reason, messageFmt, args...)
+}
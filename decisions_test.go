@@ -0,0 +1,75 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// annotationsRecorder keeps the annotations of the last event recorded
+type annotationsRecorder struct {
+	record.EventRecorder
+	annotations map[string]string
+}
+
+func (r *annotationsRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.annotations = annotations
+}
+
+func TestDecisionRecorder(t *testing.T) {
+	annotations := &annotationsRecorder{}
+	recorder := decisionRecorder{EventRecorder: annotations}
+
+	recorder.Event(fluxSecret(), "Normal", SuccessSynced, MessageResourceSynced)
+	if want := map[string]string{decisionLabelName: decisionCreated}; !reflect.DeepEqual(annotations.annotations, want) {
+		t.Errorf("annotations = %v, want %v", annotations.annotations, want)
+	}
+	recorder.Eventf(fluxSecret(), "Normal", "Unknown", "message")
+	if len(annotations.annotations) != 0 {
+		t.Errorf("annotations = %v of a reason without decision, want none", annotations.annotations)
+	}
+
+	recorder.cluster = "remote"
+	recorder.AnnotatedEventf(fluxSecret(), map[string]string{"other": "value"}, "Warning", ErrKeyPolicy, "message")
+	if want := map[string]string{decisionLabelName: decisionError, clusterLabelName: "remote", "other": "value"}; !reflect.DeepEqual(annotations.annotations, want) {
+		t.Errorf("annotations = %v, want %v", annotations.annotations, want)
+	}
+}
+
+func TestDecisionsDocumented(t *testing.T) {
+	readme, err := ioutil.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	documented := map[string]string{}
+	row := regexp.MustCompile("(?m)^\\| `([a-z]+)` \\| (.*) \\|$")
+	for _, match := range row.FindAllStringSubmatch(string(readme), -1) {
+		for _, reason := range strings.Split(match[2], ", ") {
+			documented[strings.Trim(reason, "`")] = match[1]
+		}
+	}
+	if !reflect.DeepEqual(documented, decisions) {
+		t.Errorf("the README event decisions %v don't match %v", documented, decisions)
+	}
+}
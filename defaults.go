@@ -0,0 +1,156 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// keyDefaults are the deploy key settings of the secrets of a namespace that
+// don't set them with annotations
+type keyDefaults struct {
+	// Title is a template of the title, given the .Namespace and .Name of
+	// the secret
+	Title string `json:"title,omitempty"`
+	// CanPush is the push permission
+	CanPush *bool `json:"canPush,omitempty"`
+
+	title *template.Template
+}
+
+// namespaceDefaults holds the key defaults of the namespaces, read from the
+// -defaults-configmap ConfigMap
+type namespaceDefaults struct {
+	mu         sync.RWMutex
+	namespaces map[string]*keyDefaults
+}
+
+// defaults are the key defaults of the namespaces, empty without a
+// -defaults-configmap
+var defaults = &namespaceDefaults{}
+
+// get returns the key defaults of the namespace, nil if it has none
+func (d *namespaceDefaults) get(namespace string) *keyDefaults {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.namespaces[namespace]
+}
+
+// set replaces the key defaults with the ones of the ConfigMap, which maps
+// namespaces to YAML or JSON key defaults. Invalid entries are logged and
+// skipped.
+func (d *namespaceDefaults) set(configMap *corev1.ConfigMap) {
+	namespaces := map[string]*keyDefaults{}
+	if configMap != nil {
+		for namespace, value := range configMap.Data {
+			parsed, err := parseKeyDefaults(value)
+			if err != nil {
+				utilruntime.HandleError(fmt.Errorf("invalid key defaults of namespace %s: %s", namespace, err.Error()))
+				continue
+			}
+			namespaces[namespace] = parsed
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.namespaces = namespaces
+	klog.Infof("Loaded the key defaults of %d namespaces", len(namespaces))
+}
+
+// parseKeyDefaults parses the key defaults of a namespace
+func parseKeyDefaults(value string) (*keyDefaults, error) {
+	var parsed keyDefaults
+	if err := yaml.UnmarshalStrict([]byte(value), &parsed); err != nil {
+		return nil, err
+	}
+	if parsed.Title != "" {
+		t, err := template.New("title").Option("missingkey=error").Parse(parsed.Title)
+		if err != nil {
+			return nil, err
+		}
+		parsed.title = t
+	}
+	return &parsed, nil
+}
+
+// titleOf executes the title template for the secret, returning false when
+// there's none or it fails
+func (k *keyDefaults) titleOf(secret *corev1.Secret) (string, bool) {
+	if k == nil || k.title == nil {
+		return "", false
+	}
+	var title strings.Builder
+	if err := k.title.Execute(&title, struct{ Namespace, Name string }{secret.Namespace, secret.Name}); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to render the default title of secret %s/%s: %s", secret.Namespace, secret.Name, err.Error()))
+		return "", false
+	}
+	return title.String(), title.Len() > 0
+}
+
+// watchDefaults keeps the key defaults in sync with the -defaults-configmap
+// ConfigMap until stopCh is closed. The returned function reports whether
+// the ConfigMap was read.
+func watchDefaults(kubeClient kubernetes.Interface, stopCh <-chan struct{}) (cache.InformerSynced, error) {
+	if len(defaultsConfigMap) == 0 {
+		return func() bool { return true }, nil
+	}
+	parts := strings.SplitN(defaultsConfigMap, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid defaults ConfigMap %q, expected namespace/name", defaultsConfigMap)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(parts[0]),
+		informers.WithTweakListOptions(func(lo *metav1.ListOptions) {
+			lo.FieldSelector = fields.OneTermEqualSelector("metadata.name", parts[1]).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { defaults.set(obj.(*corev1.ConfigMap)) },
+		UpdateFunc: func(old, new interface{}) { defaults.set(new.(*corev1.ConfigMap)) },
+		DeleteFunc: func(obj interface{}) { defaults.set(nil) },
+	})
+	factory.Start(stopCh)
+	return informer.HasSynced, nil
+}
+
+// waitForDefaults starts watching the -defaults-configmap ConfigMap and waits
+// until it was read, so no key is created with the wrong defaults
+func waitForDefaults(kubeClient kubernetes.Interface, stopCh <-chan struct{}) error {
+	synced, err := watchDefaults(kubeClient, stopCh)
+	if err != nil {
+		return err
+	}
+	if !cache.WaitForCacheSync(stopCh, synced) {
+		return fmt.Errorf("failed to wait for the defaults ConfigMap to sync")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestNamespaceDefaults(t *testing.T) {
+	defer defaults.set(nil)
+	defaults.set(&corev1.ConfigMap{Data: map[string]string{
+		"tenant-a": "title: \"{{.Namespace}} {{.Name}}\"\ncanPush: false\n",
+		"tenant-b": `{"canPush": true}`,
+		"invalid":  "unknown: field",
+	}})
+
+	if defaults.get("invalid") != nil || defaults.get("other") != nil {
+		t.Errorf("invalid or missing namespaces have key defaults")
+	}
+
+	secret := unannotatedSecret()
+	secret.Namespace = "tenant-a"
+	if title, canPush := desiredKey(secret); title != "tenant-a flux-git-deploy" || canPush {
+		t.Errorf("desiredKey = %q, %v, want the namespace's title and read-only", title, canPush)
+	}
+	// The annotations take precedence over the namespace defaults
+	secret.Annotations = map[string]string{deployKeyTitleLabelName: "Custom"}
+	if title, _ := desiredKey(secret); title != "Custom" {
+		t.Errorf("title = %q, want the annotation's", title)
+	}
+
+	secret.Namespace = "tenant-b"
+	secret.Annotations = nil
+	if title, canPush := desiredKey(secret); title != deployKeyTitle || !canPush {
+		t.Errorf("desiredKey = %q, %v, want the default title and push", title, canPush)
+	}
+
+	if _, err := parseKeyDefaults("title: \"{{.Namespace\""); err == nil {
+		t.Errorf("an invalid title template didn't fail")
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// deletionHaltBackoff is how long the deletions are requeued for once the
+// guard halted them, so they don't spin until the controller is restarted
+const deletionHaltBackoff = 5 * time.Minute
+
+// errDeletionsHalted is returned for every deletion once the guard halted
+// them
+var errDeletionsHalted = fmt.Errorf("deploy key deletions are halted, restart the controller to resume them")
+
+// deletionDelayed is returned when the deletion rate limit is reached, the
+// deletion should be retried after the delay
+type deletionDelayed struct {
+	after time.Duration
+}
+
+func (e *deletionDelayed) Error() string {
+	return fmt.Sprintf("deletion rate limit of %d per minute reached", maxDeletionsPerMinute)
+}
+
+// deletionGuard bounds the blast radius of a mass Secret deletion, such as a
+// namespace teardown, by rate limiting the deploy key deletions and halting
+// them altogether once too many happened within a window.
+type deletionGuard struct {
+	mu     sync.Mutex
+	times  []time.Time
+	halted bool
+}
+
+// allow records a deletion about to be made, returning an error if it must
+// not be made now
+func (g *deletionGuard) allow() error {
+	if maxDeletionsPerMinute <= 0 && deletionHaltThreshold <= 0 {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.halted {
+		return errDeletionsHalted
+	}
+
+	now := time.Now()
+	window := time.Minute
+	if deletionHaltThreshold > 0 && deletionHaltWindow > window {
+		window = deletionHaltWindow
+	}
+	for len(g.times) > 0 && now.Sub(g.times[0]) >= window {
+		g.times = g.times[1:]
+	}
+
+	if maxDeletionsPerMinute > 0 {
+		recent := 0
+		oldest := now
+		for i := len(g.times) - 1; i >= 0 && now.Sub(g.times[i]) < time.Minute; i-- {
+			recent++
+			oldest = g.times[i]
+		}
+		if recent >= maxDeletionsPerMinute {
+			return &deletionDelayed{after: oldest.Add(time.Minute).Sub(now)}
+		}
+	}
+
+	if deletionHaltThreshold > 0 {
+		recent := 0
+		for i := len(g.times) - 1; i >= 0 && now.Sub(g.times[i]) < deletionHaltWindow; i-- {
+			recent++
+		}
+		if recent >= deletionHaltThreshold {
+			klog.Errorf("HALTING DEPLOY KEY DELETIONS: %d deploy keys were deleted within %s, which reaches -deletion-halt-threshold. No more deploy keys will be deleted until the controller is restarted.", recent, deletionHaltWindow)
+			g.halted = true
+			deletionsHalted.Set(1)
+			return errDeletionsHalted
+		}
+	}
+
+	g.times = append(g.times, now)
+	return nil
+}
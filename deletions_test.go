@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// setDeletionLimits sets the deletion guard flags until the test is over
+func setDeletionLimits(t *testing.T, perMinute, haltThreshold int, haltWindow time.Duration) {
+	perMinuteBefore, thresholdBefore, windowBefore := maxDeletionsPerMinute, deletionHaltThreshold, deletionHaltWindow
+	t.Cleanup(func() {
+		maxDeletionsPerMinute, deletionHaltThreshold, deletionHaltWindow = perMinuteBefore, thresholdBefore, windowBefore
+	})
+	maxDeletionsPerMinute, deletionHaltThreshold, deletionHaltWindow = perMinute, haltThreshold, haltWindow
+}
+
+func TestDeletionGuardUnlimited(t *testing.T) {
+	setDeletionLimits(t, 0, 0, 10*time.Minute)
+	var g deletionGuard
+	for i := 0; i < 1000; i++ {
+		if err := g.allow(); err != nil {
+			t.Fatalf("deletion %d: %s", i, err.Error())
+		}
+	}
+}
+
+func TestDeletionGuardRateLimit(t *testing.T) {
+	setDeletionLimits(t, 3, 0, 10*time.Minute)
+	var g deletionGuard
+	for i := 0; i < 3; i++ {
+		if err := g.allow(); err != nil {
+			t.Fatalf("deletion %d: %s", i, err.Error())
+		}
+	}
+	err := g.allow()
+	var delayed *deletionDelayed
+	if !errors.As(err, &delayed) {
+		t.Fatalf("deletion past the rate limit: got %v, want a delay", err)
+	}
+	if delayed.after <= 0 || delayed.after > time.Minute {
+		t.Errorf("delay = %s, want up to a minute", delayed.after)
+	}
+
+	// The deletions older than a minute no longer count
+	for i := range g.times {
+		g.times[i] = g.times[i].Add(-time.Minute)
+	}
+	if err := g.allow(); err != nil {
+		t.Errorf("deletion a minute later: %s", err.Error())
+	}
+}
+
+func TestDeletionGuardHalt(t *testing.T) {
+	setDeletionLimits(t, 0, 3, 10*time.Minute)
+	var g deletionGuard
+	for i := 0; i < 3; i++ {
+		if err := g.allow(); err != nil {
+			t.Fatalf("deletion %d: %s", i, err.Error())
+		}
+	}
+	if err := g.allow(); err != errDeletionsHalted {
+		t.Fatalf("deletion past the halt threshold: got %v, want %v", err, errDeletionsHalted)
+	}
+
+	// The halt lasts until the controller is restarted
+	g.times = nil
+	if err := g.allow(); err != errDeletionsHalted {
+		t.Errorf("deletion once halted: got %v, want %v", err, errDeletionsHalted)
+	}
+}
+
+func TestDeletionGuardHaltWindow(t *testing.T) {
+	setDeletionLimits(t, 0, 3, 10*time.Minute)
+	var g deletionGuard
+	for i := 0; i < 3; i++ {
+		if err := g.allow(); err != nil {
+			t.Fatalf("deletion %d: %s", i, err.Error())
+		}
+	}
+	// The deletions older than the window no longer count
+	for i := range g.times {
+		g.times[i] = g.times[i].Add(-10 * time.Minute)
+	}
+	if err := g.allow(); err != nil {
+		t.Errorf("deletion after the window: %s", err.Error())
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog"
+)
+
+const (
+	// credentialTypeLabelName is the label used to pick the kind of gitlab
+	// credential created for the secret, a deploy key unless set to
+	// deployTokenCredentialType
+	credentialTypeLabelName = "fluxcd.io/credential-type"
+	// deployTokenCredentialType makes the controller create a deploy token
+	// for HTTPS git sources instead of a deploy key
+	deployTokenCredentialType = "deploy-token"
+
+	// deployTokenLabelName is the label used to record the id of the deploy
+	// token created for the secret
+	deployTokenLabelName = "fluxcd.io/deployTokenId"
+
+	// deployTokenUsernameKey and deployTokenPasswordKey are the secret data
+	// keys the deploy token is written to, as expected by flux HTTPS sources
+	deployTokenUsernameKey = "username"
+	deployTokenPasswordKey = "password"
+
+	// tokenScopesLabelName is the label used to retrieve the comma separated
+	// scopes of the deploy token created for the secret
+	tokenScopesLabelName = "fluxcd.io/token-scopes"
+)
+
+// defaultTokenScopes are the scopes of the deploy tokens of the secrets
+// without a token scopes annotation
+var defaultTokenScopes = []string{"read_repository"}
+
+// allowedTokenScopes are the deploy token scopes a secret can ask for
+var allowedTokenScopes = map[string]bool{
+	"read_repository":  true,
+	"write_repository": true,
+	"read_registry":    true,
+}
+
+// isDeployToken reports whether the secret asks for a deploy token rather
+// than a deploy key
+func isDeployToken(secret *corev1.Secret) bool {
+	return secret.Annotations[credentialTypeLabelName] == deployTokenCredentialType
+}
+
+// tokenScopes returns the deploy token scopes the secret asks for
+func tokenScopes(secret *corev1.Secret) ([]string, error) {
+	value, ok := secret.Annotations[tokenScopesLabelName]
+	if !ok {
+		return defaultTokenScopes, nil
+	}
+	var scopes []string
+	for _, scope := range strings.Split(value, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !allowedTokenScopes[scope] {
+			return nil, fmt.Errorf("unknown scope %q, expected read_repository, write_repository or read_registry", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("no scope")
+	}
+	return scopes, nil
+}
+
+// syncDeployToken makes sure the secret holds a deploy token of its project
+// with the scopes it asks for
+func (c *Controller) syncDeployToken(ctx context.Context, secret *corev1.Secret) error {
+	if c.state != nil {
+		// The token has to be written into the secret
+		utilruntime.HandleError(fmt.Errorf("secret %s/%s asks for a deploy token, which -state-configmap doesn't support", secret.Namespace, secret.Name))
+		return nil
+	}
+	if _, ok := secret.Annotations[deployTokenLabelName]; ok && len(secret.Data[deployTokenPasswordKey]) > 0 {
+		logV(4).Infof("Secret %s already has deployToken, no need to update", secret.GetName())
+		return nil
+	}
+
+	scopes, err := tokenScopes(secret)
+	if err != nil {
+		// Retrying won't help until the annotation is fixed
+		c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrInvalidTokenScopes, MessageInvalidTokenScopes, secret.Annotations[tokenScopesLabelName], err.Error())
+		return nil
+	}
+
+	project, err := c.getProject(ctx, secret)
+	if err != nil {
+		return err
+	}
+
+	title, _ := desiredKey(secret)
+	token, _, err := c.gitlabClient.DeployTokens.CreateProjectDeployToken(project.ID, &gitlab.CreateProjectDeployTokenOptions{
+		Name:   &title,
+		Scopes: scopes,
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	audit.record(auditCreateDeployToken, project.PathWithNamespace, token.ID, token.Name, secret)
+
+	err = c.updateSecret(ctx, secret, func(secret *corev1.Secret) {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Annotations[deployTokenLabelName] = strconv.Itoa(token.ID)
+		secret.Annotations[projectIdLabelName] = strconv.Itoa(project.ID)
+		secret.Data[deployTokenUsernameKey] = []byte(token.Username)
+		secret.Data[deployTokenPasswordKey] = []byte(token.Token)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.recorder.Event(secret, corev1.EventTypeNormal, SuccessSynced, MessageResourceSynced)
+	return nil
+}
+
+// deleteDeployToken removes the deploy token of a deleted Secret from gitlab
+func (c *Controller) deleteDeployToken(ctx context.Context, secret *corev1.Secret, value string) error {
+	deployToken, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if noDelete {
+		klog.Infof("Not deleting deploy token %d of project %s, deletion is disabled", deployToken, projectPath(secret))
+		return nil
+	}
+	if err := c.deletions.allow(); err != nil {
+		return err
+	}
+
+	ctx, cancel := c.gitlabContext(ctx, secret)
+	defer cancel()
+
+	logV(4).Infof("Deleting deploy token %d", deployToken)
+	deleteToken := func(pid interface{}) (*gitlab.Response, error) {
+		return c.gitlabClient.DeployTokens.DeleteProjectDeployToken(pid, deployToken, gitlab.WithContext(ctx))
+	}
+	projectID, _ := projectRef(secret)
+	resp, err := deleteToken(projectID)
+	resp, err = c.retryOnStaleProject(ctx, secret, resp, err, deleteToken)
+	if isNotFound(resp) {
+		// The token is already revoked
+		logV(4).Infof("Deploy token %d of project %s is already gone", deployToken, projectPath(secret))
+		return nil
+	}
+	if err != nil {
+		// The token is still valid, the revocation is retried
+		return err
+	}
+	audit.record(auditDeleteDeployToken, projectPath(secret), deployToken, "", secret)
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenScopes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"read_repository, read_registry", []string{"read_repository", "read_registry"}},
+		{"write_repository,", []string{"write_repository"}},
+		{"api", nil},
+		{" , ", nil},
+	}
+	for _, test := range tests {
+		secret := fluxSecret()
+		secret.Annotations[tokenScopesLabelName] = test.value
+		scopes, err := tokenScopes(secret)
+		if (err == nil) != (test.want != nil) || !reflect.DeepEqual(scopes, test.want) {
+			t.Errorf("tokenScopes(%q) = %v, %v, want %v", test.value, scopes, err, test.want)
+		}
+	}
+	if scopes, err := tokenScopes(fluxSecret()); err != nil || !reflect.DeepEqual(scopes, defaultTokenScopes) {
+		t.Errorf("tokenScopes without annotation = %v, %v, want the default ones", scopes, err)
+	}
+}
+
+func TestSyncDeployTokenScopes(t *testing.T) {
+	var scopes []string
+	gl := newFakeGitlab()
+	secret := fluxSecret()
+	delete(secret.Annotations, deployKeyLabelName)
+	secret.Annotations[credentialTypeLabelName] = deployTokenCredentialType
+	secret.Annotations[tokenScopesLabelName] = "read_repository,read_registry"
+	s := newTestSync(t, gl, secret)
+	s.gitlabClient = newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/deploy_tokens") {
+			gl.ServeHTTP(w, r)
+			return
+		}
+		var opts struct {
+			Scopes []string `json:"scopes"`
+		}
+		json.NewDecoder(r.Body).Decode(&opts)
+		scopes = opts.Scopes
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 5, "username": "gitlab+deploy-token-5", "token": "secret"})
+	}))
+
+	if err := s.syncDeployToken(context.Background(), secret); err != nil {
+		t.Fatalf("syncDeployToken: %s", err.Error())
+	}
+	if !reflect.DeepEqual(scopes, []string{"read_repository", "read_registry"}) {
+		t.Errorf("deploy token scopes = %v, want the annotation's", scopes)
+	}
+	if updated := s.secret(t, secret); updated.Annotations[deployTokenLabelName] != "5" || string(updated.Data[deployTokenPasswordKey]) != "secret" {
+		t.Errorf("secret = %v, want the deploy token", updated)
+	}
+
+	// Invalid scopes aren't retried
+	secret = fluxSecret()
+	secret.Annotations[tokenScopesLabelName] = "api"
+	if err := s.syncDeployToken(context.Background(), secret); err != nil {
+		t.Errorf("syncDeployToken = %s, want no retry", err.Error())
+	}
+	if !hasEvent(s.events(), ErrInvalidTokenScopes) {
+		t.Errorf("no %s event", ErrInvalidTokenScopes)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/crypto/ssh"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// diagnosis reports the outcome of each step of a diagnose run
+type diagnosis struct {
+	out    io.Writer
+	failed bool
+}
+
+// check reports step as passed with detail, or as failed when err is set. It
+// returns whether the step passed.
+func (d *diagnosis) check(step, detail string, err error) bool {
+	if err != nil {
+		fmt.Fprintf(d.out, "FAIL  %s: %s\n", step, err.Error())
+		d.failed = true
+		return false
+	}
+	fmt.Fprintf(d.out, "PASS  %s: %s\n", step, detail)
+	return true
+}
+
+// diagnose runs every validation the controller does on the secret named
+// namespace/name without changing anything, writing a pass/fail report for
+// each step to out. It returns false if any step failed.
+func diagnose(kubeClient kubernetes.Interface, gitlabClient *gitlab.Client, name string, out io.Writer) bool {
+	d := &diagnosis{out: out}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(name)
+	if err == nil && (namespace == "" || name == "") {
+		err = fmt.Errorf("expected namespace/name")
+	}
+	if !d.check("secret name", namespace+"/"+name, err) {
+		return false
+	}
+
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if !d.check("fetch secret", "found", err) {
+		return false
+	}
+
+	_, found := secret.Labels[fluxSecretLabelFilter]
+	err = nil
+	if !found {
+		err = fmt.Errorf("missing the %s label, the controller doesn't watch this secret", fluxSecretLabelFilter)
+	}
+	d.check("marker label", fluxSecretLabelFilter, err)
+
+	timeout, err := parseRequestTimeout(secret)
+	d.check("request timeout", timeout.String(), err)
+	if err != nil {
+		timeout = requestTimeout
+	}
+
+	url, found := gitURL(secret)
+	err = nil
+	if !found {
+		err = fmt.Errorf("missing the %s annotation", gitUrlLabelName)
+	} else if prefix := fmt.Sprintf("git@%s:", gitSSHHost); !strings.HasPrefix(url, prefix) {
+		err = fmt.Errorf("git url %q doesn't start with %q", url, prefix)
+	}
+	urlOK := d.check("git url", projectPath(secret), err)
+
+	sshKey, err := publicKey(secret)
+	keyOK := err == nil
+	if keyOK {
+		d.check("identity", ssh.FingerprintSHA256(sshKey), nil)
+	} else {
+		d.check("identity", "", err)
+	}
+
+	if !urlOK {
+		return !d.failed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	p, _, err := getProject(ctx, gitlabClient, projectPath(secret))
+	if err == nil && p == nil {
+		err = fmt.Errorf("gitlab returned an empty project")
+	}
+	if !d.check("project lookup", fmt.Sprintf("project id %d", safeProjectID(p)), err) {
+		return false
+	}
+
+	if id, ok := secret.Annotations[projectIdLabelName]; ok {
+		err = nil
+		if id != strconv.Itoa(p.ID) {
+			err = fmt.Errorf("recorded project id %s doesn't match %d, it will be looked up again", id, p.ID)
+		}
+		d.check("recorded project id", id, err)
+	}
+
+	level := accessLevel(p)
+	err = nil
+	if level != 0 && level < gitlab.MaintainerPermissions {
+		err = fmt.Errorf("token has access level %d, managing deploy keys requires maintainer (%d)", level, gitlab.MaintainerPermissions)
+	}
+	d.check("permissions", fmt.Sprintf("access level %d", level), err)
+
+	if value, ok := secret.Annotations[deployKeyLabelName]; ok {
+		deployKey, err := strconv.Atoi(value)
+		if err == nil {
+			var key *gitlab.DeployKey
+			key, _, err = gitlabClient.DeployKeys.GetDeployKey(p.ID, deployKey, gitlab.WithContext(ctx))
+			if err == nil && keyOK && !sameKey(key.Key, sshKey) {
+				err = fmt.Errorf("deploy key %d doesn't match the secret identity", deployKey)
+			}
+		}
+		d.check("deploy key", value, err)
+	}
+
+	return !d.failed
+}
+
+// safeProjectID returns the id of p, or 0 when it's nil
+func safeProjectID(p *gitlab.Project) int {
+	if p == nil {
+		return 0
+	}
+	return p.ID
+}
+
+// accessLevel returns the highest access level the token has on the project,
+// or 0 when gitlab didn't report it
+func accessLevel(p *gitlab.Project) gitlab.AccessLevelValue {
+	var level gitlab.AccessLevelValue
+	if p.Permissions == nil {
+		return level
+	}
+	if p.Permissions.ProjectAccess != nil && p.Permissions.ProjectAccess.AccessLevel > level {
+		level = p.Permissions.ProjectAccess.AccessLevel
+	}
+	if p.Permissions.GroupAccess != nil && p.Permissions.GroupAccess.AccessLevel > level {
+		level = p.Permissions.GroupAccess.AccessLevel
+	}
+	return level
+}
+
+// sameKey reports whether the authorized key line returned by gitlab holds
+// the public key, ignoring any trailing comment
+func sameKey(authorizedKey string, key ssh.PublicKey) bool {
+	fp, err := fingerprint(authorizedKey)
+	return err == nil && fp == ssh.FingerprintSHA256(key)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/xanzy/go-gitlab"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// The sources of the errors failing a sync, the source label of
+// flux_gitlab_controller_sync_errors_total
+const (
+	errorSourceKubernetes = "kubernetes"
+	errorSourceGitlab     = "gitlab"
+	errorSourceController = "controller"
+)
+
+var (
+	// errKubernetes is wrapped by the errors of the Kubernetes API calls
+	errKubernetes = errors.New("kubernetes API error")
+	// errGitlab is wrapped by the errors of the gitlab API requests that
+	// got no response
+	errGitlab = errors.New("gitlab API error")
+)
+
+// sourceError is an error of the Kubernetes or gitlab API, which it unwraps
+// to while also being its source sentinel error
+type sourceError struct {
+	source error
+	err    error
+}
+
+func (e *sourceError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sourceError) Unwrap() error {
+	return e.err
+}
+
+func (e *sourceError) Is(target error) bool {
+	return target == e.source
+}
+
+// kubernetesError marks err, if any, as an error of the Kubernetes API
+func kubernetesError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &sourceError{source: errKubernetes, err: err}
+}
+
+// gitlabError marks err, if any, as an error of the gitlab API
+func gitlabError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &sourceError{source: errGitlab, err: err}
+}
+
+// errorSource returns where the error failing a sync comes from: the
+// Kubernetes API, the gitlab API or the controller itself
+func errorSource(err error) string {
+	var errResp *gitlab.ErrorResponse
+	var status apierrors.APIStatus
+	switch {
+	case errors.Is(err, errKubernetes), errors.As(err, &status):
+		return errorSourceKubernetes
+	case errors.Is(err, errGitlab), errors.As(err, &errResp):
+		return errorSourceGitlab
+	}
+	return errorSourceController
+}
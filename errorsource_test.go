@@ -0,0 +1,82 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/xanzy/go-gitlab"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestErrorSource(t *testing.T) {
+	conflict := apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "flux-git-deploy", errors.New("changed"))
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{kubernetesError(errors.New("connection refused")), errorSourceKubernetes},
+		{fmt.Errorf("failed to update: %w", kubernetesError(conflict)), errorSourceKubernetes},
+		{conflict, errorSourceKubernetes},
+		{gitlabError(errors.New("connection refused")), errorSourceGitlab},
+		{fmt.Errorf("failed to add: %w", &gitlab.ErrorResponse{Response: &http.Response{StatusCode: http.StatusBadRequest}}), errorSourceGitlab},
+		{errDeletionsHalted, errorSourceController},
+		{errors.New("invalid identity"), errorSourceController},
+	}
+	for _, test := range tests {
+		if got := errorSource(test.err); got != test.want {
+			t.Errorf("errorSource(%v) = %s, want %s", test.err, got, test.want)
+		}
+	}
+
+	if kubernetesError(nil) != nil || gitlabError(nil) != nil {
+		t.Errorf("a nil error was marked with its source")
+	}
+}
+
+func TestSourceErrorUnwraps(t *testing.T) {
+	terminating := &apierrors.StatusError{ErrStatus: metav1.Status{
+		Reason:  metav1.StatusReasonForbidden,
+		Details: &metav1.StatusDetails{Causes: []metav1.StatusCause{{Type: corev1.NamespaceTerminatingCause}}},
+	}}
+	err := kubernetesError(terminating)
+	if err.Error() != terminating.Error() {
+		t.Errorf("error = %q, want the message of the wrapped error %q", err.Error(), terminating.Error())
+	}
+	if !isNamespaceTerminating(err) {
+		t.Errorf("a marked namespace terminating error isn't recognized")
+	}
+	if errors.Is(err, errGitlab) || !errors.Is(err, errKubernetes) {
+		t.Errorf("a kubernetes error has the wrong source")
+	}
+}
+
+func TestMetricsTransportGitlabError(t *testing.T) {
+	transport := &metricsTransport{next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})}
+	req, _ := http.NewRequest(http.MethodGet, "https://gitlab.example.com/api/v4/projects/10", nil)
+	if _, err := transport.RoundTrip(req); errorSource(err) != errorSourceGitlab {
+		t.Errorf("errorSource of a failed request = %s, want %s", errorSource(err), errorSourceGitlab)
+	}
+}
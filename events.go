@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+// eventQueueLength is the number of events waiting to be handed to the
+// broadcaster before new ones are dropped
+const eventQueueLength = 1000
+
+// recentEventsSize is the number of recent events remembered to suppress
+// their duplicates
+const recentEventsSize = 1024
+
+// asyncRecorder hands the events to the recorder it wraps from its own
+// goroutine. The broadcaster behind a recorder blocks once its queue is full,
+// which happens while the API server doesn't take the events, so a sync never
+// waits on an event: it's dropped when the queue is full.
+type asyncRecorder struct {
+	events chan func(record.EventRecorder)
+}
+
+// newAsyncRecorder returns a recorder recording the events with recorder
+// without ever blocking
+func newAsyncRecorder(recorder record.EventRecorder) record.EventRecorder {
+	r := &asyncRecorder{events: make(chan func(record.EventRecorder), eventQueueLength)}
+	go func() {
+		for event := range r.events {
+			event(recorder)
+		}
+	}()
+	return r
+}
+
+func (r *asyncRecorder) enqueue(reason string, event func(record.EventRecorder)) {
+	select {
+	case r.events <- event:
+	default:
+		droppedEvents.Inc()
+		klog.Warningf("Dropping %s event, the event queue is full", reason)
+	}
+}
+
+func (r *asyncRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.enqueue(reason, func(recorder record.EventRecorder) {
+		recorder.Event(object, eventtype, reason, message)
+	})
+}
+
+func (r *asyncRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.enqueue(reason, func(recorder record.EventRecorder) {
+		recorder.Eventf(object, eventtype, reason, messageFmt, args...)
+	})
+}
+
+func (r *asyncRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.enqueue(reason, func(recorder record.EventRecorder) {
+		recorder.AnnotatedEventf(object, annotations, eventtype, reason, messageFmt, args...)
+	})
+}
+
+// dedupRecorder suppresses the events identical to one recorded for the same
+// object within -event-dedup-window, so a flapping Secret doesn't use up the
+// event budget of the API server. The recent events are kept in a small LRU
+// cache, the oldest being forgotten first.
+type dedupRecorder struct {
+	record.EventRecorder
+	recent *cache.LRUExpireCache
+}
+
+// newDedupRecorder returns a recorder suppressing the duplicate events of
+// recorder, recorder itself when -event-dedup-window is disabled
+func newDedupRecorder(recorder record.EventRecorder) record.EventRecorder {
+	if eventDedupWindow <= 0 {
+		return recorder
+	}
+	return &dedupRecorder{EventRecorder: recorder, recent: cache.NewLRUExpireCache(recentEventsSize)}
+}
+
+// duplicate reports whether the event was recorded for the object within
+// the window, remembering it otherwise
+func (r *dedupRecorder) duplicate(object runtime.Object, eventtype, reason, message string) bool {
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		return false
+	}
+	key := fmt.Sprintf("%s/%s/%s\x00%s\x00%s\x00%s", accessor.GetNamespace(), accessor.GetName(), accessor.GetUID(), eventtype, reason, message)
+	if _, ok := r.recent.Get(key); ok {
+		logV(4).Infof("Suppressing duplicate %s event of %s/%s", reason, accessor.GetNamespace(), accessor.GetName())
+		suppressedEvents.Inc()
+		return true
+	}
+	r.recent.Add(key, struct{}{}, eventDedupWindow)
+	return false
+}
+
+func (r *dedupRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if !r.duplicate(object, eventtype, reason, message) {
+		r.EventRecorder.Event(object, eventtype, reason, message)
+	}
+}
+
+func (r *dedupRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if !r.duplicate(object, eventtype, reason, fmt.Sprintf(messageFmt, args...)) {
+		r.EventRecorder.Eventf(object, eventtype, reason, messageFmt, args...)
+	}
+}
+
+func (r *dedupRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	if !r.duplicate(object, eventtype, reason, fmt.Sprintf(messageFmt, args...)) {
+		r.EventRecorder.AnnotatedEventf(object, annotations, eventtype, reason, messageFmt, args...)
+	}
+}
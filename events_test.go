@@ -0,0 +1,112 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// blockingRecorder records the events on its channel, blocking until they're
+// received
+type blockingRecorder struct {
+	record.EventRecorder
+	events chan string
+}
+
+func (r *blockingRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.events <- reason
+}
+
+func TestAsyncRecorder(t *testing.T) {
+	blocking := &blockingRecorder{events: make(chan string)}
+	recorder := newAsyncRecorder(blocking)
+
+	dropped := testutil.ToFloat64(droppedEvents)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// One event blocks the recorder, the queue fills up with the others
+		for i := 0; i < eventQueueLength+2; i++ {
+			recorder.Event(fluxSecret(), "Normal", "Reason", "message")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording the events blocked")
+	}
+	if got := testutil.ToFloat64(droppedEvents) - dropped; got < 1 {
+		t.Errorf("dropped %v events, want the ones past the queue", got)
+	}
+
+	// The queued events are still recorded
+	select {
+	case reason := <-blocking.events:
+		if reason != "Reason" {
+			t.Errorf("recorded %s, want Reason", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued events weren't recorded")
+	}
+	go func() {
+		for range blocking.events {
+		}
+	}()
+}
+
+func TestDedupRecorder(t *testing.T) {
+	defer func(window time.Duration) { eventDedupWindow = window }(eventDedupWindow)
+
+	eventDedupWindow = 0
+	fake := record.NewFakeRecorder(10)
+	if recorder := newDedupRecorder(fake); recorder != fake {
+		t.Errorf("newDedupRecorder = %T without -event-dedup-window, want the recorder as is", recorder)
+	}
+
+	eventDedupWindow = time.Minute
+	recorder := newDedupRecorder(fake)
+	suppressed := testutil.ToFloat64(suppressedEvents)
+	secret, other := fluxSecret(), fluxSecret()
+	other.Name = "other"
+	recorder.Eventf(secret, "Warning", "Reason", "deploy key %d", 1)
+	recorder.Eventf(secret, "Warning", "Reason", "deploy key %d", 1)
+	recorder.Event(secret, "Warning", "Reason", "deploy key 1")
+	recorder.AnnotatedEventf(secret, nil, "Warning", "Reason", "deploy key %d", 1)
+	recorder.Eventf(secret, "Warning", "Reason", "deploy key %d", 2)
+	recorder.Eventf(secret, "Warning", "Other", "deploy key %d", 1)
+	recorder.Eventf(other, "Warning", "Reason", "deploy key %d", 1)
+
+	if got := len(fake.Events); got != 4 {
+		t.Errorf("recorded %d events, want the 4 that aren't duplicates", got)
+	}
+	if got := testutil.ToFloat64(suppressedEvents) - suppressed; got != 3 {
+		t.Errorf("suppressed %v events, want 3", got)
+	}
+
+	eventDedupWindow = time.Nanosecond
+	expiring := newDedupRecorder(record.NewFakeRecorder(10)).(*dedupRecorder)
+	expiring.duplicate(secret, "Warning", "Reason", "message")
+	time.Sleep(time.Millisecond)
+	if expiring.duplicate(secret, "Warning", "Reason", "message") {
+		t.Errorf("an event recorded past the window is a duplicate")
+	}
+}
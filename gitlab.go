@@ -0,0 +1,426 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/klog"
+)
+
+// newGitlabClient returns a gitlab API client authenticated through tokens
+func newGitlabClient(tokens *tokenTransport) (*gitlab.Client, error) {
+	client, err := gitlab.NewClient("",
+		gitlab.WithBaseURL(fmt.Sprintf("https://%s/api/v4", gitlabHostname)),
+		gitlab.WithHTTPClient(&http.Client{Transport: tokens}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	client.UserAgent = gitlabUserAgent
+	return client, nil
+}
+
+// gitlabTransport returns the transport the gitlab client requests go through
+// once authenticated
+func gitlabTransport() http.RoundTripper {
+	var transport http.RoundTripper = http.DefaultTransport
+	if logGitlabRequests {
+		transport = &loggingTransport{next: transport}
+	}
+	if len(gitlabHeaders) > 0 {
+		transport = &headerTransport{headers: gitlabHeaders, next: transport}
+	}
+	if gitlabQPS > 0 || len(gitlabHostQPS) > 0 {
+		transport = &rateLimitTransport{next: transport}
+	}
+	return &metricsTransport{next: transport}
+}
+
+// requestCounterKey is the context key of the number of gitlab requests made
+// with the context
+type requestCounterKey struct{}
+
+// withRequestCounter returns a context counting the gitlab requests made
+// with it, and the counter
+func withRequestCounter(ctx context.Context) (context.Context, *int32) {
+	counter := new(int32)
+	return context.WithValue(ctx, requestCounterKey{}, counter), counter
+}
+
+// metricsTransport counts the gitlab requests by operation, and in the
+// request counter of their context if it has one, and their responses by
+// operation and status code
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := operation(req)
+	gitlabRequests.WithLabelValues(op).Inc()
+	if counter, ok := req.Context().Value(requestCounterKey{}).(*int32); ok {
+		atomic.AddInt32(counter, 1)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		gitlabResponses.WithLabelValues(op, "error").Inc()
+		return nil, gitlabError(err)
+	}
+	gitlabResponses.WithLabelValues(op, statusCode(resp.StatusCode)).Inc()
+	return resp, nil
+}
+
+// reportedStatusCodes are the status codes gitlab responses are counted by,
+// the others being counted by class to bound the metric cardinality
+var reportedStatusCodes = map[int]bool{
+	http.StatusOK:                  true,
+	http.StatusCreated:             true,
+	http.StatusNoContent:           true,
+	http.StatusNotModified:         true,
+	http.StatusBadRequest:          true,
+	http.StatusUnauthorized:        true,
+	http.StatusForbidden:           true,
+	http.StatusNotFound:            true,
+	http.StatusMethodNotAllowed:    true,
+	http.StatusConflict:            true,
+	http.StatusUnprocessableEntity: true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// statusCode labels a response status code, e.g. "404", or its class, e.g.
+// "4xx", when it isn't one of the reportedStatusCodes
+func statusCode(code int) string {
+	if reportedStatusCodes[code] {
+		return strconv.Itoa(code)
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// operation names the API endpoint of a request after its method and path,
+// with the ids replaced so it can label metrics, e.g. "GET projects/:id"
+func operation(req *http.Request) string {
+	path := strings.Trim(strings.TrimPrefix(req.URL.EscapedPath(), "/api/v4"), "/")
+	segments := strings.Split(path, "/")
+	// The API paths alternate resources and ids
+	for i := 1; i < len(segments); i += 2 {
+		segments[i] = ":id"
+	}
+	return req.Method + " " + strings.Join(segments, "/")
+}
+
+// redactedHeaders are the request headers holding credentials, which are
+// never logged
+var redactedHeaders = []string{"Private-Token", "Authorization", "Job-Token"}
+
+// loggingTransport logs every gitlab request with its headers, credentials
+// and -gitlab-header values redacted, and the response status and latency
+type loggingTransport struct {
+	next http.RoundTripper
+}
+
+// redactHeaders returns a copy of the headers with the values of the
+// credential and -gitlab-header ones redacted
+func redactHeaders(header http.Header) http.Header {
+	headers := header.Clone()
+	for _, key := range redactedHeaders {
+		if _, ok := headers[http.CanonicalHeaderKey(key)]; ok {
+			headers.Set(key, "REDACTED")
+		}
+	}
+	// The extra headers often carry credentials too, e.g. for a proxy
+	for key := range gitlabHeaders {
+		if _, ok := headers[http.CanonicalHeaderKey(key)]; ok {
+			headers.Set(key, "REDACTED")
+		}
+	}
+	return headers
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	headers := redactHeaders(req.Header)
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	latency := time.Since(start)
+	if err != nil {
+		klog.Infof("GitLab request %s %s %v failed after %s: %s", req.Method, req.URL, headers, latency, err.Error())
+		return resp, err
+	}
+	klog.Infof("GitLab request %s %s %v: %s in %s", req.Method, req.URL, headers, resp.Status, latency)
+	return resp, err
+}
+
+// headerTransport adds extra headers to every request, e.g. for an
+// authenticating proxy in front of gitlab
+type headerTransport struct {
+	headers http.Header
+	next    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request they're given
+	req = req.Clone(req.Context())
+	for key, values := range t.headers {
+		req.Header[key] = values
+	}
+	return t.next.RoundTrip(req)
+}
+
+// headerFlag is a repeatable key=value flag collecting http headers
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var headers []string
+	for key, values := range h {
+		for _, value := range values {
+			headers = append(headers, key+"="+value)
+		}
+	}
+	return strings.Join(headers, ",")
+}
+
+func (h headerFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	http.Header(h).Add(parts[0], parts[1])
+	return nil
+}
+
+// tokenTransport sets the gitlab token on every request, so the token can be
+// reloaded without building a new client
+type tokenTransport struct {
+	mu    sync.RWMutex
+	token string
+	next  http.RoundTripper
+}
+
+func newTokenTransport(token string, next http.RoundTripper) *tokenTransport {
+	return &tokenTransport{token: token, next: next}
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	token := t.token
+	t.mu.RUnlock()
+
+	// RoundTrippers must not modify the request they're given
+	req = req.Clone(req.Context())
+	req.Header.Set("Private-Token", token)
+	return t.next.RoundTrip(req)
+}
+
+// reload reads the token file again, reporting whether the token changed.
+// It's a no-op when the token doesn't come from a file.
+func (t *tokenTransport) reload() (bool, error) {
+	if gitlabTokenFile == "" {
+		return false, nil
+	}
+	token, err := readTokenFile(gitlabTokenFile)
+	if err != nil {
+		return false, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if token == t.token {
+		return false, nil
+	}
+	t.token = token
+	return true, nil
+}
+
+// readTokenFile returns the gitlab token stored in path
+func readTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// gitlabStatus returns the http status of a gitlab API error, or 0 when err
+// isn't one
+func gitlabStatus(err error) int {
+	var errResp *gitlab.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		return errResp.Response.StatusCode
+	}
+	return 0
+}
+
+// projectIDOrPath returns the project reference of a path, which is the numeric
+// project id when it's all digits, e.g. from a git@gitlab.com:12345.git url
+func projectIDOrPath(path string) interface{} {
+	if id, err := strconv.Atoi(path); err == nil && id > 0 && !strings.HasPrefix(path, "+") {
+		return id
+	}
+	return path
+}
+
+// errEmptyProject is returned when gitlab answers a project request without
+// an error but without a project either, as some self-hosted versions do
+var errEmptyProject = errors.New("gitlab returned an empty project")
+
+// getProject gets a project, turning an empty answer into errEmptyProject
+// rather than a project that can't be used
+func getProject(ctx context.Context, client *gitlab.Client, pid interface{}) (*gitlab.Project, *gitlab.Response, error) {
+	p, resp, err := client.Projects.GetProject(pid, nil, gitlab.WithContext(ctx))
+	if err == nil && (p == nil || p.ID == 0) {
+		return nil, resp, fmt.Errorf("project %v: %w", pid, errEmptyProject)
+	}
+	return p, resp, err
+}
+
+// isTitleTaken reports whether gitlab rejected a deploy key because another
+// key of the project has the same title
+func isTitleTaken(err error) bool {
+	var errResp *gitlab.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Response == nil || errResp.Response.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	return strings.Contains(errResp.Message, "title") && strings.Contains(errResp.Message, "taken")
+}
+
+// isKeyTaken reports whether gitlab rejected a deploy key because the same
+// key is already a deploy key of the project
+func isKeyTaken(err error) bool {
+	var errResp *gitlab.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Response == nil || errResp.Response.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	return strings.Contains(errResp.Message, "taken") && (strings.Contains(errResp.Message, "fingerprint") || strings.Contains(errResp.Message, "deploy_key"))
+}
+
+// isProjectKeyLimit reports whether gitlab rejected a deploy key because the
+// project has as many deploy keys as the instance allows
+func isProjectKeyLimit(err error) bool {
+	var errResp *gitlab.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Response == nil {
+		return false
+	}
+	switch errResp.Response.StatusCode {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusUnprocessableEntity:
+		return strings.Contains(strings.ToLower(errResp.Message), "limit")
+	}
+	return false
+}
+
+// isProjectMissing reports whether a project lookup failed because gitlab
+// has no project at the path
+func isProjectMissing(err error) bool {
+	var errResp *gitlab.ErrorResponse
+	return errors.As(err, &errResp) && errResp.Response != nil && errResp.Response.StatusCode == http.StatusNotFound
+}
+
+// retryAfter returns how long gitlab asked to wait before retrying a rate
+// limited request, or fallback when it didn't say. A time that's already
+// past, e.g. because of clock skew, falls back too rather than retrying in a
+// tight loop.
+func retryAfter(err error, fallback time.Duration) time.Duration {
+	var errResp *gitlab.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Response == nil {
+		return fallback
+	}
+	header := errResp.Response.Header
+
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(value); err == nil && time.Until(at) > 0 {
+			return time.Until(at)
+		}
+	}
+	// GitLab also sends the unix time at which the rate limit resets
+	if value := header.Get("RateLimit-Reset"); value != "" {
+		if reset, err := strconv.ParseInt(value, 10, 64); err == nil && time.Until(time.Unix(reset, 0)) > 0 {
+			return time.Until(time.Unix(reset, 0))
+		}
+	}
+
+	return fallback
+}
+
+// deployKeysURL returns the address of the page listing the deploy keys of
+// the project in the gitlab UI. Subgroups are kept as path segments.
+func deployKeysURL(projectPath string) string {
+	segments := strings.Split(strings.Trim(projectPath, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("https://%s/%s/-/settings/repository#js-deploy-keys-settings", gitlabHostname, strings.Join(segments, "/"))
+}
+
+// fingerprint returns the SHA256 fingerprint of an authorized key line like
+// the ones gitlab returns, ignoring any trailing comment
+func fingerprint(authorizedKey string) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(key), nil
+}
+
+// updateDeployKeyOptions represents the available updateDeployKey options.
+//
+// GitLab API docs: https://docs.gitlab.com/ce/api/deploy_keys.html#update-deploy-key
+type updateDeployKeyOptions struct {
+	Title   *string `url:"title,omitempty" json:"title,omitempty"`
+	CanPush *bool   `url:"can_push,omitempty" json:"can_push,omitempty"`
+}
+
+// updateDeployKey updates the title and push permission of a project deploy
+// key. go-gitlab doesn't wrap this endpoint so the request is built by hand.
+func updateDeployKey(client *gitlab.Client, pid interface{}, deployKey int, opt *updateDeployKeyOptions, options ...gitlab.RequestOptionFunc) (*gitlab.DeployKey, *gitlab.Response, error) {
+	u := fmt.Sprintf("projects/%s/deploy_keys/%d", pathEscape(fmt.Sprint(pid)), deployKey)
+
+	req, err := client.NewRequest("PUT", u, opt, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k := new(gitlab.DeployKey)
+	resp, err := client.Do(req, k)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return k, resp, err
+}
+
+// pathEscape escapes a project id or path the same way go-gitlab does
+func pathEscape(s string) string {
+	return strings.Replace(url.PathEscape(s), ".", "%2E", -1)
+}
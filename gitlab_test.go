@@ -0,0 +1,532 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// newTestGitlab returns a gitlab client of a fake gitlab API served by the
+// handler
+func newTestGitlab(t *testing.T, handler http.Handler) *gitlab.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// go-gitlab requests the API root once to configure its rate limiter
+		if r.URL.Path == "/api/v4/" {
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(server.URL+"/api/v4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// unusedGitlab returns a gitlab client failing the test on any request
+func unusedGitlab(t *testing.T) *gitlab.Client {
+	return newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected gitlab request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+}
+
+// rateLimited returns the error gitlab answers a rate limited request with,
+// with the headers
+func rateLimited(header http.Header) error {
+	return &gitlab.ErrorResponse{Response: &http.Response{StatusCode: http.StatusTooManyRequests, Header: header}}
+}
+
+func TestRetryAfter(t *testing.T) {
+	const fallback = time.Minute
+	tests := []struct {
+		name   string
+		err    error
+		want   time.Duration
+		approx bool
+	}{
+		{"not a gitlab error", errors.New("connection reset"), fallback, false},
+		{"no header", rateLimited(http.Header{}), fallback, false},
+		{"seconds", rateLimited(http.Header{"Retry-After": {"30"}}), 30 * time.Second, false},
+		{"zero seconds", rateLimited(http.Header{"Retry-After": {"0"}}), 0, false},
+		{"negative seconds", rateLimited(http.Header{"Retry-After": {"-5"}}), fallback, false},
+		{"invalid", rateLimited(http.Header{"Retry-After": {"soon"}}), fallback, false},
+		{"future date", rateLimited(http.Header{"Retry-After": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}), time.Hour, true},
+		{"past date", rateLimited(http.Header{"Retry-After": {time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}}), fallback, false},
+		{"future reset", rateLimited(http.Header{"Ratelimit-Reset": {strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)}}), time.Hour, true},
+		{"past reset", rateLimited(http.Header{"Ratelimit-Reset": {strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)}}), fallback, false},
+	}
+	for _, test := range tests {
+		got := retryAfter(test.err, fallback)
+		if test.approx && (got <= test.want-5*time.Second || got > test.want) {
+			t.Errorf("%s: retryAfter = %s, want about %s", test.name, got, test.want)
+		}
+		if !test.approx && got != test.want {
+			t.Errorf("%s: retryAfter = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// testKey returns a new RSA private key of the size, PEM encoded as PKCS#1,
+// along with its public key
+func testKey(t *testing.T, bits int) ([]byte, ssh.PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), publicKey
+}
+
+func TestFingerprint(t *testing.T) {
+	_, publicKey := testKey(t, 2048)
+	want := ssh.FingerprintSHA256(publicKey)
+
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+	for _, key := range []string{authorizedKey, authorizedKey + " flux@cluster"} {
+		if got, err := fingerprint(key); err != nil || got != want {
+			t.Errorf("fingerprint(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	if _, err := fingerprint("ssh-rsa not-a-key"); err == nil {
+		t.Errorf("fingerprint of an invalid key didn't fail")
+	}
+}
+
+// roundTripperFunc is a http.RoundTripper calling the function
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestHeaderFlag(t *testing.T) {
+	headers := http.Header{}
+	flag := headerFlag(headers)
+	for _, value := range []string{"X-Proxy-Token=abc", "X-Query=a=b", "X-Proxy-Token=def"} {
+		if err := flag.Set(value); err != nil {
+			t.Errorf("Set(%q): %s", value, err.Error())
+		}
+	}
+	for _, value := range []string{"X-Proxy-Token", "=abc", ""} {
+		if err := flag.Set(value); err == nil {
+			t.Errorf("Set(%q) didn't fail", value)
+		}
+	}
+	if got := headers["X-Proxy-Token"]; len(got) != 2 || got[0] != "abc" || got[1] != "def" {
+		t.Errorf("X-Proxy-Token = %v, want [abc def]", got)
+	}
+	if got := headers.Get("X-Query"); got != "a=b" {
+		t.Errorf("X-Query = %q, want %q", got, "a=b")
+	}
+}
+
+func TestHeaderTransport(t *testing.T) {
+	var sent http.Header
+	transport := &headerTransport{
+		headers: http.Header{"X-Proxy-Token": {"abc"}},
+		next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent = req.Header
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://gitlab.example.com/api/v4/projects", nil)
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := sent.Get("X-Proxy-Token"); got != "abc" {
+		t.Errorf("sent X-Proxy-Token = %q, want %q", got, "abc")
+	}
+	if got := req.Header.Get("X-Proxy-Token"); got != "" {
+		t.Errorf("the original request was modified, X-Proxy-Token = %q", got)
+	}
+}
+
+// fakeGitlab is a fake gitlab API serving a single project and its deploy
+// keys, recording the requests it gets
+type fakeGitlab struct {
+	mu       sync.Mutex
+	project  *gitlab.Project
+	keys     map[int]*gitlab.DeployKey
+	nextID   int
+	requests []string
+	// protected are the protected branches of the project
+	protected map[string]*gitlab.ProtectedBranch
+	// addError, when set, is the status and message gitlab rejects the
+	// added deploy keys with
+	addError   int
+	addMessage string
+}
+
+// newFakeGitlab returns a fake gitlab API with the project group/app
+func newFakeGitlab() *fakeGitlab {
+	return &fakeGitlab{
+		project: &gitlab.Project{ID: 10, PathWithNamespace: "group/app", DefaultBranch: "main"},
+		keys:    map[int]*gitlab.DeployKey{},
+		nextID:  1,
+	}
+}
+
+// client returns a gitlab client of the fake API
+func (f *fakeGitlab) client(t *testing.T) *gitlab.Client {
+	return newTestGitlab(t, f)
+}
+
+// addKey adds a deploy key to the project as if it was added by hand
+func (f *fakeGitlab) addKey(key *gitlab.DeployKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key.ID = f.nextID
+	f.nextID++
+	f.keys[key.ID] = key
+}
+
+// requested returns the requests made so far as "METHOD path"
+func (f *fakeGitlab) requested() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// notFound answers like gitlab does for a missing resource
+func notFound(w http.ResponseWriter, what string) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"message": "404 " + what + " Not Found"})
+}
+
+func (f *fakeGitlab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v4/projects/"), "/")
+	ref, _ := url.PathUnescape(parts[0])
+	if f.project == nil || (ref != strconv.Itoa(f.project.ID) && ref != f.project.PathWithNamespace) {
+		notFound(w, "Project")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(f.project)
+	case len(parts) == 2 && parts[1] == "deploy_keys" && r.Method == http.MethodGet:
+		keys := []*gitlab.DeployKey{}
+		for id := 1; id < f.nextID; id++ {
+			if key, ok := f.keys[id]; ok {
+				keys = append(keys, key)
+			}
+		}
+		json.NewEncoder(w).Encode(keys)
+	case len(parts) == 2 && parts[1] == "deploy_keys" && r.Method == http.MethodPost:
+		if f.addError != 0 {
+			w.WriteHeader(f.addError)
+			json.NewEncoder(w).Encode(map[string]string{"message": f.addMessage})
+			return
+		}
+		key := &gitlab.DeployKey{}
+		json.NewDecoder(r.Body).Decode(key)
+		key.ID = f.nextID
+		f.nextID++
+		f.keys[key.ID] = key
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(key)
+	case len(parts) == 3 && parts[1] == "deploy_keys":
+		id, _ := strconv.Atoi(parts[2])
+		key, ok := f.keys[id]
+		if !ok {
+			notFound(w, "Deploy Key")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(key)
+		case http.MethodPut:
+			json.NewDecoder(r.Body).Decode(key)
+			json.NewEncoder(w).Encode(key)
+		case http.MethodDelete:
+			delete(f.keys, id)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case len(parts) == 3 && parts[1] == "protected_branches" && r.Method == http.MethodGet:
+		branch, ok := f.protected[parts[2]]
+		if !ok {
+			notFound(w, "Protected Branch")
+			return
+		}
+		json.NewEncoder(w).Encode(branch)
+	default:
+		notFound(w, "Resource")
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	defer func(headers http.Header) { gitlabHeaders = headers }(gitlabHeaders)
+	gitlabHeaders = http.Header{"X-Proxy-Token": {"proxy-secret"}}
+
+	header := http.Header{
+		"Private-Token": {"token"},
+		"Authorization": {"Bearer token"},
+		"X-Proxy-Token": {"proxy-secret"},
+		"User-Agent":    {"flux-gitlab-controller"},
+	}
+	redacted := redactHeaders(header)
+	for _, key := range []string{"Private-Token", "Authorization", "X-Proxy-Token"} {
+		if got := redacted.Get(key); got != "REDACTED" {
+			t.Errorf("%s = %q, want it redacted", key, got)
+		}
+	}
+	if got := redacted.Get("User-Agent"); got != "flux-gitlab-controller" {
+		t.Errorf("User-Agent = %q, want it as is", got)
+	}
+	if got := header.Get("Private-Token"); got != "token" {
+		t.Errorf("the request headers were modified, Private-Token = %q", got)
+	}
+	if _, ok := redacted["Job-Token"]; ok {
+		t.Errorf("a missing header was added")
+	}
+}
+
+func TestGetProjectEmpty(t *testing.T) {
+	client := newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	if _, _, err := getProject(context.Background(), client, "group/app"); !errors.Is(err, errEmptyProject) {
+		t.Errorf("getProject of an empty project = %v, want errEmptyProject", err)
+	}
+
+	f := newFakeGitlab()
+	if p, _, err := getProject(context.Background(), f.client(t), "group/app"); err != nil || p.ID != f.project.ID {
+		t.Errorf("getProject = %+v, %v, want project %d", p, err, f.project.ID)
+	}
+}
+
+func TestNewGitlabClient(t *testing.T) {
+	defer func(host, agent string) { gitlabHostname, gitlabUserAgent = host, agent }(gitlabHostname, gitlabUserAgent)
+	gitlabUserAgent = "agent/1.0"
+
+	var mu sync.Mutex
+	headers := map[string]http.Header{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		headers[r.URL.Path] = r.Header
+		json.NewEncoder(w).Encode(map[string]int{"id": 10})
+	}))
+	defer server.Close()
+	gitlabHostname = strings.TrimPrefix(server.URL, "https://")
+
+	client, err := newGitlabClient(newTokenTransport("secret", server.Client().Transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.Projects.GetProject(10, nil); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	header := headers["/api/v4/projects/10"]
+	if header.Get("User-Agent") != "agent/1.0" || header.Get("Private-Token") != "secret" {
+		t.Errorf("request headers = %v, want the -gitlab-user-agent and the token", header)
+	}
+}
+
+func TestMetricsTransport(t *testing.T) {
+	for code, want := range map[int]string{http.StatusNotFound: "404", http.StatusTeapot: "4xx", http.StatusOK: "200", 599: "5xx"} {
+		if got := statusCode(code); got != want {
+			t.Errorf("statusCode(%d) = %q, want %q", code, got, want)
+		}
+	}
+
+	status := http.StatusNotFound
+	transport := &metricsTransport{next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if status == 0 {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: status}, nil
+	})}
+	op := "GET projects/:id/deploy_keys/:id"
+	notFound := testutil.ToFloat64(gitlabResponses.WithLabelValues(op, "404"))
+	failed := testutil.ToFloat64(gitlabResponses.WithLabelValues(op, "error"))
+	for _, status = range []int{http.StatusNotFound, 0} {
+		req, _ := http.NewRequest(http.MethodGet, "https://gitlab.example.com/api/v4/projects/group%2Fapp/deploy_keys/1", nil)
+		transport.RoundTrip(req)
+	}
+	if got := testutil.ToFloat64(gitlabResponses.WithLabelValues(op, "404")) - notFound; got != 1 {
+		t.Errorf("counted %v 404 responses, want 1", got)
+	}
+	if got := testutil.ToFloat64(gitlabResponses.WithLabelValues(op, "error")) - failed; got != 1 {
+		t.Errorf("counted %v failed requests, want 1", got)
+	}
+}
+
+func TestProjectIDOrPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"12345", 12345},
+		{"group/app", "group/app"},
+		{"group/12345", "group/12345"},
+		{"0", "0"},
+		{"-1", "-1"},
+		{"+1", "+1"},
+	}
+	for _, test := range tests {
+		if got := projectIDOrPath(test.path); got != test.want {
+			t.Errorf("projectIDOrPath(%q) = %#v, want %#v", test.path, got, test.want)
+		}
+	}
+
+	// An all-digit git url finds the project by id
+	f := newFakeGitlab()
+	secret := fluxSecret()
+	secret.Annotations[gitUrlLabelName] = "git@" + gitSSHHost + ":10.git"
+	c := &Controller{gitlabClient: f.client(t), recorder: record.NewFakeRecorder(10), missingProjects: newMissingProjects()}
+	if p, err := c.lookupProject(context.Background(), secret); err != nil || p.ID != 10 {
+		t.Errorf("lookupProject = %+v, %v, want project 10", p, err)
+	}
+}
+
+func TestTokenTransport(t *testing.T) {
+	var got string
+	tokens := newTokenTransport("token", roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.Header.Get("Private-Token")
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	req, _ := http.NewRequest(http.MethodGet, "https://gitlab.example.com/api/v4/projects/10", nil)
+	tokens.RoundTrip(req)
+	if got != "token" {
+		t.Errorf("Private-Token = %q, want %q", got, "token")
+	}
+	if req.Header.Get("Private-Token") != "" {
+		t.Errorf("the request given to the transport was modified")
+	}
+}
+
+func TestTokenReload(t *testing.T) {
+	defer func(file string) { gitlabTokenFile = file }(gitlabTokenFile)
+
+	gitlabTokenFile = ""
+	tokens := newTokenTransport("token", nil)
+	if changed, err := tokens.reload(); changed || err != nil {
+		t.Errorf("reload without a token file = %v, %v, want false, nil", changed, err)
+	}
+
+	gitlabTokenFile = filepath.Join(t.TempDir(), "token")
+	if _, err := tokens.reload(); err == nil {
+		t.Errorf("reload of a missing token file didn't fail")
+	}
+	ioutil.WriteFile(gitlabTokenFile, []byte("token\n"), 0600)
+	if changed, err := tokens.reload(); changed || err != nil {
+		t.Errorf("reload of the same token = %v, %v, want false, nil", changed, err)
+	}
+	ioutil.WriteFile(gitlabTokenFile, []byte(" rotated\n"), 0600)
+	if changed, err := tokens.reload(); !changed || err != nil || tokens.token != "rotated" {
+		t.Errorf("reload of a rotated token = %v, %v, token %q, want the rotated token", changed, err, tokens.token)
+	}
+}
+
+func TestBackoffAuthError(t *testing.T) {
+	defer func(file string) { gitlabTokenFile = file }(gitlabTokenFile)
+	gitlabTokenFile = filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(gitlabTokenFile, []byte("token"), 0600)
+
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{recorder: recorder, gitlabToken: newTokenTransport("token", nil)}
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		err := &gitlab.ErrorResponse{Response: &http.Response{StatusCode: status}}
+		if after, ok := c.backoff(fluxSecret(), err); !ok || after != authErrorBackoff {
+			t.Errorf("backoff of a %d = %s, %v, want %s", status, after, ok, authErrorBackoff)
+		}
+		if event := <-recorder.Events; !strings.Contains(event, ErrGitLabAuth) {
+			t.Errorf("event = %q, want a %s event", event, ErrGitLabAuth)
+		}
+	}
+
+	// A rotated token is retried with right away
+	ioutil.WriteFile(gitlabTokenFile, []byte("rotated"), 0600)
+	err := &gitlab.ErrorResponse{Response: &http.Response{StatusCode: http.StatusUnauthorized}}
+	if after, ok := c.backoff(fluxSecret(), err); ok {
+		t.Errorf("backoff with a rotated token = %s, want the regular requeue", after)
+	}
+}
+
+func TestBackoffHold(t *testing.T) {
+	gl := newFakeGitlab()
+	gl.addError = http.StatusForbidden
+	secret := identitySecret(t)
+	secret.ResourceVersion = "1"
+	s := newTestSync(t, gl, secret).withLister(secret)
+	s.workqueue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	s.deletionqueue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	s.workqueue.Add(secret)
+	s.processNextWorkItem(s.workqueue)
+	if after, held := s.holds.remaining(secret); !held || after > authErrorBackoff || after < authErrorBackoff-time.Minute {
+		t.Fatalf("hold = %s, %v, want the auth error backoff", after, held)
+	}
+
+	// A resync during the backoff
+	resynced := secret.DeepCopy()
+	if materialChange(secret, resynced) {
+		s.handleObject(resynced)
+	}
+	if s.workqueue.Len() != 0 {
+		t.Fatalf("the resync enqueued the secret backing off")
+	}
+
+	// A secret queued before the backoff started isn't synced either
+	requests := len(gl.requested())
+	s.workqueue.Add(secret.DeepCopy())
+	s.processNextWorkItem(s.workqueue)
+	if got := len(gl.requested()); got != requests {
+		t.Errorf("the secret backing off was synced, requests %v", gl.requested()[requests:])
+	}
+
+	s.holds.until["flux/flux-git-deploy"] = time.Now().Add(-time.Second)
+	s.handleObject(resynced)
+	if s.workqueue.Len() != 1 {
+		t.Errorf("the secret wasn't enqueued once its backoff was over")
+	}
+}
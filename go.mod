@@ -5,12 +5,16 @@ module k8s.io/flux-gitlab-controller
 go 1.13
 
 require (
+	github.com/prometheus/client_golang v1.7.1
 	github.com/xanzy/go-gitlab v0.31.0
 	golang.org/x/crypto v0.0.0-20200220183623-bac4c82f6975
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	k8s.io/api v0.18.2
 	k8s.io/apimachinery v0.18.2
 	k8s.io/client-go v0.18.2
 	k8s.io/klog v1.0.0
+	sigs.k8s.io/controller-runtime v0.6.0
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace (
@@ -0,0 +1,151 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+// deletionGraced is returned while the deploy key of a deleted Secret waits
+// for -delete-grace-period, the deletion should be retried after the delay
+type deletionGraced struct {
+	after time.Duration
+}
+
+func (e *deletionGraced) Error() string {
+	return fmt.Sprintf("deletion grace period of %s not over", deleteGracePeriod)
+}
+
+// pendingDeletion is a deleted Secret whose deploy key is removed once due
+type pendingDeletion struct {
+	secret *corev1.Secret
+	due    time.Time
+}
+
+// pendingDeletions holds, by namespace/name, the deleted Secrets whose deploy
+// key waits for -delete-grace-period. They're only kept in memory, a restart
+// within the grace period leaves their keys in gitlab.
+type pendingDeletions struct {
+	mu      sync.Mutex
+	secrets map[string]pendingDeletion
+}
+
+// remaining returns how long the deploy key of the deleted Secret still
+// waits, starting its grace period the first time. It reports false once the
+// grace period is over.
+func (p *pendingDeletions) remaining(secret *corev1.Secret) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := secret.Namespace + "/" + secret.Name
+	pending, ok := p.secrets[key]
+	if !ok || pending.secret.UID != secret.UID {
+		if p.secrets == nil {
+			p.secrets = map[string]pendingDeletion{}
+		}
+		klog.Infof("Secret %s was deleted, removing its deploy key in %s unless it's recreated", key, deleteGracePeriod)
+		p.secrets[key] = pendingDeletion{secret: secret, due: time.Now().Add(deleteGracePeriod)}
+		return deleteGracePeriod, true
+	}
+	if after := time.Until(pending.due); after > 0 {
+		return after, true
+	}
+	return 0, false
+}
+
+// get returns the deleted Secret named namespace/name whose deploy key is
+// pending, if any
+func (p *pendingDeletions) get(key string) (*corev1.Secret, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.secrets[key]
+	return pending.secret, ok
+}
+
+// done drops the pending deletion of the Secret
+func (p *pendingDeletions) done(secret *corev1.Secret) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := secret.Namespace + "/" + secret.Name
+	if pending, ok := p.secrets[key]; ok && pending.secret.UID == secret.UID {
+		delete(p.secrets, key)
+	}
+}
+
+// renamed returns the deleted Secret whose pending deploy key of the project
+// has the fingerprint, for when a Secret is recreated under another name
+func (p *pendingDeletions) renamed(project, fingerprint string) (*corev1.Secret, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pending := range p.secrets {
+		if projectPath(pending.secret) == project && pending.secret.Annotations[deployKeyFingerprintLabelName] == fingerprint {
+			return pending.secret, true
+		}
+	}
+	return nil, false
+}
+
+// adoptedByRename reports whether another Secret, such as the deleted one
+// recreated under another name, records the deploy key of the deleted Secret
+func (c *Controller) adoptedByRename(secret *corev1.Secret) bool {
+	deployKey, ok := secret.Annotations[deployKeyLabelName]
+	if !ok {
+		return false
+	}
+	secrets, err := c.secretsLister.List(labels.Everything())
+	if err != nil {
+		return false
+	}
+	for _, other := range secrets {
+		if other.UID == secret.UID || other.DeletionTimestamp != nil {
+			continue
+		}
+		other = c.state.overlay(other)
+		if other.Annotations[deployKeyLabelName] == deployKey && other.Annotations[projectIdLabelName] == secret.Annotations[projectIdLabelName] {
+			return true
+		}
+	}
+	return false
+}
+
+// recreated reports whether the deleted Secret was recreated with the same
+// identity, in which case its deploy key is kept for the new Secret
+func (c *Controller) recreated(ctx context.Context, secret *corev1.Secret) bool {
+	current, err := c.kubeclientset.CoreV1().Secrets(secret.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil || current.UID == secret.UID || current.DeletionTimestamp != nil {
+		return false
+	}
+	keyFingerprint, ok := secret.Annotations[deployKeyFingerprintLabelName]
+	if !ok {
+		sshKey, err := publicKey(secret)
+		if err != nil {
+			return false
+		}
+		keyFingerprint = ssh.FingerprintSHA256(sshKey)
+	}
+	sshKey, err := publicKey(current)
+	return err == nil && ssh.FingerprintSHA256(sshKey) == keyFingerprint
+}
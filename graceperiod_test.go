@@ -0,0 +1,195 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	goerrors "errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPendingDeletions(t *testing.T) {
+	defer func(period time.Duration) { deleteGracePeriod = period }(deleteGracePeriod)
+	deleteGracePeriod = time.Hour
+
+	var p pendingDeletions
+	secret := fluxSecret()
+	secret.Annotations[deployKeyFingerprintLabelName] = "SHA256:key"
+	if after, ok := p.remaining(secret); !ok || after != time.Hour {
+		t.Errorf("remaining = %v, %v, want the grace period starting", after, ok)
+	}
+	if after, ok := p.remaining(secret); !ok || after > time.Hour || after < 59*time.Minute {
+		t.Errorf("remaining = %v, %v, want the rest of the grace period", after, ok)
+	}
+	if got, ok := p.get("flux/flux-git-deploy"); !ok || got != secret {
+		t.Errorf("get = %v, %v, want the pending secret", got, ok)
+	}
+	if got, ok := p.renamed("group/app", "SHA256:key"); !ok || got != secret {
+		t.Errorf("renamed = %v, %v, want the pending secret of the key", got, ok)
+	}
+	if _, ok := p.renamed("group/app", "SHA256:other"); ok {
+		t.Errorf("renamed found the pending secret of another key")
+	}
+
+	// Another secret deleted under the same name starts over
+	recreated := secret.DeepCopy()
+	recreated.UID = "recreated"
+	p.done(recreated)
+	if _, ok := p.get("flux/flux-git-deploy"); !ok {
+		t.Errorf("the pending deletion was dropped by another secret")
+	}
+	p.secrets["flux/flux-git-deploy"] = pendingDeletion{secret: secret, due: time.Now().Add(-time.Second)}
+	if _, ok := p.remaining(recreated); !ok {
+		t.Errorf("the grace period of the recreated secret didn't start over")
+	}
+
+	p.secrets["flux/flux-git-deploy"] = pendingDeletion{secret: recreated, due: time.Now().Add(-time.Second)}
+	if _, ok := p.remaining(recreated); ok {
+		t.Errorf("the grace period isn't over once due")
+	}
+	p.done(recreated)
+	if _, ok := p.get("flux/flux-git-deploy"); ok {
+		t.Errorf("the pending deletion wasn't dropped once done")
+	}
+}
+
+// expireGracePeriod ends the grace period of the pending deletion of the
+// secret
+func expireGracePeriod(c *Controller, secret *corev1.Secret) {
+	key := secret.Namespace + "/" + secret.Name
+	pending := c.pending.secrets[key]
+	pending.due = time.Now().Add(-time.Second)
+	c.pending.secrets[key] = pending
+}
+
+func TestDeleteDeployKeyGracePeriod(t *testing.T) {
+	defer func(period time.Duration) { deleteGracePeriod = period }(deleteGracePeriod)
+	deleteGracePeriod = time.Hour
+
+	secret := identitySecret(t)
+	secret.Annotations[deployKeyLabelName] = "1"
+	gl := newFakeGitlab()
+	gl.addKey(&gitlab.DeployKey{Title: deployKeyTitle})
+	s := newTestSync(t, gl).withLister()
+
+	var graced *deletionGraced
+	if err := s.deleteDeployKey(context.Background(), secret); !goerrors.As(err, &graced) || graced.after != time.Hour {
+		t.Fatalf("deleteDeployKey = %v, want it graced for an hour", err)
+	}
+	if len(gl.requested()) != 0 {
+		t.Errorf("requests = %v within the grace period", gl.requested())
+	}
+
+	expireGracePeriod(s.Controller, secret)
+	if err := s.deleteDeployKey(context.Background(), secret); err != nil {
+		t.Fatalf("deleteDeployKey: %s", err.Error())
+	}
+	if _, ok := gl.keys[1]; ok {
+		t.Errorf("the deploy key wasn't deleted once the grace period was over")
+	}
+	if _, ok := s.pending.get("flux/flux-git-deploy"); ok {
+		t.Errorf("the pending deletion wasn't dropped")
+	}
+}
+
+func TestDeleteDeployKeyRecreated(t *testing.T) {
+	defer func(period time.Duration) { deleteGracePeriod = period }(deleteGracePeriod)
+	deleteGracePeriod = time.Hour
+
+	deleted := identitySecret(t)
+	deleted.Annotations[deployKeyLabelName] = "1"
+	sshKey, err := publicKey(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted.Annotations[deployKeyFingerprintLabelName] = ssh.FingerprintSHA256(sshKey)
+	recreated := deleted.DeepCopy()
+	recreated.UID = types.UID("recreated")
+	recreated.Annotations = map[string]string{gitUrlLabelName: deleted.Annotations[gitUrlLabelName]}
+	gl := newFakeGitlab()
+	gl.addKey(&gitlab.DeployKey{Title: deployKeyTitle})
+	s := newTestSync(t, gl, recreated).withLister(recreated)
+
+	s.deleteDeployKey(context.Background(), deleted)
+	expireGracePeriod(s.Controller, deleted)
+	if err := s.deleteDeployKey(context.Background(), deleted); err != nil {
+		t.Fatalf("deleteDeployKey: %s", err.Error())
+	}
+	if _, ok := gl.keys[1]; !ok {
+		t.Errorf("the deploy key of the secret recreated with the same identity was deleted")
+	}
+
+	// A secret recreated under another name records the key
+	gl.requests = nil
+	renamed := recreated.DeepCopy()
+	renamed.Name = "renamed"
+	renamed.Annotations[deployKeyLabelName] = "1"
+	s = newTestSync(t, gl).withLister(renamed)
+	deleted.Annotations[projectIdLabelName] = "10"
+	renamed.Annotations[projectIdLabelName] = "10"
+	s.deleteDeployKey(context.Background(), deleted)
+	expireGracePeriod(s.Controller, deleted)
+	if err := s.deleteDeployKey(context.Background(), deleted); err != nil {
+		t.Fatalf("deleteDeployKey: %s", err.Error())
+	}
+	if _, ok := gl.keys[1]; !ok || len(gl.requested()) != 0 {
+		t.Errorf("the deploy key of the renamed secret was deleted, requests %v", gl.requested())
+	}
+}
+
+func TestSyncAdoptsRenamedKey(t *testing.T) {
+	defer func(period time.Duration) { deleteGracePeriod = period }(deleteGracePeriod)
+	deleteGracePeriod = time.Hour
+
+	deleted := identitySecret(t)
+	deleted.Annotations[deployKeyLabelName] = "1"
+	sshKey, err := publicKey(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted.Annotations[deployKeyFingerprintLabelName] = ssh.FingerprintSHA256(sshKey)
+	renamed := deleted.DeepCopy()
+	renamed.Name, renamed.UID = "renamed", types.UID("renamed")
+	renamed.Annotations = map[string]string{gitUrlLabelName: deleted.Annotations[gitUrlLabelName]}
+
+	gl := newFakeGitlab()
+	gl.addKey(&gitlab.DeployKey{Title: "old title", Key: string(ssh.MarshalAuthorizedKey(sshKey)), CanPush: gitlab.Bool(true)})
+	gl.addError, gl.addMessage = http.StatusBadRequest, "fingerprint has already been taken"
+	s := newTestSync(t, gl, renamed).withLister(renamed)
+	s.deleteDeployKey(context.Background(), deleted)
+
+	if err := s.syncSecret(context.Background(), renamed); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	title, _ := desiredKey(renamed)
+	if key := gl.keys[1]; key.Title != title {
+		t.Errorf("deploy key title = %q, want it retitled %q", key.Title, title)
+	}
+	if got := s.secret(t, renamed).Annotations[deployKeyLabelName]; got != "1" {
+		t.Errorf("deploy key annotation = %q, want the adopted key 1", got)
+	}
+	if events := s.events(); !hasEvent(events, DeployKeyRenamed) || hasEvent(events, DeployKeyAdopted) {
+		t.Errorf("events = %v, want a %s event only", events, DeployKeyRenamed)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog"
+)
+
+const (
+	// deployKeyIdsLabelName is the label used to record, as a JSON object,
+	// the deploy key ids of a secret with several identities by identity
+	// suffix or environment
+	deployKeyIdsLabelName = "fluxcd.io/deployKeyIds"
+
+	// environmentsLabelName is the label used to retrieve, as a JSON object,
+	// the projects to add the secret's identity to by environment, e.g.
+	// {"dev": "group/app-dev", "prod": "group/app"}
+	environmentsLabelName = "fluxcd.io/environments"
+)
+
+// identityPair is one of the identities of a secret along with the git url
+// of the repo it's for
+type identityPair struct {
+	suffix string
+	data   []byte
+	url    string
+}
+
+// project returns the gitlab project path of the pair's git url
+func (p identityPair) project() string {
+	return pathFromURL(p.url)
+}
+
+// identityPairs returns the identities of the secret under the
+// -multi-identity-prefix data keys, e.g. identity-a, that have a matching git
+// url annotation, e.g. fluxcd.io/git-url-a, or its identity paired with each
+// of its environments, sorted by suffix
+func identityPairs(secret *corev1.Secret) []identityPair {
+	if _, ok := secret.Annotations[environmentsLabelName]; ok {
+		return environmentPairs(secret)
+	}
+	if len(multiIdentityPrefix) == 0 {
+		return nil
+	}
+
+	var pairs []identityPair
+	for key, data := range secret.Data {
+		suffix := strings.TrimPrefix(key, multiIdentityPrefix)
+		if suffix == key || suffix == "" {
+			continue
+		}
+		url, ok := secret.Annotations[gitUrlLabelName+"-"+suffix]
+		if !ok {
+			continue
+		}
+		pairs = append(pairs, identityPair{suffix: suffix, data: data, url: url})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].suffix < pairs[j].suffix })
+	return pairs
+}
+
+// pairIdentities returns the -multi-identity-prefix data keys of the secret
+// identityPairs reads, whether or not they have a git url annotation
+func pairIdentities(secret *corev1.Secret) map[string][]byte {
+	if len(multiIdentityPrefix) == 0 {
+		return nil
+	}
+	identities := map[string][]byte{}
+	for key, data := range secret.Data {
+		if strings.HasPrefix(key, multiIdentityPrefix) {
+			identities[key] = data
+		}
+	}
+	return identities
+}
+
+// environmentPairs pairs the identity of the secret with the project of each
+// environment of its environments annotation, the environment being the
+// suffix
+func environmentPairs(secret *corev1.Secret) []identityPair {
+	var environments map[string]string
+	if err := json.Unmarshal([]byte(secret.Annotations[environmentsLabelName]), &environments); err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid %s annotation of secret %s/%s: %s", environmentsLabelName, secret.Namespace, secret.Name, err.Error()))
+		return nil
+	}
+	data, ok := identity(secret)
+	if !ok {
+		return nil
+	}
+
+	var pairs []identityPair
+	for environment, project := range environments {
+		pairs = append(pairs, identityPair{suffix: environment, data: data, url: project})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].suffix < pairs[j].suffix })
+	return pairs
+}
+
+// pairDeployKeys returns the deploy key ids recorded for the identity pairs
+// of the secret, by suffix
+func pairDeployKeys(secret *corev1.Secret) (map[string]int, error) {
+	keys := map[string]int{}
+	value, ok := secret.Annotations[deployKeyIdsLabelName]
+	if !ok {
+		return keys, nil
+	}
+	if err := json.Unmarshal([]byte(value), &keys); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %s", deployKeyIdsLabelName, err.Error())
+	}
+	return keys, nil
+}
+
+// syncIdentityPairs makes sure every identity pair of the secret has its
+// deploy key in the project of its git url
+func (c *Controller) syncIdentityPairs(ctx context.Context, secret *corev1.Secret, pairs []identityPair) error {
+	keys, err := pairDeployKeys(secret)
+	if err != nil {
+		return err
+	}
+
+	created := false
+	title, canPush := desiredKey(secret)
+	for _, pair := range pairs {
+		if _, ok := keys[pair.suffix]; ok {
+			continue
+		}
+		if !allowedProject(pair.project()) {
+			c.recorder.Eventf(secret, corev1.EventTypeWarning, ProjectNotAllowed, MessageProjectNotAllowed, pair.project())
+			continue
+		}
+
+		if !c.belowKeyLimit(secret) {
+			break
+		}
+
+		key, err := c.addPairDeployKey(ctx, secret, pair, title, canPush)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			continue
+		}
+		logV(4).Infof("Adding deploy key %d for identity %s", key.ID, pair.suffix)
+		keys[pair.suffix] = key.ID
+		created = true
+	}
+	if !created {
+		logV(4).Infof("Secret %s already has all its deployKeys, no need to update", secret.GetName())
+		return nil
+	}
+
+	value, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	if err := c.updateSecretStatus(ctx, secret, map[string]string{deployKeyIdsLabelName: string(value)}); err != nil {
+		return err
+	}
+	c.recorder.Event(secret, corev1.EventTypeNormal, SuccessSynced, MessageResourceSynced)
+	return nil
+}
+
+// addPairDeployKey adds the deploy key of the identity pair to the project of
+// its git url, or adopts it when the project already has it. It returns nil
+// when the pair is skipped.
+func (c *Controller) addPairDeployKey(ctx context.Context, secret *corev1.Secret, pair identityPair, title string, canPush bool) (*gitlab.DeployKey, error) {
+	sshKey, err := parsePublicKey(pair.data)
+	if err != nil {
+		return nil, fmt.Errorf("identity %s: %s", pair.suffix, err.Error())
+	}
+	if !c.checkKeyPolicy(secret, sshKey) {
+		return nil, nil
+	}
+
+	unlock := c.projects.lock(pair.project())
+	defer unlock()
+
+	project, _, err := getProject(ctx, c.gitlabClient, projectIDOrPath(pair.project()))
+	if err != nil {
+		return nil, err
+	}
+	readOnly := projectReadOnly(project)
+	if !c.checkPushRequired(secret, readOnly) {
+		return nil, nil
+	}
+
+	opts := &gitlab.AddDeployKeyOptions{
+		Title:   gitlab.String(truncateTitle(title + " " + pair.suffix)),
+		Key:     gitlab.String(c.authorizedKey(secret, sshKey)),
+		CanPush: gitlab.Bool(canPush && readOnly == ""),
+	}
+	key, _, err := c.gitlabClient.DeployKeys.AddDeployKey(project.ID, opts, gitlab.WithContext(ctx))
+	if isKeyTaken(err) {
+		return c.findDeployKey(ctx, project.ID, ssh.FingerprintSHA256(sshKey))
+	}
+	if err != nil {
+		return nil, err
+	}
+	audit.record(auditCreateDeployKey, project.PathWithNamespace, key.ID, key.Title, secret)
+	return key, nil
+}
+
+// deleteIdentityPairKeys removes the deploy keys of every identity pair of a
+// deleted Secret from gitlab
+func (c *Controller) deleteIdentityPairKeys(ctx context.Context, secret *corev1.Secret) error {
+	keys, err := pairDeployKeys(secret)
+	if err != nil {
+		return err
+	}
+	urls := map[string]string{}
+	for _, pair := range identityPairs(secret) {
+		urls[pair.suffix] = pair.project()
+	}
+
+	ctx, cancel := c.gitlabContext(ctx, secret)
+	defer cancel()
+
+	for suffix, deployKey := range keys {
+		project, ok := urls[suffix]
+		if !ok {
+			klog.Warningf("Secret %s has no git url left for identity %s, leaving deploy key %d in place", secret.GetName(), suffix, deployKey)
+			continue
+		}
+		if !allowedProject(project) {
+			klog.Warningf("Project %s of secret %s isn't in the project allowlist, leaving deploy key %d in place", project, secret.GetName(), deployKey)
+			continue
+		}
+		if noDelete {
+			klog.Infof("Not deleting deploy key %d of project %s, deletion is disabled", deployKey, project)
+			continue
+		}
+		if err := c.deletions.allow(); err != nil {
+			return err
+		}
+		logV(4).Infof("Deleting deploy key %d of identity %s", deployKey, suffix)
+		resp, err := c.gitlabClient.DeployKeys.DeleteDeployKey(projectIDOrPath(project), deployKey, gitlab.WithContext(ctx))
+		if err != nil && !isNotFound(resp) {
+			return err
+		}
+		if err == nil {
+			audit.record(auditDeleteDeployKey, project, deployKey, "", secret)
+		}
+	}
+	return nil
+}
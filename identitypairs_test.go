@@ -0,0 +1,103 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIdentityPairs(t *testing.T) {
+	defer func(prefix string) { multiIdentityPrefix = prefix }(multiIdentityPrefix)
+
+	secret := unannotatedSecret()
+	secret.Data = map[string][]byte{"identity-b": []byte("b"), "identity-a": []byte("a"), "identity-c": []byte("c"), "identity-": []byte("none")}
+	secret.Annotations = map[string]string{
+		gitUrlLabelName + "-a": "git@" + gitSSHHost + ":group/a.git",
+		gitUrlLabelName + "-b": "git@" + gitSSHHost + ":group/b.git",
+	}
+
+	multiIdentityPrefix = ""
+	if pairs := identityPairs(secret); len(pairs) != 0 {
+		t.Errorf("got %d pairs without -multi-identity-prefix, want none", len(pairs))
+	}
+
+	multiIdentityPrefix = "identity-"
+	pairs := identityPairs(secret)
+	if len(pairs) != 2 {
+		t.Fatalf("got %d pairs, want the 2 identities with a git url", len(pairs))
+	}
+	for i, want := range []string{"a", "b"} {
+		if pairs[i].suffix != want || string(pairs[i].data) != want || pairs[i].project() != "group/"+want {
+			t.Errorf("pair %d = %+v, want identity %s of project group/%s", i, pairs[i], want, want)
+		}
+	}
+}
+
+func TestSyncIdentityPairs(t *testing.T) {
+	defer func(prefix string) { multiIdentityPrefix = prefix }(multiIdentityPrefix)
+	multiIdentityPrefix = "identity-"
+
+	secret := unannotatedSecret()
+	secret.Labels = map[string]string{fluxSecretLabelFilter: "true"}
+	secret.Data["identity-a"], _ = testKey(t, 2048)
+	secret.Data["identity-b"], _ = testKey(t, 2048)
+	secret.Annotations = map[string]string{
+		gitUrlLabelName + "-a": "git@" + gitSSHHost + ":group/app.git",
+		gitUrlLabelName + "-b": "git@" + gitSSHHost + ":group/app.git",
+	}
+	gl := newFakeGitlab()
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	keys, err := pairDeployKeys(s.secret(t, secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || len(gl.keys) != 2 || keys["a"] == keys["b"] {
+		t.Fatalf("recorded deploy keys %v and created %d, want one per identity", keys, len(gl.keys))
+	}
+
+	// The recorded pairs aren't created again
+	requests := len(gl.requested())
+	if err := s.syncSecret(context.Background(), s.secret(t, secret)); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if len(gl.requested()) != requests {
+		t.Errorf("the second sync made gitlab requests %v", gl.requested()[requests:])
+	}
+}
+
+func TestEnvironmentPairs(t *testing.T) {
+	secret := unannotatedSecret()
+	secret.Annotations = map[string]string{environmentsLabelName: `{"prod": "group/app", "dev": "group/app-dev"}`}
+	pairs := identityPairs(secret)
+	if len(pairs) != 2 {
+		t.Fatalf("got %d pairs, want one per environment", len(pairs))
+	}
+	for i, want := range []struct{ environment, project string }{{"dev", "group/app-dev"}, {"prod", "group/app"}} {
+		if pairs[i].suffix != want.environment || pairs[i].project() != want.project || string(pairs[i].data) != string(secret.Data["identity"]) {
+			t.Errorf("pair %d = %+v, want the identity in project %s for %s", i, pairs[i], want.project, want.environment)
+		}
+	}
+
+	secret.Annotations[environmentsLabelName] = "invalid"
+	if pairs := identityPairs(secret); len(pairs) != 0 {
+		t.Errorf("got %d pairs of an invalid environments annotation, want none", len(pairs))
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// importManifest lists the deploy keys to import, e.g.
+//
+//	keys:
+//	- project: group/app
+//	  key: ssh-rsa AAAA...
+//	  title: flux app
+//	  canPush: false
+type importManifest struct {
+	Keys []importedKey `json:"keys"`
+}
+
+// importedKey is a public key to make a deploy key of a project. The title
+// and push permission default to the ones of -deploy-key-title and
+// -deploy-key-can-push.
+type importedKey struct {
+	Project string `json:"project"`
+	Key     string `json:"key"`
+	Title   string `json:"title,omitempty"`
+	CanPush *bool  `json:"canPush,omitempty"`
+}
+
+// readImportManifest reads and checks the manifest at path
+func readImportManifest(path string) (*importManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest importManifest
+	if err := yaml.UnmarshalStrict(data, &manifest); err != nil {
+		return nil, err
+	}
+	for i, key := range manifest.Keys {
+		if key.Project == "" || key.Key == "" {
+			return nil, fmt.Errorf("key %d: project and key are required", i)
+		}
+		if _, err := fingerprint(key.Key); err != nil {
+			return nil, fmt.Errorf("key %d: %s", i, err.Error())
+		}
+	}
+	return &manifest, nil
+}
+
+// importKeys makes sure every key of the manifest is a deploy key of its
+// project, then records it in the labeled secrets with the same project and
+// public key so the controller manages it from then on. Nothing is changed
+// with dryRun. The outcome of each key is written to out, it returns false if
+// any failed.
+func importKeys(kubeClient kubernetes.Interface, gitlabClient *gitlab.Client, manifest *importManifest, dryRun bool, out io.Writer) bool {
+	c := &Controller{kubeclientset: kubeClient, gitlabClient: gitlabClient}
+	ctx := context.TODO()
+
+	secrets, err := kubeClient.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: fluxSecretLabelFilter})
+	if err != nil {
+		fmt.Fprintf(out, "FAIL  list secrets: %s\n", err.Error())
+		return false
+	}
+
+	ok := true
+	for _, key := range manifest.Keys {
+		if err := c.importKey(ctx, key, secrets.Items, dryRun, out); err != nil {
+			fmt.Fprintf(out, "FAIL  %s: %s\n", key.Project, err.Error())
+			ok = false
+		}
+	}
+	return ok
+}
+
+// importKey imports a key of the manifest, see importKeys
+func (c *Controller) importKey(ctx context.Context, key importedKey, secrets []corev1.Secret, dryRun bool, out io.Writer) error {
+	keyFingerprint, _ := fingerprint(key.Key)
+	project, _, err := getProject(ctx, c.gitlabClient, projectIDOrPath(pathFromURL(key.Project)))
+	if err != nil {
+		return err
+	}
+
+	deployKey, err := c.findDeployKey(ctx, project.ID, keyFingerprint)
+	switch {
+	case err == nil:
+		fmt.Fprintf(out, "PASS  %s: deploy key %d has fingerprint %s\n", project.PathWithNamespace, deployKey.ID, keyFingerprint)
+	case !goerrors.Is(err, errDeployKeyNotFound):
+		return err
+	case dryRun:
+		fmt.Fprintf(out, "DRY   %s: would create the deploy key with fingerprint %s\n", project.PathWithNamespace, keyFingerprint)
+	default:
+		title, canPush := deployKeyTitle, deployKeyCanPush
+		if key.Title != "" {
+			title = key.Title
+		}
+		if key.CanPush != nil {
+			canPush = *key.CanPush
+		}
+		opts := &gitlab.AddDeployKeyOptions{
+			Title:   gitlab.String(truncateTitle(title)),
+			Key:     gitlab.String(key.Key),
+			CanPush: gitlab.Bool(canPush && !project.Mirror),
+		}
+		if deployKey, _, err = c.gitlabClient.DeployKeys.AddDeployKey(project.ID, opts, gitlab.WithContext(ctx)); err != nil {
+			return err
+		}
+		audit.record(auditCreateDeployKey, project.PathWithNamespace, deployKey.ID, deployKey.Title, nil)
+		fmt.Fprintf(out, "PASS  %s: created deploy key %d with fingerprint %s\n", project.PathWithNamespace, deployKey.ID, keyFingerprint)
+	}
+
+	for i := range secrets {
+		secret := &secrets[i]
+		if projectPath(secret) != project.PathWithNamespace {
+			continue
+		}
+		sshKey, err := publicKey(secret)
+		if err != nil || ssh.FingerprintSHA256(sshKey) != keyFingerprint {
+			continue
+		}
+		if dryRun || deployKey == nil {
+			fmt.Fprintf(out, "DRY   %s: would record the deploy key in secret %s/%s\n", project.PathWithNamespace, secret.Namespace, secret.Name)
+			continue
+		}
+
+		createdAt := time.Now()
+		if deployKey.CreatedAt != nil {
+			createdAt = *deployKey.CreatedAt
+		}
+		annotations := map[string]string{
+			deployKeyLabelName:            strconv.Itoa(deployKey.ID),
+			deployKeyFingerprintLabelName: keyFingerprint,
+			createdTitleLabelName:         deployKey.Title,
+			projectIdLabelName:            strconv.Itoa(project.ID),
+			projectPathLabelName:          project.PathWithNamespace,
+			createdAtLabelName:            createdAt.UTC().Format(time.RFC3339),
+		}
+		if project.Mirror {
+			annotations[mirrorLabelName] = "true"
+		}
+		if err := c.updateSecretStatus(ctx, secret, annotations); err != nil {
+			return fmt.Errorf("failed to record the deploy key in secret %s/%s: %s", secret.Namespace, secret.Name, err.Error())
+		}
+		fmt.Fprintf(out, "PASS  %s: recorded deploy key %d in secret %s/%s\n", project.PathWithNamespace, deployKey.ID, secret.Namespace, secret.Name)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReadImportManifest(t *testing.T) {
+	_, key := testKey(t, 2048)
+	authorized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	tests := []struct {
+		name     string
+		manifest string
+		valid    bool
+	}{
+		{"valid", "keys:\n- project: group/app\n  key: " + authorized + "\n  canPush: false\n", true},
+		{"missing project", "keys:\n- key: " + authorized + "\n", false},
+		{"invalid key", "keys:\n- project: group/app\n  key: ssh-rsa invalid\n", false},
+		{"unknown field", "keys:\n- project: group/app\n  key: " + authorized + "\n  push: true\n", false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "manifest.yaml")
+		if err := ioutil.WriteFile(path, []byte(test.manifest), 0600); err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := readImportManifest(path)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: readImportManifest = %v", test.name, err)
+		}
+		if test.valid && (len(manifest.Keys) != 1 || manifest.Keys[0].CanPush == nil || *manifest.Keys[0].CanPush) {
+			t.Errorf("%s: manifest = %+v", test.name, manifest)
+		}
+	}
+}
+
+func TestImportKeys(t *testing.T) {
+	secret := identitySecret(t)
+	sshKey, err := publicKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canPush := false
+	manifest := &importManifest{Keys: []importedKey{{Project: "group/app", Key: string(ssh.MarshalAuthorizedKey(sshKey)), Title: "imported", CanPush: &canPush}}}
+	s := newTestSync(t, newFakeGitlab(), secret)
+
+	var out bytes.Buffer
+	if !importKeys(s.client, s.gitlabClient, manifest, true, &out) {
+		t.Fatalf("dry run import failed:\n%s", out.String())
+	}
+	if len(s.gitlab.keys) != 0 || !strings.Contains(out.String(), "DRY") {
+		t.Errorf("the dry run changed things:\n%s", out.String())
+	}
+
+	out.Reset()
+	if !importKeys(s.client, s.gitlabClient, manifest, false, &out) {
+		t.Fatalf("import failed:\n%s", out.String())
+	}
+	key := s.gitlab.keys[1]
+	if key == nil || key.Title != "imported" || key.CanPush == nil || *key.CanPush {
+		t.Errorf("deploy key = %+v, want the read-only key of the manifest", key)
+	}
+	annotations := s.secret(t, secret).Annotations
+	if annotations[deployKeyLabelName] != "1" || annotations[deployKeyFingerprintLabelName] != ssh.FingerprintSHA256(sshKey) {
+		t.Errorf("annotations = %v, want the imported deploy key", annotations)
+	}
+
+	// Importing again finds the deploy key
+	out.Reset()
+	if !importKeys(s.client, s.gitlabClient, manifest, false, &out) || len(s.gitlab.keys) != 1 {
+		t.Errorf("the second import created another key:\n%s", out.String())
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// inventoryEntry describes a deploy key managed by the controller
+type inventoryEntry struct {
+	Namespace   string     `json:"namespace"`
+	Name        string     `json:"name"`
+	Project     string     `json:"project"`
+	ProjectID   string     `json:"projectId,omitempty"`
+	DeployKeyID string     `json:"deployKeyId"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	Title       string     `json:"title,omitempty"`
+	CreatedAt   string     `json:"createdAt,omitempty"`
+	LastSynced  *time.Time `json:"lastSynced,omitempty"`
+}
+
+// listFunc lists the Secrets watched by the controller
+type listFunc func() ([]*corev1.Secret, error)
+
+// inventory returns the deploy keys of the secrets that have one, sorted by
+// namespace/name
+func (c *Controller) inventory(secrets []*corev1.Secret) []inventoryEntry {
+	entries := []inventoryEntry{}
+	for _, secret := range secrets {
+		secret = c.state.overlay(secret)
+		deployKey, ok := secret.Annotations[deployKeyLabelName]
+		if !ok {
+			continue
+		}
+		entry := inventoryEntry{
+			Namespace:   secret.Namespace,
+			Name:        secret.Name,
+			Project:     projectPath(secret),
+			ProjectID:   secret.Annotations[projectIdLabelName],
+			DeployKeyID: deployKey,
+			Fingerprint: secret.Annotations[deployKeyFingerprintLabelName],
+			Title:       secret.Annotations[createdTitleLabelName],
+			CreatedAt:   secret.Annotations[createdAtLabelName],
+		}
+		if synced, ok := c.lastSynced(secret); ok {
+			entry.LastSynced = &synced
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Namespace != entries[j].Namespace {
+			return entries[i].Namespace < entries[j].Namespace
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// inventoryHandler serves the inventory of the secrets returned by list as
+// JSON, or as YAML with ?format=yaml
+func (c *Controller) inventoryHandler(list listFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secrets, err := list()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list secrets: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		data, err := json.MarshalIndent(c.inventory(secrets), "", "  ")
+		contentType := "application/json"
+		if err == nil && r.URL.Query().Get("format") == "yaml" {
+			data, err = yaml.JSONToYAML(data)
+			contentType = "application/yaml"
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Write(data)
+	})
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestInventoryHandler(t *testing.T) {
+	keyed := fluxSecret()
+	keyed.Namespace = "b"
+	keyed.Annotations[deployKeyFingerprintLabelName] = "SHA256:abc"
+	other := fluxSecret()
+	other.Namespace = "a"
+	unkeyed := unannotatedSecret()
+
+	c := &Controller{}
+	c.markSynced(keyed)
+	handler := c.inventoryHandler(func() ([]*corev1.Secret, error) {
+		return []*corev1.Secret{keyed, unkeyed, other}, nil
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/inventory", nil))
+	var entries []inventoryEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("invalid inventory %s: %s", rec.Body.String(), err.Error())
+	}
+	if len(entries) != 2 || entries[0].Namespace != "a" || entries[1].Namespace != "b" {
+		t.Fatalf("inventory = %+v, want the 2 keyed secrets sorted by namespace", entries)
+	}
+	if entries[1].Project != projectPath(keyed) || entries[1].DeployKeyID != "1" || entries[1].Fingerprint != "SHA256:abc" || entries[1].LastSynced == nil {
+		t.Errorf("inventory entry = %+v, want the key, fingerprint and sync time of the secret", entries[1])
+	}
+	if entries[0].LastSynced != nil {
+		t.Errorf("never synced secret has a sync time")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/inventory?format=yaml", nil))
+	if rec.Header().Get("Content-Type") != "application/yaml" || !strings.Contains(rec.Body.String(), "deployKeyId: \"1\"") {
+		t.Errorf("YAML inventory = %s", rec.Body.String())
+	}
+}
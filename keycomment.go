@@ -0,0 +1,88 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// keyCommentTemplate is the parsed -key-comment-template, nil when unset
+var keyCommentTemplate *template.Template
+
+// keyCommentData is what the -key-comment-template is given
+type keyCommentData struct {
+	// Cluster is the -remote-kubeconfigs cluster of the secret, or else the
+	// -cluster-name
+	Cluster string
+	// Namespace and Name are the secret namespace and name
+	Namespace string
+	Name      string
+	// Timestamp is the UTC time the key is uploaded, e.g. 20201017T120000Z
+	Timestamp string
+}
+
+// parseKeyCommentTemplate parses the -key-comment-template, making sure it
+// renders for any secret
+func parseKeyCommentTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("key-comment").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var comment strings.Builder
+	if err = tmpl.Execute(&comment, keyCommentData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// authorizedKey returns the authorized_keys line of the public key uploaded
+// to gitlab, with the -key-comment-template comment when set, so the key
+// tells where it comes from in gitlab
+func (c *Controller) authorizedKey(secret *corev1.Secret, sshKey ssh.PublicKey) string {
+	line := string(ssh.MarshalAuthorizedKey(sshKey))
+	if keyCommentTemplate == nil {
+		return line
+	}
+
+	cluster := c.cluster
+	if cluster == "" {
+		cluster = clusterName
+	}
+	var comment strings.Builder
+	err := keyCommentTemplate.Execute(&comment, keyCommentData{
+		Cluster:   cluster,
+		Namespace: secret.Namespace,
+		Name:      secret.Name,
+		Timestamp: time.Now().UTC().Format("20060102T150405Z"),
+	})
+	if err != nil {
+		klog.Warningf("Failed to render the key comment of secret %s, uploading the key without it: %s", secret.GetName(), err.Error())
+		return line
+	}
+	// The comment ends the line, it can't span several
+	text := strings.Join(strings.Fields(comment.String()), " ")
+	if text == "" {
+		return line
+	}
+	return strings.TrimSuffix(line, "\n") + " " + text + "\n"
+}
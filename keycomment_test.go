@@ -0,0 +1,93 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseKeyCommentTemplate(t *testing.T) {
+	if _, err := parseKeyCommentTemplate("flux@{{.Cluster}}-{{.Timestamp}}"); err != nil {
+		t.Errorf("parseKeyCommentTemplate: %s", err.Error())
+	}
+	for _, text := range []string{"flux@{{.Cluster", "flux@{{.Project}}"} {
+		if _, err := parseKeyCommentTemplate(text); err == nil {
+			t.Errorf("parseKeyCommentTemplate(%q) didn't fail", text)
+		}
+	}
+}
+
+func TestAuthorizedKey(t *testing.T) {
+	defer func(tmpl *template.Template, name string) { keyCommentTemplate, clusterName = tmpl, name }(keyCommentTemplate, clusterName)
+	_, publicKey := testKey(t, 1024)
+	line := string(ssh.MarshalAuthorizedKey(publicKey))
+	secret := fluxSecret()
+
+	keyCommentTemplate = nil
+	if got := (&Controller{}).authorizedKey(secret, publicKey); got != line {
+		t.Errorf("authorizedKey = %q without a template, want %q", got, line)
+	}
+
+	var err error
+	clusterName = "production"
+	keyCommentTemplate, err = parseKeyCommentTemplate("flux@{{.Cluster}} {{.Namespace}}/{{.Name}}\n{{.Timestamp}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comment := regexp.MustCompile(`^ flux@production flux/flux-git-deploy [0-9]{8}T[0-9]{6}Z\n$`)
+	got := (&Controller{}).authorizedKey(secret, publicKey)
+	if !strings.HasPrefix(got, strings.TrimSuffix(line, "\n")) || !comment.MatchString(strings.TrimPrefix(got, strings.TrimSuffix(line, "\n"))) {
+		t.Errorf("authorizedKey = %q, want the key with the comment on a single line", got)
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(got)); err != nil {
+		t.Errorf("the commented key doesn't parse: %s", err.Error())
+	}
+	if got := (&Controller{cluster: "staging"}).authorizedKey(secret, publicKey); !strings.Contains(got, "flux@staging ") {
+		t.Errorf("authorizedKey = %q, want the remote cluster in the comment", got)
+	}
+
+	keyCommentTemplate = template.Must(parseKeyCommentTemplate("{{if false}}flux{{end}}"))
+	if got := (&Controller{}).authorizedKey(secret, publicKey); got != line {
+		t.Errorf("authorizedKey = %q with an empty comment, want %q", got, line)
+	}
+}
+
+func TestSyncCommentsKey(t *testing.T) {
+	defer func(tmpl *template.Template) { keyCommentTemplate = tmpl }(keyCommentTemplate)
+	keyCommentTemplate = template.Must(parseKeyCommentTemplate("flux@{{.Namespace}}"))
+
+	secret := identitySecret(t)
+	gl := newFakeGitlab()
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if key := gl.keys[1]; key == nil || !strings.HasSuffix(strings.TrimSpace(key.Key), " flux@flux") {
+		t.Errorf("deploy key = %+v, want the key commented", key)
+	}
+	// The comment doesn't change the fingerprint the key is found by
+	sshKey, _ := publicKey(secret)
+	if got := s.secret(t, secret).Annotations[deployKeyFingerprintLabelName]; got != ssh.FingerprintSHA256(sshKey) {
+		t.Errorf("fingerprint = %q, want %q", got, ssh.FingerprintSHA256(sshKey))
+	}
+}
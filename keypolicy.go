@@ -0,0 +1,83 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// defaultKeyTypes are the -allowed-key-types, the key types gitlab accepts
+// by default
+var defaultKeyTypes = strings.Join([]string{
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+}, ",")
+
+// keyTypes holds the parsed -allowed-key-types
+var keyTypes = map[string]bool{}
+
+// parseKeyTypes parses a comma separated list of ssh key types
+func parseKeyTypes(list string) (map[string]bool, error) {
+	types := map[string]bool{}
+	for _, keyType := range strings.Split(list, ",") {
+		if keyType = strings.TrimSpace(keyType); keyType != "" {
+			types[keyType] = true
+		}
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("no key type allowed")
+	}
+	return types, nil
+}
+
+// keyPolicyViolation returns how the public key breaks the
+// -enforce-key-policy, empty when it doesn't or there's no policy
+func keyPolicyViolation(key ssh.PublicKey) string {
+	if !enforceKeyPolicy {
+		return ""
+	}
+	if !keyTypes[key.Type()] {
+		return fmt.Sprintf("%s keys aren't allowed, only %s", key.Type(), allowedKeyTypes)
+	}
+	if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSAKeyBits {
+			return fmt.Sprintf("the RSA key has %d bits, less than the %d required", rsaKey.N.BitLen(), minRSAKeyBits)
+		}
+	}
+	return ""
+}
+
+// checkKeyPolicy reports whether the public key of the secret complies with
+// the -enforce-key-policy, recording a Warning event when it doesn't rather
+// than having gitlab reject it
+func (c *Controller) checkKeyPolicy(secret *corev1.Secret, key ssh.PublicKey) bool {
+	violation := keyPolicyViolation(key)
+	if violation == "" {
+		return true
+	}
+	c.recorder.Eventf(secret, corev1.EventTypeWarning, ErrKeyPolicy, MessageKeyPolicy, ssh.FingerprintSHA256(key), violation)
+	skippedSecrets.WithLabelValues("key_policy").Inc()
+	return false
+}
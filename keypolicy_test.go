@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// setKeyPolicy enforces a key policy of the key types and RSA size
+func setKeyPolicy(t *testing.T, types string, bits int) {
+	t.Helper()
+	parsed, err := parseKeyTypes(types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enforceKeyPolicy, allowedKeyTypes, keyTypes, minRSAKeyBits = true, types, parsed, bits
+}
+
+func TestParseKeyTypes(t *testing.T) {
+	types, err := parseKeyTypes(" ssh-rsa, ssh-ed25519 ,")
+	if err != nil {
+		t.Fatalf("parseKeyTypes: %s", err.Error())
+	}
+	if want := map[string]bool{ssh.KeyAlgoRSA: true, ssh.KeyAlgoED25519: true}; !reflect.DeepEqual(types, want) {
+		t.Errorf("types = %v, want %v", types, want)
+	}
+	if _, err := parseKeyTypes(" , "); err == nil {
+		t.Errorf("parseKeyTypes of no type didn't fail")
+	}
+	if types, err := parseKeyTypes(defaultKeyTypes); err != nil || len(types) != 5 {
+		t.Errorf("parseKeyTypes of the default types = %v, %v", types, err)
+	}
+}
+
+func TestKeyPolicyViolation(t *testing.T) {
+	defer func(enforce bool, allowed string, types map[string]bool, bits int) {
+		enforceKeyPolicy, allowedKeyTypes, keyTypes, minRSAKeyBits = enforce, allowed, types, bits
+	}(enforceKeyPolicy, allowedKeyTypes, keyTypes, minRSAKeyBits)
+
+	_, small := testKey(t, 1024)
+	_, large := testKey(t, 2048)
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	ed, _ := ssh.NewPublicKey(edPublic)
+
+	enforceKeyPolicy = false
+	if violation := keyPolicyViolation(small); violation != "" {
+		t.Errorf("violation %q without -enforce-key-policy", violation)
+	}
+
+	setKeyPolicy(t, ssh.KeyAlgoRSA, 2048)
+	tests := []struct {
+		key      ssh.PublicKey
+		violates bool
+	}{
+		{small, true},
+		{large, false},
+		{ed, true},
+	}
+	for _, test := range tests {
+		if violation := keyPolicyViolation(test.key); (violation != "") != test.violates {
+			t.Errorf("keyPolicyViolation of a %s key = %q, want a violation %v", test.key.Type(), violation, test.violates)
+		}
+	}
+}
+
+func TestSyncKeyPolicy(t *testing.T) {
+	defer func(enforce bool, allowed string, types map[string]bool, bits int) {
+		enforceKeyPolicy, allowedKeyTypes, keyTypes, minRSAKeyBits = enforce, allowed, types, bits
+	}(enforceKeyPolicy, allowedKeyTypes, keyTypes, minRSAKeyBits)
+	setKeyPolicy(t, defaultKeyTypes, 4096)
+
+	secret := identitySecret(t)
+	gl := newFakeGitlab()
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if len(gl.keys) != 0 {
+		t.Errorf("a key breaking the key policy was uploaded")
+	}
+	if !hasEvent(s.events(), ErrKeyPolicy) {
+		t.Errorf("no %s event", ErrKeyPolicy)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// knownHostsKey is the secret data key flux reads the known hosts from
+const knownHostsKey = "known_hosts"
+
+// hostKeyAlgorithms are the host key types fetched from the gitlab SSH host
+var hostKeyAlgorithms = []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSA}
+
+// knownHosts caches the known_hosts lines of the gitlab SSH host once they
+// were fetched
+type knownHosts struct {
+	mu    sync.Mutex
+	lines string
+}
+
+// get returns the known_hosts lines of the SSH host, fetching them the first
+// time
+func (k *knownHosts) get(addr string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.lines != "" {
+		return k.lines, nil
+	}
+	lines, err := fetchKnownHosts(addr)
+	if err != nil {
+		return "", err
+	}
+	k.lines = lines
+	return lines, nil
+}
+
+// fetchKnownHosts returns a known_hosts line for every host key type the SSH
+// host at addr offers. It only goes as far as the key exchange, the
+// authentication failing on purpose.
+func fetchKnownHosts(addr string) (string, error) {
+	var lines []string
+	for _, algorithm := range hostKeyAlgorithms {
+		var hostKey ssh.PublicKey
+		config := &ssh.ClientConfig{
+			User:              "git",
+			HostKeyAlgorithms: []string{algorithm},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				hostKey = key
+				return fmt.Errorf("host key fetched")
+			},
+			Timeout: 10 * time.Second,
+		}
+		if conn, err := ssh.Dial("tcp", addr, config); err == nil {
+			conn.Close()
+		}
+		if hostKey != nil {
+			lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey))
+		}
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("failed to fetch the host keys of %s", addr)
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// knownHostsAddr returns the address of the SSH host to fetch the host keys
+// of, the git SSH host unless -known-hosts-addr is set
+func knownHostsAddr() string {
+	if len(knownHostsAddress) > 0 {
+		return knownHostsAddress
+	}
+	return net.JoinHostPort(gitSSHHost, "22")
+}
+
+// missingKnownHosts returns the secret data with the known hosts of the
+// gitlab SSH host, nil when the secret already has some
+func (c *Controller) missingKnownHosts(secret *corev1.Secret) (map[string][]byte, error) {
+	if _, ok := secret.Data[knownHostsKey]; ok {
+		return nil, nil
+	}
+	lines, err := c.knownHosts.get(knownHostsAddr())
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{knownHostsKey: []byte(lines)}, nil
+}
+
+// populateKnownHosts writes the known hosts of the gitlab SSH host into the
+// secret, unless it already has some
+func (c *Controller) populateKnownHosts(ctx context.Context, secret *corev1.Secret) error {
+	data, err := c.missingKnownHosts(secret)
+	if err != nil || data == nil {
+		return err
+	}
+	return c.patchSecret(ctx, secret, nil, data)
+}
+
+// patchSecret sets the annotations and data on the Secret in a single merge
+// patch, which leaves the rest of them alone. Unlike the apply patches of
+// updateSecretStatus, it doesn't make the field manager own the data, which
+// a later apply without it would otherwise remove.
+func (c *Controller) patchSecret(ctx context.Context, secret *corev1.Secret, annotations map[string]string, data map[string][]byte) error {
+	fields := map[string]interface{}{"data": data}
+	if len(annotations) > 0 {
+		fields["metadata"] = map[string]interface{}{"annotations": annotations}
+	}
+	patch, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeclientset.CoreV1().Secrets(secret.Namespace).Patch(ctx, secret.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+	return kubernetesError(err)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshHost serves the SSH handshakes of fetchKnownHosts with an ed25519 host
+// key, returning its address and public key
+func sshHost(t *testing.T) (string, ssh.PublicKey) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, fmt.Errorf("unauthorized")
+		},
+	}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ssh.NewServerConn(conn, config)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String(), signer.PublicKey()
+}
+
+func TestFetchKnownHosts(t *testing.T) {
+	addr, hostKey := sshHost(t)
+	lines, err := fetchKnownHosts(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey) + "\n"
+	if lines != want {
+		t.Errorf("known hosts = %q, want %q", lines, want)
+	}
+
+	// The hosts are only fetched once
+	var cache knownHosts
+	if _, err := cache.get(addr); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := cache.get("127.0.0.1:1"); err != nil || cached != want {
+		t.Errorf("cached known hosts = %q, %v", cached, err)
+	}
+
+	if _, err := fetchKnownHosts("127.0.0.1:1"); err == nil {
+		t.Errorf("fetching from a closed port didn't fail")
+	}
+}
+
+func TestMissingKnownHosts(t *testing.T) {
+	addr, _ := sshHost(t)
+	defer func(a string) { knownHostsAddress = a }(knownHostsAddress)
+	knownHostsAddress = addr
+
+	c := &Controller{}
+	secret := fluxSecret()
+	data, err := c.missingKnownHosts(secret)
+	if err != nil || !strings.HasPrefix(string(data[knownHostsKey]), knownhosts.Normalize(addr)+" ") {
+		t.Errorf("missing known hosts = %q, %v", data[knownHostsKey], err)
+	}
+
+	secret.Data[knownHostsKey] = []byte("custom")
+	if data, err := c.missingKnownHosts(secret); data != nil || err != nil {
+		t.Errorf("the known hosts of the secret were replaced with %q, %v", data, err)
+	}
+}
+
+func TestSyncPopulatesKnownHosts(t *testing.T) {
+	addr, _ := sshHost(t)
+	defer func(populate bool, a string) { populateKnownHosts, knownHostsAddress = populate, a }(populateKnownHosts, knownHostsAddress)
+	populateKnownHosts, knownHostsAddress = true, addr
+
+	secret := identitySecret(t)
+	s := newTestSync(t, newFakeGitlab(), secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	updated := s.secret(t, secret)
+	if updated.Annotations[deployKeyLabelName] != "1" || len(updated.Data[knownHostsKey]) == 0 {
+		t.Errorf("secret = %v, want the deploy key and the known hosts", updated)
+	}
+	writes := 0
+	for _, action := range s.client.Actions() {
+		if action.GetVerb() == "patch" || action.GetVerb() == "update" {
+			writes++
+		}
+	}
+	if writes != 1 {
+		t.Errorf("the secret was written %d times, want once", writes)
+	}
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"k8s.io/klog"
+)
+
+// logV is the leveled logger of the controller's own reconcile logs. They're
+// logged at -reconcile-log-level or at the klog verbosity, whichever is
+// higher, so the reconcile traces can be turned on without the verbose logs
+// of client-go.
+func logV(level klog.Level) klog.Verbose {
+	if level <= klog.Level(reconcileLogLevel) {
+		return klog.Verbose(true)
+	}
+	return klog.V(level)
+}
@@ -18,9 +18,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
@@ -33,16 +41,219 @@ import (
 	"k8s.io/flux-gitlab-controller/pkg/signals"
 )
 
+// version is the version of the controller, set at build time with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
 var (
-	masterURL      string
-	kubeconfig     string
-	gitlabToken    string
-	gitlabHostname string
+	gitlabHeaders = http.Header{}
+	// gitlabHostQPS holds the -gitlab-host-qps request rates by host
+	gitlabHostQPS = hostQPSFlag{}
+
+	// namespaceRegexp is the compiled namespacePattern, nil when unset
+	namespaceRegexp *regexp.Regexp
+	// projectAllowlist holds the project path patterns of projectAllowlistFlag
+	// and projectAllowlistFile, empty when unset
+	projectAllowlist []string
+	// gitURLTemplate is the parsed gitURLFromName, nil when unset
+	gitURLTemplate *template.Template
+
+	masterURL            string
+	kubeconfig           string
+	gitlabToken          string
+	gitlabTokenFile      string
+	gitlabHostname       string
+	gitSSHHost           string
+	metricsAddr          string
+	healthAddr           string
+	shardIndex           int
+	shardCount           int
+	requestTimeout       time.Duration
+	verifyKeys           bool
+	noDelete             bool
+	diagnoseSecret       string
+	verifyCacheTTL       time.Duration
+	identityKeys         string
+	max429Backoff        time.Duration
+	namespacePattern     string
+	useManager           bool
+	verifySampleFraction float64
+	leaderElect          bool
+
+	logGitlabRequests     bool
+	reconcileOnStart      bool
+	deletionWorkers       int
+	fieldManager          string
+	gitURLFromName        string
+	multiIdentityPrefix   string
+	reconcileToken        string
+	reconcileLogLevel     int
+	projectAllowlistFlag  string
+	projectAllowlistFile  string
+	defaultsConfigMap     string
+	deployKeyTitle        string
+	deployKeyCanPush      bool
+	populateKnownHosts    bool
+	maxManagedKeys        int
+	gitlabQPS             float64
+	verifyRecreate        bool
+	gitlabUserAgent       string
+	knownHostsAddress     string
+	maxDeletionsPerMinute int
+	deletionHaltThreshold int
+	deletionHaltWindow    time.Duration
+
+	reconcileOnIdentityChange bool
+	importManifestFile        string
+	importDryRun              bool
+	auditLogPath              string
+	verifyAfterCreate         time.Duration
+	projectKeyLimit           int
+	defaultProvider           string
+	titleUniqueness           string
+	clusterName               string
+	deleteGracePeriod         time.Duration
+	allowPushKeys             bool
+	stateConfigMap            string
+	namePrefix                string
+	titleEmbedHash            bool
+	workers                   int
+	startupDelay              time.Duration
+	startupRamp               time.Duration
+	requireGitURL             bool
+	maintenancePause          time.Duration
+	gitURLFromOwner           bool
+	serveConfig               bool
+	pollInterval              time.Duration
+	maxKeyAge                 time.Duration
+	remoteKubeconfigs         string
+	gitlabPageSize            int
+	reconcileTimeout          time.Duration
+	progressWindow            time.Duration
+	eventDedupWindow          time.Duration
+	pushPolicyFile            string
+	orphanScanInterval        time.Duration
+	keyComment                string
+	projectNegativeCacheTTL   time.Duration
+	enforceKeyPolicy          bool
+	minRSAKeyBits             int
+	allowedKeyTypes           string
+	adoptPushMismatch         string
 )
 
 func main() {
 	klog.InitFlags(nil)
 	flag.Parse()
+	kubeconfig = flag.Lookup("kubeconfig").Value.String()
+	masterURL = flag.Lookup("master").Value.String()
+
+	if shardCount < 1 || shardIndex < 0 || shardIndex >= shardCount {
+		klog.Fatalf("Invalid shard %d of %d, the shard index must be between 0 and shard-count - 1", shardIndex, shardCount)
+	}
+
+	if gitlabPageSize < 1 || gitlabPageSize > 100 {
+		klog.Fatalf("Invalid gitlab page size %d, it must be between 1 and 100", gitlabPageSize)
+	}
+
+	if workers < 1 {
+		klog.Fatalf("Invalid number of workers %d, it must be at least 1", workers)
+	}
+
+	if deletionWorkers < 1 {
+		klog.Fatalf("Invalid number of deletion workers %d, it must be at least 1", deletionWorkers)
+	}
+
+	if err := validateIdentityKeys(identityKeys); err != nil {
+		klog.Fatalf("Invalid identity keys: %s", err.Error())
+	}
+
+	if verifySampleFraction < 0 || verifySampleFraction > 1 {
+		klog.Fatalf("Invalid verify sample fraction %v, it must be between 0 and 1", verifySampleFraction)
+	}
+
+	if len(gitSSHHost) == 0 {
+		gitSSHHost = gitlabHostname
+	} else if strings.ContainsAny(gitSSHHost, "@:/ ") {
+		klog.Fatalf("Invalid git ssh host %q, it must be a bare hostname such as git.example.com", gitSSHHost)
+	}
+
+	allowlist, err := readProjectAllowlist(projectAllowlistFlag, projectAllowlistFile)
+	if err != nil {
+		klog.Fatalf("Invalid project allowlist: %s", err.Error())
+	}
+	projectAllowlist = allowlist
+
+	if pushPolicyFile != "" {
+		policy, err := readPushPolicy(pushPolicyFile)
+		if err != nil {
+			klog.Fatalf("Invalid push policy: %s", err.Error())
+		}
+		pushPolicy = policy
+	}
+
+	if len(gitURLFromName) > 0 {
+		var err error
+		if gitURLTemplate, err = template.New("git-url-from-name").Option("missingkey=error").Parse(gitURLFromName); err != nil {
+			klog.Fatalf("Invalid git url template: %s", err.Error())
+		}
+		if _, err = projectPathFromName("namespace", "name"); err != nil {
+			klog.Fatalf("Invalid git url template: %s", err.Error())
+		}
+	}
+
+	if adoptPushMismatch != adoptPushUpdate && adoptPushMismatch != adoptPushKeep {
+		klog.Fatalf("Invalid adopt push mismatch %q, expected update or keep", adoptPushMismatch)
+	}
+
+	if enforceKeyPolicy {
+		types, err := parseKeyTypes(allowedKeyTypes)
+		if err != nil {
+			klog.Fatalf("Invalid allowed key types: %s", err.Error())
+		}
+		keyTypes = types
+	}
+
+	if len(keyComment) > 0 {
+		var err error
+		if keyCommentTemplate, err = parseKeyCommentTemplate(keyComment); err != nil {
+			klog.Fatalf("Invalid key comment template: %s", err.Error())
+		}
+	}
+
+	if len(stateConfigMap) > 0 && (useManager || populateKnownHosts) {
+		klog.Fatalf("-state-configmap can't be used with -controller-runtime nor -populate-known-hosts, which write the secrets")
+	}
+
+	remoteClusters, err := parseRemoteKubeconfigs(remoteKubeconfigs)
+	if err != nil {
+		klog.Fatalf("Invalid remote kubeconfigs: %s", err.Error())
+	}
+	if len(remoteClusters) > 0 && (useManager || len(stateConfigMap) > 0) {
+		klog.Fatalf("-remote-kubeconfigs can't be used with -controller-runtime nor -state-configmap")
+	}
+
+	switch titleUniqueness {
+	case titleUniqueSecret, titleUniqueNone:
+	case titleUniqueCluster:
+		if len(clusterName) == 0 {
+			klog.Fatalf("-title-uniqueness=cluster requires -cluster-name")
+		}
+	default:
+		klog.Fatalf("Invalid title uniqueness %q, expected secret, cluster or none", titleUniqueness)
+	}
+
+	if len(namespacePattern) > 0 {
+		var err error
+		if namespaceRegexp, err = regexp.Compile(namespacePattern); err != nil {
+			klog.Fatalf("Invalid namespace pattern: %s", err.Error())
+		}
+	}
+
+	if len(auditLogPath) > 0 {
+		if err := audit.open(auditLogPath); err != nil {
+			klog.Fatalf("Error opening the audit log: %s", err.Error())
+		}
+	}
 
 	// set up signals so we handle the first shutdown signal gracefully
 	stopCh := signals.SetupSignalHandler()
@@ -52,30 +263,207 @@ func main() {
 		klog.Fatalf("Error building kubeconfig: %s", err.Error())
 	}
 
+	if len(gitlabTokenFile) > 0 {
+		if gitlabToken, err = readTokenFile(gitlabTokenFile); err != nil {
+			klog.Fatalf("Error reading the gitlab token file: %s", err.Error())
+		}
+	}
+	logEffectiveConfig()
+
 	kubeClient, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
 		klog.Fatalf("Error building kubernetes clientset: %s", err.Error())
 	}
 
+	if len(diagnoseSecret) > 0 {
+		gitlabClient, err := newGitlabClient(newTokenTransport(gitlabToken, gitlabTransport()))
+		if err != nil {
+			klog.Fatalf("Error building gitlab client: %s", err.Error())
+		}
+		if !diagnose(kubeClient, gitlabClient, diagnoseSecret, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(importManifestFile) > 0 {
+		manifest, err := readImportManifest(importManifestFile)
+		if err != nil {
+			klog.Fatalf("Error reading the import manifest: %s", err.Error())
+		}
+		gitlabClient, err := newGitlabClient(newTokenTransport(gitlabToken, gitlabTransport()))
+		if err != nil {
+			klog.Fatalf("Error building gitlab client: %s", err.Error())
+		}
+		if !importKeys(kubeClient, gitlabClient, manifest, importDryRun, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if useManager {
+		if err = runManager(cfg, workers, stopCh); err != nil {
+			klog.Fatalf("Error running controller manager: %s", err.Error())
+		}
+		return
+	}
+
 	kubeInformerFactory := informers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*30, informers.WithTweakListOptions(func(lo *v1.ListOptions) {
 		lo.LabelSelector = fluxSecretLabelFilter
 	}))
 
-	controller := NewController(kubeClient, kubeInformerFactory.Core().V1().Secrets())
+	// The Secrets informer falls back to polling when watching is denied
+	kubeInformerFactory.InformerFor(&corev1.Secret{}, newSecretInformer)
+	controller := NewController(kubeClient, kubeInformerFactory.Core().V1().Secrets(), "")
+	if controller.dynamicClient, err = newOwnerClient(cfg); err != nil {
+		klog.Fatalf("Error building dynamic client: %s", err.Error())
+	}
+	if len(stateConfigMap) > 0 {
+		if controller.state, err = newStateStore(kubeClient, stateConfigMap); err != nil {
+			klog.Fatalf("Error loading the state ConfigMap: %s", err.Error())
+		}
+	}
+
+	if err = serve("metrics", metricsAddr, metricsHandler(controller), stopCh); err != nil {
+		klog.Fatalf("Error serving metrics: %s", err.Error())
+	}
+	if err = serve("health checks", healthAddr, healthHandler(controller), stopCh); err != nil {
+		klog.Fatalf("Error serving health checks: %s", err.Error())
+	}
+
 	// notice that there is no need to run Start methods in a separate goroutine. (i.e. go kubeInformerFactory.Start(stopCham
 	// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
 	kubeInformerFactory.Start(stopCh)
 
-	if err = controller.Run(2, stopCh); err != nil {
+	if err = waitForDefaults(kubeClient, stopCh); err != nil {
+		klog.Fatalf("Error reading the key defaults: %s", err.Error())
+	}
+
+	for _, cluster := range remoteClusters {
+		if err = runRemoteController(controller, cluster, stopCh); err != nil {
+			klog.Fatalf("Error running remote controller: %s", err.Error())
+		}
+	}
+
+	if err = controller.Run(workers, stopCh); err != nil {
 		klog.Fatalf("Error running controller: %s", err.Error())
 	}
 }
 
+// readProjectAllowlist returns the project patterns of the comma separated
+// list and of the file, one per line
+func readProjectAllowlist(list, file string) ([]string, error) {
+	entries := strings.Split(list, ",")
+	if len(file) > 0 {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, strings.Split(string(data), "\n")...)
+	}
+
+	var patterns []string
+	for _, entry := range entries {
+		entry = strings.Trim(strings.TrimSpace(entry), "/")
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if _, err := path.Match(entry, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", entry, err.Error())
+		}
+		patterns = append(patterns, entry)
+	}
+	return patterns, nil
+}
+
 func init() {
-	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
-	flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	// controller-runtime registers -kubeconfig and -master for the manager,
+	// the controller reads the same flags
+	if flag.Lookup("kubeconfig") == nil {
+		flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
+	}
+	if flag.Lookup("master") == nil {
+		flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	}
 	flag.StringVar(&gitlabHostname, "gitlab-hostname", "gitlab.com", "The gitlab API token to create and remove deployment keys for the repo")
+	flag.BoolVar(&reconcileOnStart, "reconcile-on-start", true, "Enqueue every secret once the informer cache is synced on start, whatever the resync period.")
+	flag.BoolVar(&logGitlabRequests, "log-gitlab-requests", false, "Log every gitlab API request with its headers, the credentials redacted, and the response status and latency.")
+	flag.StringVar(&gitSSHHost, "git-ssh-host", "", "The host of the git@host: urls in the secrets, when it differs from -gitlab-hostname such as with a vanity SSH host. Defaults to -gitlab-hostname.")
 	flag.StringVar(&gitlabToken, "gitlab-token", "", "The gitlab API token to create and remove deployment keys for the repo")
+	flag.DurationVar(&requestTimeout, "request-timeout", 30*time.Second, "The timeout of the gitlab API calls made for a secret. Can be overridden per secret with the fluxcd.io/request-timeout annotation.")
+	flag.Float64Var(&verifySampleFraction, "verify-sample-fraction", 1, "The fraction of deploy keys, between 0 and 1, randomly picked for verification on each resync with -verify-keys.")
+	flag.DurationVar(&verifyCacheTTL, "verify-cache-ttl", 0, "How long a deploy key verified with -verify-keys isn't verified again. 0 verifies it on every resync.")
+	flag.StringVar(&identityKeys, "identity-keys", "identity,ssh-privatekey", "Comma-separated secret data keys the private key is read from, the first one present is used. A key#field.path entry reads it from a field of a YAML or JSON data key.")
+	flag.BoolVar(&verifyKeys, "verify-keys", false, "Check on every resync that the deploy keys still exist in gitlab with the expected title and push permission, recreating or updating them if not.")
+	flag.BoolVar(&reconcileOnIdentityChange, "reconcile-on-identity-change", false, "Replace the deploy key of the secrets whose identity no longer matches the recorded fingerprint with a key of the new identity.")
+	flag.StringVar(&importManifestFile, "import-manifest", "", "Path of a YAML manifest of project and public key pairs to make deploy keys of and record in the matching secrets, then exit.")
+	flag.BoolVar(&importDryRun, "import-dry-run", false, "Report what -import-manifest would do without changing anything.")
+	flag.DurationVar(&verifyAfterCreate, "verify-after-create", 0, "Verify the deploy keys this long after creating them, e.g. to confirm an HA gitlab propagated them. 0 disables it.")
+	flag.IntVar(&projectKeyLimit, "project-key-limit", 0, "The number of deploy keys a gitlab project can have, checked before creating a key to report the projects at or near it. 0 disables the check.")
+	flag.StringVar(&defaultProvider, "provider", gitlabProvider, "The git provider of the secrets without a fluxcd.io/provider annotation. Only the gitlab secrets are handled, the others are left to the controllers of their provider.")
+	flag.StringVar(&titleUniqueness, "title-uniqueness", titleUniqueSecret, "How the title of a deploy key is suffixed when another key of the project has it: secret (a hash of the secret namespace/name), cluster (a hash of -cluster-name and the secret namespace/name) or none (the key isn't created).")
+	flag.StringVar(&clusterName, "cluster-name", "", "The name of the cluster, unique among the clusters sharing gitlab projects. Required by -title-uniqueness=cluster.")
+	flag.DurationVar(&deleteGracePeriod, "delete-grace-period", 0, "How long after a secret is deleted its deploy key is removed from gitlab, so an accidental deletion can be undone by recreating the secret with the same identity meanwhile. 0 removes it right away.")
+	flag.BoolVar(&allowPushKeys, "allow-push-keys", true, "Whether deploy keys can push. When disabled, every key is created read-only and the secrets with the fluxcd.io/push-required annotation don't get one.")
+	flag.StringVar(&stateConfigMap, "state-configmap", "", "The namespace/name of a ConfigMap to keep the deploy key annotations of the secrets in instead of writing them on the secrets, for clusters where the controller can only read secrets.")
+	flag.StringVar(&namePrefix, "name-prefix", "", "Only manage the secrets whose name starts with this prefix, e.g. flux-. Empty manages them all.")
+	flag.BoolVar(&titleEmbedHash, "title-embed-hash", false, "Embed a short hash of the project, fingerprint and push permission of a deploy key in its title, so -verify-keys reports keys changed outside of the controller.")
+	flag.IntVar(&workers, "workers", 2, "The number of workers creating the deploy keys of the secrets.")
+	flag.DurationVar(&startupDelay, "startup-delay", 0, "How long to wait after the caches synced before starting the workers, e.g. to let gitlab recover from a deploy. 0 starts them right away.")
+	flag.DurationVar(&startupRamp, "startup-ramp", 0, "The window over which the workers are started one after the other, starting with one, so the secrets queued on startup don't all hit gitlab at once. 0 starts them all at once.")
+	flag.BoolVar(&requireGitURL, "require-git-url", false, "Record a Warning event on the labeled secrets with an identity but no git url, which are otherwise skipped silently.")
+	flag.DurationVar(&maintenancePause, "maintenance-pause", 5*time.Minute, "How long the workers pause once gitlab keeps answering 503 Service Unavailable, e.g. during a maintenance window, and how long a secret failing with it waits before being retried.")
+	flag.BoolVar(&gitURLFromOwner, "git-url-from-owner", false, "Read the git url of the secrets owned by a flux v2 GitRepository from its spec.url rather than from their annotation. Requires get on gitrepositories.source.toolkit.fluxcd.io.")
+	flag.BoolVar(&serveConfig, "serve-config", false, "Serve the effective configuration, tokens and header values redacted, at /config on the metrics address. It's logged on start either way.")
+	flag.DurationVar(&pollInterval, "poll-interval", 0, "List the secrets this often instead of watching them, for clusters only granting list and get on secrets. 0 watches them, falling back to listing them every minute when watching is denied.")
+	flag.DurationVar(&maxKeyAge, "max-key-age", 0, "Rotate the deploy keys created longer than this ago, e.g. 2160h for 90 days, generating a new identity for the secret. 0 never rotates them.")
+	flag.StringVar(&remoteKubeconfigs, "remote-kubeconfigs", "", "A comma separated list of kubeconfigs of other clusters whose secrets the controller manages along with the local ones, as name=path or path, the name then being the file name without its extension.")
+	flag.IntVar(&gitlabPageSize, "gitlab-page-size", 100, "The number of deploy keys per page when listing the deploy keys of a project, at most the 100 gitlab allows. Every page is listed whatever the size.")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", 0, "The deadline of the gitlab and Kubernetes calls of the sync of a secret, after which it's cancelled and retried later. A secret timing out 3 times in a row isn't retried until it changes. 0 waits for it however long it takes.")
+	flag.DurationVar(&progressWindow, "progress-window", 10*time.Minute, "How long /progressz tolerates no secret being synced successfully while secrets are queued before reporting the controller stuck.")
+	flag.DurationVar(&eventDedupWindow, "event-dedup-window", 5*time.Minute, "How long an event identical to one recorded for the same secret is suppressed, so a flapping secret doesn't flood the events. 0 records every event.")
+	flag.StringVar(&pushPolicyFile, "push-policy", "", "A file listing, one per line, the gitlab project paths or path.Match patterns such as group/* whose deploy keys can push. The keys of the other projects are created read-only. All projects can have push keys when unset.")
+	flag.DurationVar(&orphanScanInterval, "orphan-scan-interval", 0, "How often the deploy keys titled with -deploy-key-title that no secret records are looked for in the projects of the secrets, to log them and count them in a metric. They are never deleted. 0 disables it.")
+	flag.StringVar(&keyComment, "key-comment-template", "", "A template of the comment appended to the public keys uploaded to gitlab, given the .Cluster (the -remote-kubeconfigs cluster or -cluster-name), the .Namespace and .Name of the secret and the upload .Timestamp, e.g. flux@{{.Cluster}}-{{.Timestamp}}. No comment when unset.")
+	flag.DurationVar(&projectNegativeCacheTTL, "project-negative-cache-ttl", 5*time.Minute, "How long a project gitlab didn't find isn't looked up again, so deleted or misspelled projects don't cost a request on every sync. 0 looks them up every time.")
+	flag.BoolVar(&enforceKeyPolicy, "enforce-key-policy", false, "Check the public keys against -min-rsa-key-bits and -allowed-key-types before uploading them, recording an ErrKeyPolicy Warning event on the secrets breaking them rather than having gitlab reject them.")
+	flag.IntVar(&minRSAKeyBits, "min-rsa-key-bits", 2048, "The minimum size of the RSA keys with -enforce-key-policy, e.g. the one the gitlab instance requires.")
+	flag.StringVar(&allowedKeyTypes, "allowed-key-types", defaultKeyTypes, "A comma separated list of the ssh key types allowed with -enforce-key-policy, e.g. the ones the gitlab instance accepts.")
+	flag.StringVar(&adoptPushMismatch, "adopt-push-mismatch", adoptPushUpdate, "What to do when a deploy key adopted by a secret has another push permission than the secret asks for: update, recreating it on gitlab versions that can't update deploy keys, or keep it as it is.")
+	flag.StringVar(&auditLogPath, "audit-log-path", "", "Path of the file every gitlab mutation is appended to as a JSON audit record, - for stdout. Disabled when empty.")
+	flag.StringVar(&gitlabUserAgent, "gitlab-user-agent", controllerAgentName+"/"+version, "The User-Agent of the gitlab API requests.")
+	flag.BoolVar(&verifyRecreate, "verify-recreate", true, "Recreate the deploy keys -verify-keys finds missing or not matching the secret. When disabled, the annotation of a missing key is replaced with fluxcd.io/deployKeyMissing instead.")
+	flag.Float64Var(&gitlabQPS, "gitlab-qps", 0, "The maximum rate of requests per second to each gitlab host, unless set by -gitlab-host-qps. 0 doesn't limit it.")
+	flag.Var(gitlabHostQPS, "gitlab-host-qps", "The maximum rate of requests per second to a gitlab host, as host=qps, e.g. gitlab.example.com=5. Repeat it for each host.")
+	flag.IntVar(&maxManagedKeys, "max-managed-keys", 0, "Stop creating deploy keys once the controller manages this many, as a circuit breaker against a creation loop. 0 doesn't limit them.")
+	flag.BoolVar(&populateKnownHosts, "populate-known-hosts", false, "Write the known hosts of the gitlab SSH host into the known_hosts key of the secrets that don't have one once their deploy key is created.")
+	flag.StringVar(&knownHostsAddress, "known-hosts-addr", "", "The host:port to fetch the SSH host keys of with -populate-known-hosts. Defaults to port 22 of -git-ssh-host.")
+	flag.StringVar(&deployKeyTitle, "deploy-key-title", defaultDeployKeyTitle, "The title of the deploy keys of the secrets without a fluxcd.io/deploy-key-title annotation nor a namespace default.")
+	flag.BoolVar(&deployKeyCanPush, "deploy-key-can-push", true, "Whether the deploy keys of the secrets without a fluxcd.io/deploy-key-can-push annotation nor a namespace default can push.")
+	flag.StringVar(&defaultsConfigMap, "defaults-configmap", "", "The namespace/name of a ConfigMap mapping namespaces to the default title template and push permission of the deploy keys of their secrets, watched for changes.")
+	flag.StringVar(&projectAllowlistFlag, "project-allowlist", "", "A comma separated list of the gitlab project paths, or path.Match patterns such as group/*, the controller is allowed to manage deploy keys of. All projects are allowed when neither this nor -project-allowlist-file is set.")
+	flag.StringVar(&projectAllowlistFile, "project-allowlist-file", "", "A file listing, one per line, more project paths or patterns for -project-allowlist.")
+	flag.IntVar(&reconcileLogLevel, "reconcile-log-level", 0, "The verbosity of the controller's own reconcile logs, independently of -v, e.g. 4 for detailed reconcile traces without the verbose client-go logs.")
+	flag.StringVar(&reconcileToken, "reconcile-token", "", "The bearer token of the POST /reconcile?namespace=&name= endpoint on the metrics address, which enqueues a secret. The endpoint is disabled when unset.")
+	flag.StringVar(&multiIdentityPrefix, "multi-identity-prefix", "", "The prefix of the data keys of secrets holding several identities, e.g. \"identity-\": each identity-<suffix> gets a deploy key in the project of its fluxcd.io/git-url-<suffix> annotation.")
+	flag.StringVar(&gitURLFromName, "git-url-from-name", "", "A Go template deriving the gitlab project path from the .Namespace and .Name of the secrets without a git url annotation, e.g. \"{{.Namespace}}/{{.Name}}\".")
+	flag.StringVar(&fieldManager, "field-manager", controllerAgentName, "The field manager the controller applies its annotations to the secrets under.")
+	flag.IntVar(&deletionWorkers, "deletion-workers", 1, "The number of workers deleting the deploy keys of deleted secrets, apart from the workers creating them, so deletions never hold up creations.")
+	flag.IntVar(&maxDeletionsPerMinute, "max-deletions-per-minute", 0, "The maximum number of deploy keys deleted per minute, further deletions are delayed. 0 doesn't limit deletions.")
+	flag.IntVar(&deletionHaltThreshold, "deletion-halt-threshold", 0, "Halt all deploy key deletions until the controller is restarted once this many were deleted within -deletion-halt-window. 0 never halts.")
+	flag.DurationVar(&deletionHaltWindow, "deletion-halt-window", 10*time.Minute, "The window over which deletions are counted for -deletion-halt-threshold.")
+	flag.BoolVar(&noDelete, "no-delete", false, "Never delete deploy keys from gitlab, only log and record an event for the keys of deleted secrets, or the keys that would be recreated.")
+	flag.StringVar(&diagnoseSecret, "diagnose", "", "Check the configuration of the secret namespace/name without changing anything, print a report and exit.")
+	flag.DurationVar(&max429Backoff, "max-429-backoff", 10*time.Minute, "The longest a secret waits before being retried after gitlab rate limited it, whatever gitlab asks for.")
+	flag.BoolVar(&useManager, "controller-runtime", false, "Run the controller as a controller-runtime manager, which uses a finalizer to delete deploy keys and supports leader election.")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "Enable leader election, only with -controller-runtime.")
+	flag.StringVar(&namespacePattern, "namespace-pattern", "", "A regular expression the namespace of a secret must match for the controller to act on it, e.g. ^tenant-.")
+	flag.IntVar(&shardIndex, "shard-index", 0, "The shard of secrets processed by this instance, between 0 and shard-count - 1.")
+	flag.IntVar(&shardCount, "shard-count", 1, "The number of instances secrets are sharded across.")
+	flag.StringVar(&gitlabTokenFile, "gitlab-token-file", "", "Path to a file holding the gitlab API token, reloaded when gitlab rejects it. Takes precedence over -gitlab-token.")
+	flag.Var(headerFlag(gitlabHeaders), "gitlab-header", "An extra key=value header sent with every gitlab API request, e.g. for an authenticating proxy. Can be repeated.")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metrics endpoint binds to. Use 0 for a random port or an empty value to disable it.")
+	flag.StringVar(&healthAddr, "health-addr", ":8081", "The address the health endpoint binds to. Use 0 for a random port or an empty value to disable it.")
 
 	if len(gitlabToken) == 0 {
 		gitlabToken = os.Getenv("GITLAB_TOKEN")
@@ -0,0 +1,49 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadProjectAllowlist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "allowlist")
+	if err := ioutil.WriteFile(file, []byte("# platform projects\n/platform/*/\n\ngroup/app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, err := readProjectAllowlist(" infra/flux , ,", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"infra/flux", "platform/*", "group/app"}; !reflect.DeepEqual(patterns, want) {
+		t.Errorf("patterns = %q, want %q", patterns, want)
+	}
+
+	if _, err := readProjectAllowlist("group/[app", ""); err == nil {
+		t.Errorf("an invalid pattern didn't fail")
+	}
+	if _, err := readProjectAllowlist("", filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("a missing file didn't fail")
+	}
+	if patterns, err := readProjectAllowlist("", ""); err != nil || len(patterns) != 0 {
+		t.Errorf("empty allowlist = %q, %v, want none", patterns, err)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	goerrors "errors"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// deployKeyFinalizer holds the deletion of Secrets until their deploy key is
+// deleted. The manager needs it because, unlike the informer delete events,
+// it doesn't hand over the final state of deleted Secrets.
+const deployKeyFinalizer = "fluxcd.io/gitlab-deploy-key"
+
+// secretReconciler is a controller-runtime reconciler wrapping the sync
+// logic of the Controller
+type secretReconciler struct {
+	client     client.Client
+	controller *Controller
+}
+
+// Reconcile syncs the Secret named by req, deleting its deploy key once the
+// Secret is being deleted.
+func (r *secretReconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
+	ctx := context.Background()
+	if reconcileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, reconcileTimeout)
+		defer cancel()
+	}
+
+	secret := &corev1.Secret{}
+	err := r.client.Get(ctx, req.NamespacedName, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+	found := err == nil
+
+	if deleted, ok := r.controller.pending.get(req.NamespacedName.String()); ok && (!found || deleted.UID != secret.UID) {
+		// The deploy key of the Secret deleted under this name waits for
+		// the grace period, a Secret recreated meanwhile is reconciled once
+		// it's over
+		if err := r.controller.deleteDeployKey(ctx, deleted); err != nil {
+			return r.result(deleted, err)
+		}
+	}
+	if !found {
+		return reconcile.Result{}, nil
+	}
+
+	if secret.DeletionTimestamp != nil {
+		if !hasFinalizer(secret, deployKeyFinalizer) {
+			return reconcile.Result{}, nil
+		}
+		err := r.controller.deleteDeployKey(ctx, secret)
+		var graced *deletionGraced
+		if goerrors.As(err, &graced) {
+			// The pending deletion is tracked in memory, release the Secret
+			// so it can be recreated within the grace period
+			controllerutil.RemoveFinalizer(secret, deployKeyFinalizer)
+			return reconcile.Result{RequeueAfter: graced.after}, r.client.Update(ctx, secret)
+		}
+		if err != nil {
+			return r.result(secret, err)
+		}
+		controllerutil.RemoveFinalizer(secret, deployKeyFinalizer)
+		return reconcile.Result{}, r.client.Update(ctx, secret)
+	}
+
+	if _, found := gitURL(secret); (found || len(identityPairs(secret)) > 0 || r.controller.dynamicClient != nil && gitRepositoryOwner(secret) != nil) && !hasFinalizer(secret, deployKeyFinalizer) {
+		// The update triggers another reconcile, which creates the key
+		controllerutil.AddFinalizer(secret, deployKeyFinalizer)
+		return reconcile.Result{}, r.client.Update(ctx, secret)
+	}
+
+	return r.result(secret, r.controller.syncSecret(ctx, secret))
+}
+
+// result turns the outcome of a sync into a reconcile result, with the same
+// backoff as the workqueue loop
+func (r *secretReconciler) result(secret *corev1.Secret, err error) (reconcile.Result, error) {
+	if err == nil {
+		secretSyncs.WithLabelValues(r.controller.clusterLabel(), "success").Inc()
+		r.controller.markSynced(secret)
+		r.controller.throttle.reset()
+		lastSuccessfulSync.SetToCurrentTime()
+		if after, ok := r.controller.verifyRequeue(secret); ok {
+			return reconcile.Result{RequeueAfter: after}, nil
+		}
+		return reconcile.Result{}, nil
+	}
+	source := errorSource(err)
+	secretSyncs.WithLabelValues(r.controller.clusterLabel(), "error").Inc()
+	syncErrors.WithLabelValues(r.controller.clusterLabel(), source).Inc()
+	if after, ok := r.controller.backoff(secret, err); ok {
+		klog.Errorf("%s error syncing '%s/%s': %s, requeuing in %s", source, secret.Namespace, secret.Name, err.Error(), after)
+		return reconcile.Result{RequeueAfter: after}, nil
+	}
+	return reconcile.Result{}, err
+}
+
+// hasFinalizer reports whether the object has the finalizer
+func hasFinalizer(object metav1.Object, finalizer string) bool {
+	for _, f := range object.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// managedSecrets filters the Secrets the manager reconciles the same way as
+// the informer label selector and handleObject do, skipping no-op updates
+func managedSecrets() predicate.Predicate {
+	managed := func(object metav1.Object) bool {
+		return hasMarkerLabel(object) && inNamespaceScope(object) && hasNamePrefix(object) && inShard(object)
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool { return managed(e.Meta) },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return managed(e.MetaNew) && materialChange(e.ObjectOld, e.ObjectNew)
+		},
+		DeleteFunc:  func(e event.DeleteEvent) bool { return managed(e.Meta) },
+		GenericFunc: func(e event.GenericEvent) bool { return managed(e.Meta) },
+	}
+}
+
+// managerAddr converts a bind address flag to the controller-runtime
+// convention, where "0" disables the server rather than an empty value
+func managerAddr(addr string) string {
+	switch addr {
+	case "":
+		return "0"
+	case "0":
+		return ":0"
+	}
+	return addr
+}
+
+// runManager runs the controller as a controller-runtime manager, which
+// brings leader election along, until stopCh is closed.
+func runManager(cfg *rest.Config, threadiness int, stopCh <-chan struct{}) error {
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:                 runtime.NewScheme(),
+		MetricsBindAddress:     managerAddr(metricsAddr),
+		HealthProbeBindAddress: managerAddr(healthAddr),
+		LeaderElection:         leaderElect,
+		LeaderElectionID:       controllerAgentName,
+	})
+	if err != nil {
+		return err
+	}
+	if err = corev1.AddToScheme(mgr.GetScheme()); err != nil {
+		return err
+	}
+	if err = mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		return err
+	}
+	ctrlmetrics.Registry.MustRegister(lastSuccessfulSync, paused, deletionsHalted, deployKeysCreated, deployKeysAdopted, skippedSecrets, keyLimitReached, gitlabRequests, gitlabResponses, gitlabRequestsPerSync, droppedEvents, secretSyncs, reconcileTimeouts, deadLettered, suppressedEvents, orphanedDeployKeys, syncErrors)
+
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+	dynamicClient, err := newOwnerClient(cfg)
+	if err != nil {
+		return err
+	}
+	tokens := newTokenTransport(gitlabToken, gitlabTransport())
+	gitlabClient, err := newGitlabClient(tokens)
+	if err != nil {
+		return err
+	}
+	c := &Controller{
+		kubeclientset:   kubeClient,
+		gitlabClient:    gitlabClient,
+		gitlabToken:     tokens,
+		dynamicClient:   dynamicClient,
+		projects:        &projectLocks{},
+		missingProjects: newMissingProjects(),
+		recorder:        newAsyncRecorder(newDedupRecorder(decisionRecorder{EventRecorder: mgr.GetEventRecorderFor(controllerAgentName)})),
+	}
+
+	list := func() ([]*corev1.Secret, error) {
+		var secrets corev1.SecretList
+		if err := mgr.GetClient().List(context.TODO(), &secrets, client.HasLabels{fluxSecretLabelFilter}); err != nil {
+			return nil, err
+		}
+		items := make([]*corev1.Secret, len(secrets.Items))
+		for i := range secrets.Items {
+			items[i] = &secrets.Items[i]
+		}
+		return items, nil
+	}
+	c.list = list
+
+	if err = mgr.GetFieldIndexer().IndexField(context.TODO(), &corev1.Secret{}, projectPathIndex, projectPaths); err != nil {
+		return err
+	}
+	c.forProject = func(path string) ([]*corev1.Secret, error) {
+		var secrets corev1.SecretList
+		if err := mgr.GetClient().List(context.TODO(), &secrets, client.MatchingFields{projectPathIndex: path}); err != nil {
+			return nil, err
+		}
+		items := make([]*corev1.Secret, len(secrets.Items))
+		for i := range secrets.Items {
+			items[i] = &secrets.Items[i]
+		}
+		return items, nil
+	}
+	if serveConfig {
+		if err = mgr.AddMetricsExtraHandler("/config", configHandler()); err != nil {
+			return err
+		}
+	}
+	if err = mgr.AddMetricsExtraHandler("/inventory", c.inventoryHandler(list)); err != nil {
+		return err
+	}
+
+	err = ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Secret{}).
+		WithEventFilter(managedSecrets()).
+		WithOptions(controller.Options{MaxConcurrentReconciles: threadiness}).
+		Complete(&secretReconciler{client: mgr.GetClient(), controller: c})
+	if err != nil {
+		return err
+	}
+
+	if orphanScanInterval > 0 {
+		err = mgr.Add(manager.RunnableFunc(func(stopCh <-chan struct{}) error {
+			c.runOrphanScan(stopCh)
+			return nil
+		}))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = waitForDefaults(kubeClient, stopCh); err != nil {
+		return err
+	}
+
+	klog.Info("Starting Secret controller manager")
+	return mgr.Start(stopCh)
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "flux_gitlab_controller"
+
+var (
+	// lastSuccessfulSync is the unix time of the last successful sync of a
+	// Secret, alert on time() - lastSuccessfulSync to catch a stuck controller
+	lastSuccessfulSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last successful sync of a secret.",
+	})
+
+	// paused is 1 while the workers are paused because gitlab keeps rate
+	// limiting the controller
+	paused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "paused",
+		Help:      "Whether the workers are paused because gitlab keeps rate limiting the controller.",
+	})
+
+	// deletionsHalted is 1 once the deletion guard halted the deploy key
+	// deletions
+	deletionsHalted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "deletions_halted",
+		Help:      "Whether the deploy key deletions were halted because too many happened within -deletion-halt-window.",
+	})
+
+	// deployKeysCreated counts the deploy keys created in gitlab
+	deployKeysCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "deploy_keys_created_total",
+		Help:      "Number of deploy keys created in gitlab.",
+	})
+
+	// deployKeysAdopted counts the deploy keys already in gitlab that were
+	// adopted rather than created
+	deployKeysAdopted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "deploy_keys_adopted_total",
+		Help:      "Number of deploy keys already in gitlab adopted instead of being created.",
+	})
+
+	// skippedSecrets counts the syncs of secrets skipped because of missing or
+	// invalid configuration, by reason: missing_git_url, missing_identity,
+	// parse_error, skip_annotation or project_not_allowed
+	skippedSecrets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "skipped_secrets_total",
+		Help:      "Number of secret syncs skipped because of missing or invalid configuration, by reason.",
+	}, []string{"reason"})
+
+	// keyLimitReached is 1 while no key is created because the controller
+	// manages -max-managed-keys keys
+	keyLimitReached = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "key_limit_reached",
+		Help:      "Whether new deploy keys aren't created because the controller manages -max-managed-keys keys.",
+	})
+
+	// gitlabRequests counts the gitlab API requests by operation, such as
+	// "POST projects/:id/deploy_keys"
+	gitlabRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_requests_total",
+		Help:      "Number of gitlab API requests by operation.",
+	}, []string{"operation"})
+
+	// gitlabResponses counts the gitlab API responses by operation and status
+	// code, the unusual codes being counted by class, e.g. "5xx", and the
+	// requests that got no response as "error"
+	gitlabResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_responses_total",
+		Help:      "Number of gitlab API responses by operation and status code.",
+	}, []string{"operation", "code"})
+
+	// gitlabRequestsPerSync is the number of gitlab API requests made by the
+	// syncs that made any
+	gitlabRequestsPerSync = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_requests_per_sync",
+		Help:      "Number of gitlab API requests made by a secret sync, for the syncs that made any.",
+		Buckets:   []float64{1, 2, 3, 4, 5, 7, 10, 20},
+	})
+
+	// droppedEvents counts the events dropped because the event queue was
+	// full, usually while the API server doesn't take them
+	droppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dropped_events_total",
+		Help:      "Number of events dropped because the event queue was full.",
+	})
+
+	// suppressedEvents counts the duplicate events suppressed within
+	// -event-dedup-window
+	suppressedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "suppressed_events_total",
+		Help:      "Number of duplicate events suppressed within the event dedup window.",
+	})
+
+	// orphanedDeployKeys is the number of deploy keys by project found with
+	// the controller's title but recorded by no Secret on the last scan
+	orphanedDeployKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_deploy_keys",
+		Help:      "Number of deploy keys with the controller's title that no secret records, by project, as of the last orphan scan.",
+	}, []string{"project"})
+
+	// reconcileTimeouts counts the syncs that outlasted -reconcile-timeout
+	reconcileTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconcile_timeouts_total",
+		Help:      "Number of secret syncs that outlasted the reconcile timeout.",
+	})
+
+	// deadLettered counts the secrets not retried anymore after timing out
+	// too many times in a row
+	deadLettered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dead_lettered_secrets_total",
+		Help:      "Number of secrets not retried anymore after their syncs timed out too many times in a row.",
+	})
+
+	// secretSyncs counts the syncs of secrets by cluster, local or one of
+	// -remote-kubeconfigs, and result: success or error
+	secretSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_syncs_total",
+		Help:      "Number of secret syncs by cluster and result.",
+	}, []string{"cluster", "result"})
+
+	// syncErrors counts the failed syncs of secrets by cluster and source of
+	// the error: kubernetes, gitlab or controller
+	syncErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_errors_total",
+		Help:      "Number of failed secret syncs by cluster and source of the error.",
+	}, []string{"cluster", "source"})
+)
+
+func init() {
+	prometheus.MustRegister(lastSuccessfulSync, paused, deletionsHalted, deployKeysCreated, deployKeysAdopted, skippedSecrets, keyLimitReached, gitlabRequests, gitlabResponses, gitlabRequestsPerSync, droppedEvents, secretSyncs, reconcileTimeouts, deadLettered, suppressedEvents, orphanedDeployKeys, syncErrors)
+}
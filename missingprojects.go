@@ -0,0 +1,58 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+// missingProjectsSize is the number of missing projects remembered
+const missingProjectsSize = 1024
+
+// missingProjects remembers for -project-negative-cache-ttl the project
+// paths gitlab found no project for, with the error it answered, so a
+// deleted or misspelled project isn't looked up again on every sync while a
+// project created later is still picked up. Found projects need no such
+// cache, their id is recorded in the secret.
+type missingProjects struct {
+	missing *cache.LRUExpireCache
+}
+
+// newMissingProjects returns an empty cache of missing projects
+func newMissingProjects() *missingProjects {
+	return &missingProjects{missing: cache.NewLRUExpireCache(missingProjectsSize)}
+}
+
+// get returns the error gitlab answered for the project path, if it was
+// missing within the TTL
+func (m *missingProjects) get(path string) (error, bool) {
+	if projectNegativeCacheTTL <= 0 {
+		return nil, false
+	}
+	err, ok := m.missing.Get(normalizeProjectPath(path))
+	if !ok {
+		return nil, false
+	}
+	return err.(error), true
+}
+
+// add remembers that gitlab answered err for the project path
+func (m *missingProjects) add(path string, err error) {
+	if projectNegativeCacheTTL > 0 {
+		m.missing.Add(normalizeProjectPath(path), err, projectNegativeCacheTTL)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMissingProjects(t *testing.T) {
+	defer func(ttl time.Duration) { projectNegativeCacheTTL = ttl }(projectNegativeCacheTTL)
+	projectNegativeCacheTTL = time.Minute
+
+	missing := newMissingProjects()
+	notFound := errors.New("404 Project Not Found")
+	missing.add("/Group/App", notFound)
+	if err, ok := missing.get("group/app"); !ok || err != notFound {
+		t.Errorf("get = %v, %v, want the error of the missing project", err, ok)
+	}
+	if _, ok := missing.get("group/other"); ok {
+		t.Errorf("another project is missing")
+	}
+
+	projectNegativeCacheTTL = 0
+	if _, ok := missing.get("group/app"); ok {
+		t.Errorf("a project is missing with -project-negative-cache-ttl disabled")
+	}
+	missing.add("group/other", notFound)
+	projectNegativeCacheTTL = time.Minute
+	if _, ok := missing.get("group/other"); ok {
+		t.Errorf("a missing project was remembered with -project-negative-cache-ttl disabled")
+	}
+}
+
+func TestLookupMissingProject(t *testing.T) {
+	defer func(ttl time.Duration) { projectNegativeCacheTTL = ttl }(projectNegativeCacheTTL)
+	projectNegativeCacheTTL = time.Minute
+
+	gl := newFakeGitlab()
+	gl.project.PathWithNamespace = "group/other"
+	s := newTestSync(t, gl)
+	secret := fluxSecret()
+	first, err := s.lookupProject(context.Background(), secret)
+	if err == nil {
+		t.Fatalf("lookupProject of a missing project = %+v, want an error", first)
+	}
+	requests := len(gl.requested())
+	if _, err2 := s.lookupProject(context.Background(), secret); err2 == nil || err2.Error() != err.Error() {
+		t.Errorf("lookupProject = %v, want the cached %v", err2, err)
+	}
+	if got := len(gl.requested()); got != requests {
+		t.Errorf("the missing project was looked up again, requests %v", gl.requested())
+	}
+
+	// The cache is shared by the controllers of every cluster
+	remote := newTestSync(t, gl)
+	remote.missingProjects = s.missingProjects
+	remote.lookupProject(context.Background(), secret)
+	if got := len(gl.requested()); got != requests {
+		t.Errorf("the missing project was looked up again by another controller, requests %v", gl.requested())
+	}
+}
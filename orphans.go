@@ -0,0 +1,148 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// orphanedKey is a deploy key with the controller's title that no Secret
+// records
+type orphanedKey struct {
+	project string
+	id      int
+	title   string
+}
+
+// orphanScan is a project findOrphanedKeys looks at, along with the deploy
+// keys the Secrets record in it
+type orphanScan struct {
+	pid   interface{}
+	path  string
+	owned map[int]bool
+}
+
+// findOrphanedKeys returns the deploy keys titled with -deploy-key-title in
+// the projects of the Secrets that no Secret records, be it of the local or a
+// remote cluster. Only the projects some Secret still records are looked at.
+// The keys of the identity pairs and the key retired by a rotation in
+// progress are recorded too.
+func (c *Controller) findOrphanedKeys(ctx context.Context) ([]orphanedKey, error) {
+	var secrets []*corev1.Secret
+	for _, controller := range append([]*Controller{c}, c.remotes...) {
+		listed, err := controller.list()
+		if err != nil {
+			return nil, err
+		}
+		for _, secret := range listed {
+			secrets = append(secrets, controller.state.overlay(secret))
+		}
+	}
+	// The projects are compared by path, the identity pairs only record
+	// theirs, and looked up by id when a Secret recorded it
+	projects := map[string]*orphanScan{}
+	scan := func(path string, pid interface{}) *orphanScan {
+		project, ok := projects[normalizeProjectPath(path)]
+		if !ok {
+			project = &orphanScan{pid: pid, path: path, owned: map[int]bool{}}
+			projects[normalizeProjectPath(path)] = project
+		}
+		if _, ok := pid.(int); ok {
+			project.pid = pid
+		}
+		return project
+	}
+	for _, secret := range secrets {
+		if projectID, err := strconv.Atoi(secret.Annotations[projectIdLabelName]); err == nil {
+			path := secret.Annotations[projectPathLabelName]
+			if path == "" {
+				path = projectPath(secret)
+			}
+			project := scan(path, projectID)
+			for _, annotation := range []string{deployKeyLabelName, retiredKeyLabelName} {
+				if deployKey, err := strconv.Atoi(secret.Annotations[annotation]); err == nil {
+					project.owned[deployKey] = true
+				}
+			}
+		}
+		keys, err := pairDeployKeys(secret)
+		if err != nil {
+			continue
+		}
+		for _, pair := range identityPairs(secret) {
+			if deployKey, ok := keys[pair.suffix]; ok {
+				scan(pair.project(), projectIDOrPath(pair.project())).owned[deployKey] = true
+			}
+		}
+	}
+
+	var orphans []orphanedKey
+	for _, project := range projects {
+		err := c.forEachDeployKey(ctx, project.pid, func(key *gitlab.DeployKey) bool {
+			if strings.HasPrefix(key.Title, deployKeyTitle) && !project.owned[key.ID] {
+				orphans = append(orphans, orphanedKey{project: project.path, id: key.ID, title: key.Title})
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return orphans, nil
+}
+
+// reportOrphanedKeys logs the orphaned deploy keys and counts them by project
+// in flux_gitlab_controller_orphaned_deploy_keys. They are only reported, it's
+// up to the operators to review and remove them.
+func (c *Controller) reportOrphanedKeys() {
+	ctx, cancel := context.WithTimeout(context.Background(), orphanScanInterval)
+	defer cancel()
+
+	orphans, err := c.findOrphanedKeys(ctx)
+	if err != nil {
+		klog.Warningf("Failed to look for orphaned deploy keys: %s", err.Error())
+		return
+	}
+	orphanedDeployKeys.Reset()
+	for _, orphan := range orphans {
+		klog.Infof("Deploy key %d %q of project %s is orphaned, no secret records it", orphan.id, orphan.title, orphan.project)
+		orphanedDeployKeys.WithLabelValues(orphan.project).Inc()
+	}
+	klog.Infof("Found %d orphaned deploy keys", len(orphans))
+}
+
+// runOrphanScan reports the orphaned deploy keys every -orphan-scan-interval
+// until stopCh is closed
+func (c *Controller) runOrphanScan(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(orphanScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.reportOrphanedKeys()
+		case <-stopCh:
+			return
+		}
+	}
+}
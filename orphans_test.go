@@ -0,0 +1,117 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/xanzy/go-gitlab"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestFindOrphanedKeys(t *testing.T) {
+	defer func(interval time.Duration) { orphanScanInterval = interval }(orphanScanInterval)
+	orphanScanInterval = time.Minute
+
+	gl := newFakeGitlab()
+	for _, title := range []string{deployKeyTitle, deployKeyTitle + " #1", "added by hand", deployKeyTitle} {
+		gl.addKey(&gitlab.DeployKey{Title: title})
+	}
+	local := fluxSecret()
+	local.Annotations[projectIdLabelName] = "10"
+	local.Annotations[projectPathLabelName] = "group/app"
+	remote := local.DeepCopy()
+	remote.Annotations[deployKeyLabelName] = "4"
+	// A secret not synced yet has no project to look at
+	unsynced := unannotatedSecret()
+	unsynced.Name = "unsynced"
+
+	s := newTestSync(t, gl, local, unsynced)
+	s.remotes = []*Controller{{list: func() ([]*corev1.Secret, error) { return []*corev1.Secret{remote}, nil }}}
+	orphans, err := s.findOrphanedKeys(context.Background())
+	if err != nil {
+		t.Fatalf("findOrphanedKeys: %s", err.Error())
+	}
+	want := []orphanedKey{{project: "group/app", id: 2, title: deployKeyTitle + " #1"}}
+	if !reflect.DeepEqual(orphans, want) {
+		t.Errorf("orphans = %+v, want %+v", orphans, want)
+	}
+
+	orphanedDeployKeys.WithLabelValues("group/gone").Set(3)
+	s.reportOrphanedKeys()
+	if got := testutil.ToFloat64(orphanedDeployKeys.WithLabelValues("group/app")); got != 1 {
+		t.Errorf("orphaned deploy keys of group/app = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(orphanedDeployKeys); got != 1 {
+		t.Errorf("%d projects with orphaned deploy keys, want the ones of the last scan only", got)
+	}
+}
+
+// orphansOf returns the orphaned keys of the fake gitlab with deploy keys 1
+// and 2 titled with -deploy-key-title, given the secrets
+func orphansOf(t *testing.T, secrets ...*corev1.Secret) []orphanedKey {
+	t.Helper()
+	gl := newFakeGitlab()
+	gl.addKey(&gitlab.DeployKey{Title: deployKeyTitle})
+	gl.addKey(&gitlab.DeployKey{Title: deployKeyTitle + " #1"})
+	orphans, err := newTestSync(t, gl, secrets...).findOrphanedKeys(context.Background())
+	if err != nil {
+		t.Fatalf("findOrphanedKeys: %s", err.Error())
+	}
+	return orphans
+}
+
+func TestFindOrphanedKeysIdentityPairs(t *testing.T) {
+	defer func(interval time.Duration) { orphanScanInterval = interval }(orphanScanInterval)
+	orphanScanInterval = time.Minute
+
+	secret := fluxSecret()
+	secret.Annotations[projectIdLabelName] = "10"
+	secret.Annotations[projectPathLabelName] = "group/app"
+	// The other environment is recorded in the same project by path
+	paired := identitySecret(t)
+	paired.Name = "paired"
+	paired.Annotations[environmentsLabelName] = `{"prod": "Group/App"}`
+	paired.Annotations[deployKeyIdsLabelName] = `{"prod": 2}`
+	if orphans := orphansOf(t, secret, paired); len(orphans) != 0 {
+		t.Errorf("orphans = %+v, want the key of the identity pair recorded", orphans)
+	}
+	// The project of the identity pairs is looked at too
+	paired.Annotations[environmentsLabelName] = `{"prod": "group/app"}`
+	if orphans := orphansOf(t, paired); !reflect.DeepEqual(orphans, []orphanedKey{{project: "group/app", id: 1, title: deployKeyTitle}}) {
+		t.Errorf("orphans = %+v, want key 1 of the project of the identity pair", orphans)
+	}
+}
+
+func TestFindOrphanedKeysRetiredKey(t *testing.T) {
+	defer func(interval time.Duration) { orphanScanInterval = interval }(orphanScanInterval)
+	orphanScanInterval = time.Minute
+
+	// The rotation retired key 1 but didn't delete it yet
+	secret := fluxSecret()
+	secret.Annotations[deployKeyLabelName] = "2"
+	secret.Annotations[retiredKeyLabelName] = "1"
+	secret.Annotations[projectIdLabelName] = "10"
+	secret.Annotations[projectPathLabelName] = "group/app"
+	if orphans := orphansOf(t, secret); len(orphans) != 0 {
+		t.Errorf("orphans = %+v, want the retired key recorded", orphans)
+	}
+}
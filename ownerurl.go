@@ -0,0 +1,96 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+const (
+	// gitRepositoryGroup and gitRepositoryKind identify the flux v2
+	// GitRepository owning a secret
+	gitRepositoryGroup = "source.toolkit.fluxcd.io"
+	gitRepositoryKind  = "GitRepository"
+)
+
+// newOwnerClient returns the client getting the GitRepositories owning the
+// secrets with -git-url-from-owner, nil otherwise
+func newOwnerClient(cfg *rest.Config) (dynamic.Interface, error) {
+	if !gitURLFromOwner {
+		return nil, nil
+	}
+	return dynamic.NewForConfig(cfg)
+}
+
+// gitRepositoryOwner returns the owner reference of the secret to a flux
+// GitRepository, nil when it has none
+func gitRepositoryOwner(secret *corev1.Secret) *metav1.OwnerReference {
+	for i, owner := range secret.OwnerReferences {
+		gv, err := schema.ParseGroupVersion(owner.APIVersion)
+		if err == nil && gv.Group == gitRepositoryGroup && owner.Kind == gitRepositoryKind {
+			return &secret.OwnerReferences[i]
+		}
+	}
+	return nil
+}
+
+// withOwnerGitURL returns the secret with its git url annotation set to the
+// url of the flux GitRepository owning it with -git-url-from-owner, so the
+// GitRepository stays the source of truth of the url. The secret is returned
+// as is when it has no such owner or it's gone.
+func (c *Controller) withOwnerGitURL(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+	if c.dynamicClient == nil {
+		return secret, nil
+	}
+	owner := gitRepositoryOwner(secret)
+	if owner == nil {
+		return secret, nil
+	}
+
+	gv, _ := schema.ParseGroupVersion(owner.APIVersion)
+	resource := gv.WithResource("gitrepositories")
+	repository, err := c.dynamicClient.Resource(resource).Namespace(secret.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		klog.Warningf("GitRepository %s owning secret %s/%s doesn't exist, using the secret annotations", owner.Name, secret.Namespace, secret.Name)
+		return secret, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GitRepository %s: %s", owner.Name, err.Error())
+	}
+	url, found, err := unstructured.NestedString(repository.Object, "spec", "url")
+	if err != nil || !found || url == "" {
+		klog.Warningf("GitRepository %s owning secret %s/%s has no url, using the secret annotations", owner.Name, secret.Namespace, secret.Name)
+		return secret, nil
+	}
+
+	secret = secret.DeepCopy()
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[gitUrlLabelName] = url
+	return secret, nil
+}
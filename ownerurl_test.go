@@ -0,0 +1,84 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// gitRepository returns a flux GitRepository of the flux namespace with the
+// url
+func gitRepository(name, url string) *unstructured.Unstructured {
+	repository := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": gitRepositoryGroup + "/v1beta1",
+		"kind":       gitRepositoryKind,
+		"metadata":   map[string]interface{}{"namespace": "flux", "name": name},
+	}}
+	if url != "" {
+		unstructured.SetNestedField(repository.Object, url, "spec", "url")
+	}
+	return repository
+}
+
+func TestWithOwnerGitURL(t *testing.T) {
+	url := fmt.Sprintf("ssh://git@%s/group/owner.git", gitSSHHost)
+	c := &Controller{dynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), gitRepository("app", url), gitRepository("empty", ""))}
+
+	tests := []struct {
+		name  string
+		owner *metav1.OwnerReference
+		want  string
+	}{
+		{"owned", &metav1.OwnerReference{APIVersion: gitRepositoryGroup + "/v1beta1", Kind: gitRepositoryKind, Name: "app"}, url},
+		{"not owned", nil, fluxSecret().Annotations[gitUrlLabelName]},
+		{"other kind", &metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "app"}, fluxSecret().Annotations[gitUrlLabelName]},
+		{"owner gone", &metav1.OwnerReference{APIVersion: gitRepositoryGroup + "/v1beta1", Kind: gitRepositoryKind, Name: "gone"}, fluxSecret().Annotations[gitUrlLabelName]},
+		{"owner without url", &metav1.OwnerReference{APIVersion: gitRepositoryGroup + "/v1beta1", Kind: gitRepositoryKind, Name: "empty"}, fluxSecret().Annotations[gitUrlLabelName]},
+	}
+	for _, test := range tests {
+		secret := fluxSecret()
+		if test.owner != nil {
+			secret.OwnerReferences = []metav1.OwnerReference{*test.owner}
+		}
+		got, err := c.withOwnerGitURL(context.Background(), secret)
+		if err != nil {
+			t.Fatalf("%s: withOwnerGitURL: %s", test.name, err.Error())
+		}
+		if got.Annotations[gitUrlLabelName] != test.want {
+			t.Errorf("%s: git url = %q, want %q", test.name, got.Annotations[gitUrlLabelName], test.want)
+		}
+	}
+
+	secret := fluxSecret()
+	secret.OwnerReferences = []metav1.OwnerReference{*tests[0].owner}
+	secret, _ = c.withOwnerGitURL(context.Background(), secret)
+	if path := projectPath(secret); path != "group/owner" {
+		t.Errorf("project path of the owner url = %q, want group/owner", path)
+	}
+
+	// Without -git-url-from-owner the annotation is used
+	if got, _ := (&Controller{}).withOwnerGitURL(context.Background(), secret); got != secret {
+		t.Errorf("the secret was changed without a dynamic client")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// defaultPollInterval is how often the Secrets are listed when watching them
+// is denied and -poll-interval isn't set
+const defaultPollInterval = time.Minute
+
+// pollWatcher stands in for the watch of the Secrets when they're polled. It
+// ends after the poll interval with an expired error, so the informer lists
+// the Secrets again and reports the changes since the last list as events.
+type pollWatcher struct {
+	result chan watch.Event
+	stopCh chan struct{}
+	once   sync.Once
+}
+
+// newPollWatcher returns a pollWatcher ending after interval
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	w := &pollWatcher{result: make(chan watch.Event), stopCh: make(chan struct{})}
+	go func() {
+		select {
+		case <-time.After(interval):
+		case <-w.stopCh:
+			return
+		}
+		expired := &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusGone,
+			Reason:  metav1.StatusReasonExpired,
+			Message: "polling the secrets again",
+		}
+		select {
+		case w.result <- watch.Event{Type: watch.Error, Object: expired}:
+		case <-w.stopCh:
+		}
+	}()
+	return w
+}
+
+func (w *pollWatcher) Stop() {
+	w.once.Do(func() { close(w.stopCh) })
+}
+
+func (w *pollWatcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+// secretListWatch lists and watches the Secrets with the flux label. It polls
+// them every -poll-interval instead of watching them when it's set, or when
+// watching them is denied, e.g. in clusters only granting list and get.
+func secretListWatch(client kubernetes.Interface) cache.ListerWatcher {
+	var denied int32
+	interval := pollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = fluxSecretLabelFilter
+			return client.CoreV1().Secrets(metav1.NamespaceAll).List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			if pollInterval > 0 || atomic.LoadInt32(&denied) == 1 {
+				return newPollWatcher(interval), nil
+			}
+			options.LabelSelector = fluxSecretLabelFilter
+			w, err := client.CoreV1().Secrets(metav1.NamespaceAll).Watch(context.TODO(), options)
+			if errors.IsForbidden(err) {
+				klog.Warningf("Watching secrets is denied, polling them every %s instead: %s", interval, err.Error())
+				atomic.StoreInt32(&denied, 1)
+				return newPollWatcher(interval), nil
+			}
+			return w, err
+		},
+	}
+}
+
+// newSecretInformer returns the informer of the Secrets with the flux label,
+// falling back to polling them when they can't be watched
+func newSecretInformer(client kubernetes.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(secretListWatch(client), &corev1.Secret{}, resyncPeriod, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestPollWatcher(t *testing.T) {
+	w := newPollWatcher(10 * time.Millisecond)
+	defer w.Stop()
+	select {
+	case event := <-w.ResultChan():
+		status, ok := event.Object.(*metav1.Status)
+		if event.Type != watch.Error || !ok || status.Reason != metav1.StatusReasonExpired {
+			t.Errorf("event = %+v, want an expired error", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the poll watcher didn't end")
+	}
+	w.Stop()
+}
+
+func TestSecretListWatchDenied(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = 0
+
+	client := fake.NewSimpleClientset()
+	watches := 0
+	client.PrependWatchReactor("secrets", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watches++
+		return true, nil, apierrors.NewForbidden(corev1.Resource("secrets"), "", nil)
+	})
+	lw := secretListWatch(client)
+	for i := 0; i < 2; i++ {
+		w, err := lw.Watch(metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("Watch = %s, want the secrets polled", err.Error())
+		}
+		if _, ok := w.(*pollWatcher); !ok {
+			t.Errorf("Watch = %T, want a poll watcher", w)
+		}
+		w.Stop()
+	}
+	if watches != 1 {
+		t.Errorf("watched the secrets %d times, want once until denied", watches)
+	}
+
+	// -poll-interval never watches them
+	pollInterval = time.Minute
+	watches = 0
+	w, err := secretListWatch(client).Watch(metav1.ListOptions{})
+	if err != nil || watches != 0 {
+		t.Errorf("Watch = %v, watched %d times, want the secrets polled", err, watches)
+	}
+	w.Stop()
+}
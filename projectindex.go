@@ -0,0 +1,111 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// projectPathIndex is the name of the index of the Secrets by the normalized
+// paths of the gitlab projects they reference
+const projectPathIndex = "projectPath"
+
+// projectFunc lists the Secrets referencing the gitlab project at a
+// normalized path
+type projectFunc func(path string) ([]*corev1.Secret, error)
+
+// normalizeProjectPath returns the path gitlab projects are indexed by,
+// gitlab paths being case insensitive
+func normalizeProjectPath(path string) string {
+	return strings.ToLower(strings.Trim(path, "/"))
+}
+
+// projectPaths returns the normalized paths of the gitlab projects the
+// Secret references, through its git url or its identity pairs
+func projectPaths(obj runtime.Object) []string {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return nil
+	}
+	var paths []string
+	if _, found := gitURL(secret); found {
+		paths = append(paths, normalizeProjectPath(projectPath(secret)))
+	}
+	for _, pair := range identityPairs(secret) {
+		paths = append(paths, normalizeProjectPath(pair.project()))
+	}
+	return paths
+}
+
+// indexByProjectPath is the informer index function of projectPathIndex
+func indexByProjectPath(obj interface{}) ([]string, error) {
+	object, ok := obj.(runtime.Object)
+	if !ok {
+		return nil, nil
+	}
+	return projectPaths(object), nil
+}
+
+// secretsByIndex lists the Secrets of the informer indexer referencing the
+// gitlab project at a normalized path
+func secretsByIndex(indexer cache.Indexer) projectFunc {
+	return func(path string) ([]*corev1.Secret, error) {
+		objs, err := indexer.ByIndex(projectPathIndex, path)
+		if err != nil {
+			return nil, err
+		}
+		secrets := make([]*corev1.Secret, 0, len(objs))
+		for _, obj := range objs {
+			if secret, ok := obj.(*corev1.Secret); ok {
+				secrets = append(secrets, secret)
+			}
+		}
+		return secrets, nil
+	}
+}
+
+// keyInUse reports whether another Secret records the deploy key with the
+// fingerprint in the project of the Secret. Failing to tell reports it in
+// use, which leaves the key in place.
+func (c *Controller) keyInUse(secret *corev1.Secret, keyFingerprint string) bool {
+	if c.forProject == nil {
+		return false
+	}
+	secrets, err := c.secretsForProject(projectPath(secret))
+	if err != nil {
+		return true
+	}
+	for _, other := range secrets {
+		if other.Namespace == secret.Namespace && other.Name == secret.Name {
+			continue
+		}
+		if c.state.overlay(other).Annotations[deployKeyFingerprintLabelName] == keyFingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// secretsForProject returns the Secrets referencing the gitlab project at
+// path, looked up in an index rather than by listing every Secret
+func (c *Controller) secretsForProject(path string) ([]*corev1.Secret, error) {
+	return c.forProject(normalizeProjectPath(path))
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestProjectIndex(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{projectPathIndex: indexByProjectPath})
+	secret := fluxSecret()
+	secret.Annotations[deployKeyFingerprintLabelName] = "SHA256:key"
+	shared := fluxSecret()
+	shared.Name = "shared"
+	shared.Annotations[gitUrlLabelName] = fmt.Sprintf("git@%s:Group/App.git", gitSSHHost)
+	other := fluxSecret()
+	other.Name = "other"
+	other.Annotations[gitUrlLabelName] = fmt.Sprintf("git@%s:group/other.git", gitSSHHost)
+	other.Annotations[deployKeyFingerprintLabelName] = "SHA256:other"
+	for _, s := range []interface{}{secret, shared, other} {
+		if err := indexer.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Controller{forProject: secretsByIndex(indexer)}
+	secrets, err := c.secretsForProject("/Group/App")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 {
+		t.Errorf("got %d secrets of group/app, want the 2 whatever the case of their path", len(secrets))
+	}
+
+	// The secret's own key isn't in use by another one
+	if c.keyInUse(secret, "SHA256:key") {
+		t.Errorf("the key only the secret records is in use")
+	}
+	shared.Annotations[deployKeyFingerprintLabelName] = "SHA256:key"
+	if !c.keyInUse(secret, "SHA256:key") {
+		t.Errorf("the key another secret of the project records isn't in use")
+	}
+	if c.keyInUse(other, "SHA256:key") {
+		t.Errorf("the key of another project is in use")
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+)
+
+// projectLocks serializes the syncs of the Secrets of the same gitlab
+// project, so two of them never look up, adopt or create its deploy keys at
+// the same time, while the Secrets of different projects are still synced in
+// parallel
+type projectLocks struct {
+	mu    sync.Mutex
+	locks map[string]*projectLock
+}
+
+// projectLock is the lock of a project along with the number of syncs
+// holding or waiting for it, so it's forgotten once none does
+type projectLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the project until the returned function is called
+func (p *projectLocks) lock(project string) func() {
+	project = normalizeProjectPath(project)
+
+	p.mu.Lock()
+	if p.locks == nil {
+		p.locks = map[string]*projectLock{}
+	}
+	l, ok := p.locks[project]
+	if !ok {
+		l = &projectLock{}
+		p.locks[project] = l
+	}
+	l.users++
+	p.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if l.users--; l.users == 0 {
+			delete(p.locks, project)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProjectLocks(t *testing.T) {
+	var p projectLocks
+	unlock := p.lock("group/app")
+
+	// Another project isn't held up
+	done := make(chan struct{})
+	go func() {
+		p.lock("group/other")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock of another project waited")
+	}
+
+	// The same project, whatever the case of its path, waits
+	locked := make(chan func())
+	go func() { locked <- p.lock("/Group/App") }()
+	select {
+	case <-locked:
+		t.Fatal("the project was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlock = <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the project wasn't locked once unlocked")
+	}
+	unlock()
+
+	if len(p.locks) != 0 {
+		t.Errorf("%d locks are kept once unlocked, want none", len(p.locks))
+	}
+}
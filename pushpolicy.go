@@ -0,0 +1,43 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "path"
+
+// pushPolicy holds the project path patterns of the -push-policy file, the
+// projects whose deploy keys can push
+var pushPolicy []string
+
+// readPushPolicy reads the project paths or path.Match patterns, one per
+// line, of a push policy file
+func readPushPolicy(file string) ([]string, error) {
+	return readProjectAllowlist("", file)
+}
+
+// pushAllowed reports whether the push policy lets the deploy keys of the
+// project push, as they all can without a -push-policy
+func pushAllowed(project string) bool {
+	if pushPolicyFile == "" {
+		return true
+	}
+	for _, pattern := range pushPolicy {
+		if ok, _ := path.Match(pattern, project); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setPushPolicy sets the -push-policy patterns, written to a file and read
+// back
+func setPushPolicy(t *testing.T, patterns ...string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "push-policy")
+	if err := ioutil.WriteFile(file, []byte("# push keys\n"+strings.Join(patterns, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := readPushPolicy(file)
+	if err != nil {
+		t.Fatalf("readPushPolicy: %s", err.Error())
+	}
+	pushPolicyFile, pushPolicy = file, policy
+}
+
+func TestPushAllowed(t *testing.T) {
+	if !pushAllowed("group/app") {
+		t.Errorf("a project isn't allowed push keys without a push policy")
+	}
+
+	defer func(file string, policy []string) { pushPolicyFile, pushPolicy = file, policy }(pushPolicyFile, pushPolicy)
+	setPushPolicy(t, "infra/flux", "group/*")
+	for project, want := range map[string]bool{
+		"infra/flux":       true,
+		"group/app":        true,
+		"group/sub/app":    false,
+		"infra/other":      false,
+		"other/infra/flux": false,
+	} {
+		if got := pushAllowed(project); got != want {
+			t.Errorf("pushAllowed(%q) = %v, want %v", project, got, want)
+		}
+	}
+
+	if _, err := readPushPolicy(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("readPushPolicy of a missing file didn't fail")
+	}
+}
+
+func TestSyncPushPolicyDenied(t *testing.T) {
+	defer func(file string, policy []string) { pushPolicyFile, pushPolicy = file, policy }(pushPolicyFile, pushPolicy)
+	setPushPolicy(t, "infra/*")
+
+	secret := identitySecret(t)
+	if !requestedPush(secret) {
+		t.Fatalf("a push key isn't requested by default")
+	}
+	if _, canPush := desiredKey(secret); canPush {
+		t.Errorf("desiredKey of a project outside of the push policy can push")
+	}
+	gl := newFakeGitlab()
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if key := gl.keys[1]; key == nil || key.CanPush == nil || *key.CanPush {
+		t.Errorf("deploy key = %+v, want a read-only key", key)
+	}
+	if !hasEvent(s.events(), PushPolicyDenied) {
+		t.Errorf("no %s event", PushPolicyDenied)
+	}
+
+	// A read-only key asked for isn't denied anything
+	secret = identitySecret(t)
+	secret.Annotations[deployKeyCanPushLabelName] = "false"
+	s = newTestSync(t, newFakeGitlab(), secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if hasEvent(s.events(), PushPolicyDenied) {
+		t.Errorf("a %s event for a read-only key", PushPolicyDenied)
+	}
+}
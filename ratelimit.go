@@ -0,0 +1,100 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// hostQPSFlag is a repeatable host=qps flag collecting per host request
+// rates
+type hostQPSFlag map[string]float64
+
+func (h hostQPSFlag) String() string {
+	var limits []string
+	for host, qps := range h {
+		limits = append(limits, fmt.Sprintf("%s=%v", host, qps))
+	}
+	sort.Strings(limits)
+	return strings.Join(limits, ",")
+}
+
+func (h hostQPSFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected host=qps, got %q", value)
+	}
+	qps, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || qps < 0 {
+		return fmt.Errorf("invalid qps %q for host %s", parts[1], parts[0])
+	}
+	h[parts[0]] = qps
+	return nil
+}
+
+// rateLimitTransport bounds the rate of the requests to each gitlab host
+// independently, so a slow self-hosted instance doesn't hold up the
+// requests to another host
+type rateLimitTransport struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	next     http.RoundTripper
+}
+
+// limiter returns the limiter of the host, nil when its requests aren't
+// limited
+func (t *rateLimitTransport) limiter(host string) *rate.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if limiter, ok := t.limiters[host]; ok {
+		return limiter
+	}
+	qps, ok := gitlabHostQPS[host]
+	if !ok {
+		qps = gitlabQPS
+	}
+	var limiter *rate.Limiter
+	if qps > 0 {
+		burst := int(qps)
+		if burst < 1 {
+			burst = 1
+		}
+		limiter = rate.NewLimiter(rate.Limit(qps), burst)
+	}
+	if t.limiters == nil {
+		t.limiters = map[string]*rate.Limiter{}
+	}
+	t.limiters[host] = limiter
+	return limiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if limiter := t.limiter(req.URL.Hostname()); limiter != nil {
+		if err := limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHostQPSFlag(t *testing.T) {
+	h := hostQPSFlag{}
+	for _, value := range []string{"b.example.com=0.5", "a.example.com=5"} {
+		if err := h.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := h.String(); got != "a.example.com=5,b.example.com=0.5" {
+		t.Errorf("String() = %q", got)
+	}
+	for _, invalid := range []string{"a.example.com", "=5", "a.example.com=fast", "a.example.com=-1"} {
+		if err := h.Set(invalid); err == nil {
+			t.Errorf("Set(%q) didn't fail", invalid)
+		}
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	defer func(qps float64, hosts hostQPSFlag) { gitlabQPS, gitlabHostQPS = qps, hosts }(gitlabQPS, gitlabHostQPS)
+	gitlabQPS = 0
+	gitlabHostQPS = hostQPSFlag{"slow.example.com": 0.001}
+
+	transport := &rateLimitTransport{next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})}
+	request := func(ctx context.Context, host string) error {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/api/v4/projects", nil)
+		_, err := transport.RoundTrip(req)
+		return err
+	}
+
+	// The burst of a slow host lets its first request through
+	if err := request(context.Background(), "slow.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := request(ctx, "slow.example.com"); err == nil {
+		t.Errorf("the second request to the slow host wasn't limited")
+	}
+
+	// The other hosts aren't held up by it
+	for i := 0; i < 10; i++ {
+		if err := request(context.Background(), "gitlab.example.com"); err != nil {
+			t.Errorf("request to an unlimited host failed: %s", err.Error())
+		}
+	}
+	if transport.limiter("gitlab.example.com") != nil {
+		t.Errorf("a host without a rate has a limiter")
+	}
+}
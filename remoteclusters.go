@@ -0,0 +1,119 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+)
+
+const (
+	// clusterLabelName is the label used to record, on the events of the
+	// Secrets of a -remote-kubeconfigs cluster, the name of the cluster
+	clusterLabelName = "fluxcd.io/cluster"
+
+	// localCluster is the cluster label of the metrics of the Secrets of the
+	// cluster the controller runs in
+	localCluster = "local"
+)
+
+// remoteCluster is a cluster of -remote-kubeconfigs whose Secrets the
+// controller manages along with the local ones
+type remoteCluster struct {
+	name       string
+	kubeconfig string
+}
+
+// parseRemoteKubeconfigs parses the comma separated name=path list of
+// kubeconfigs, the name defaulting to the file name without its extension
+func parseRemoteKubeconfigs(value string) ([]remoteCluster, error) {
+	var clusters []remoteCluster
+	names := map[string]bool{localCluster: true}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cluster := remoteCluster{kubeconfig: entry}
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			cluster = remoteCluster{name: parts[0], kubeconfig: parts[1]}
+		} else {
+			cluster.name = strings.TrimSuffix(filepath.Base(entry), filepath.Ext(entry))
+		}
+		if cluster.name == "" || cluster.kubeconfig == "" {
+			return nil, fmt.Errorf("invalid remote kubeconfig %q, expected name=path or path", entry)
+		}
+		if names[cluster.name] {
+			return nil, fmt.Errorf("duplicate remote cluster name %q", cluster.name)
+		}
+		names[cluster.name] = true
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+// clusterLabel returns the cluster label of the metrics of the Secrets of
+// the controller
+func (c *Controller) clusterLabel() string {
+	if c.cluster == "" {
+		return localCluster
+	}
+	return c.cluster
+}
+
+// runRemoteController runs a controller for the Secrets of the remote
+// cluster until stopCh is closed. It shares the gitlab client and the
+// project locks of the local controller, so keys of the same project are
+// never created concurrently from two clusters.
+func runRemoteController(local *Controller, cluster remoteCluster, stopCh <-chan struct{}) error {
+	cfg, err := clientcmd.BuildConfigFromFlags("", cluster.kubeconfig)
+	if err != nil {
+		return fmt.Errorf("failed to load the kubeconfig of cluster %s: %s", cluster.name, err.Error())
+	}
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to build the clientset of cluster %s: %s", cluster.name, err.Error())
+	}
+
+	factory := informers.NewSharedInformerFactory(kubeClient, time.Second*30)
+	factory.InformerFor(&corev1.Secret{}, newSecretInformer)
+	c := NewController(kubeClient, factory.Core().V1().Secrets(), cluster.name)
+	c.gitlabClient, c.gitlabToken = local.gitlabClient, local.gitlabToken
+	c.projects, c.missingProjects = local.projects, local.missingProjects
+	if c.dynamicClient, err = newOwnerClient(cfg); err != nil {
+		return fmt.Errorf("failed to build the dynamic client of cluster %s: %s", cluster.name, err.Error())
+	}
+	factory.Start(stopCh)
+	local.remotes = append(local.remotes, c)
+
+	klog.Infof("Managing the secrets of cluster %s", cluster.name)
+	go func() {
+		if err := c.Run(workers, stopCh); err != nil {
+			utilruntime.HandleError(fmt.Errorf("controller of cluster %s failed: %s", cluster.name, err.Error()))
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRemoteKubeconfigs(t *testing.T) {
+	clusters, err := parseRemoteKubeconfigs(" staging=/etc/kube/a.yaml, /etc/kube/production.yaml ,")
+	if err != nil {
+		t.Fatalf("parseRemoteKubeconfigs: %s", err.Error())
+	}
+	want := []remoteCluster{
+		{name: "staging", kubeconfig: "/etc/kube/a.yaml"},
+		{name: "production", kubeconfig: "/etc/kube/production.yaml"},
+	}
+	if !reflect.DeepEqual(clusters, want) {
+		t.Errorf("clusters = %+v, want %+v", clusters, want)
+	}
+
+	if clusters, err := parseRemoteKubeconfigs(""); err != nil || len(clusters) != 0 {
+		t.Errorf("parseRemoteKubeconfigs of no kubeconfig = %+v, %v, want none", clusters, err)
+	}
+	for _, value := range []string{
+		"=/etc/kube/a.yaml",
+		"staging=",
+		"/etc/kube/a.yaml,a=/etc/kube/b.yaml",
+		"local=/etc/kube/a.yaml",
+	} {
+		if _, err := parseRemoteKubeconfigs(value); err == nil {
+			t.Errorf("parseRemoteKubeconfigs(%q) didn't fail", value)
+		}
+	}
+}
+
+func TestClusterLabel(t *testing.T) {
+	if got := (&Controller{}).clusterLabel(); got != localCluster {
+		t.Errorf("clusterLabel of the local controller = %q, want %q", got, localCluster)
+	}
+	if got := (&Controller{cluster: "staging"}).clusterLabel(); got != "staging" {
+		t.Errorf("clusterLabel = %q, want %q", got, "staging")
+	}
+}
+
+func TestRunRemoteControllerMissingKubeconfig(t *testing.T) {
+	local := &Controller{}
+	if err := runRemoteController(local, remoteCluster{name: "staging", kubeconfig: "testdata/missing.yaml"}, nil); err == nil {
+		t.Errorf("runRemoteController with a missing kubeconfig didn't fail")
+	}
+	if len(local.remotes) != 0 {
+		t.Errorf("a remote controller was recorded without a kubeconfig")
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// minRotatedKeyBits is the minimum size of the RSA identities generated to
+// rotate the deploy keys older than -max-key-age, which otherwise have the
+// size of the identity they replace
+const minRotatedKeyBits = 2048
+
+// keyTooOld reports whether the deploy key of the secret was created longer
+// than -max-key-age ago. Keys without a creation time are never too old.
+func keyTooOld(secret *corev1.Secret) bool {
+	if maxKeyAge <= 0 {
+		return false
+	}
+	createdAt, err := time.Parse(time.RFC3339, secret.Annotations[createdAtLabelName])
+	if err != nil {
+		return false
+	}
+	return time.Since(createdAt) > maxKeyAge
+}
+
+// identityDataKey returns the data key holding the identity of the secret,
+// false when it's nested in a document and can't be replaced
+func identityDataKey(secret *corev1.Secret) (string, bool) {
+	for _, selector := range strings.Split(identityKeys, ",") {
+		key, fieldPath := splitIdentitySelector(selector)
+		if _, ok := secret.Data[key]; !ok {
+			continue
+		}
+		return key, fieldPath == ""
+	}
+	return "", false
+}
+
+// keySequence returns the number of times the deploy key of the secret was
+// rotated
+func keySequence(secret *corev1.Secret) int {
+	sequence, err := strconv.Atoi(secret.Annotations[keySequenceLabelName])
+	if err != nil || sequence < 0 {
+		return 0
+	}
+	return sequence
+}
+
+// sequencedTitle suffixes the title with the rotation sequence number, left
+// as is for a key that was never rotated
+func sequencedTitle(title string, sequence int) string {
+	if sequence == 0 {
+		return title
+	}
+	suffix := fmt.Sprintf(" #%d", sequence)
+	if len(title)+len(suffix) > maxDeployKeyTitleLength {
+		title = title[:maxDeployKeyTitleLength-len(suffix)]
+	}
+	return title + suffix
+}
+
+// generateIdentity returns a new PEM encoded identity of the same kind as the
+// current one, along with its public key. The controller only supports RSA
+// identities, the new one has the size and PEM encoding, PKCS#1 or PKCS#8,
+// of the current one.
+func generateIdentity(current []byte) ([]byte, ssh.PublicKey, error) {
+	k, err := ssh.ParseRawPrivateKey(current)
+	if err != nil {
+		return nil, nil, err
+	}
+	currentKey, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("identity is a %T, only RSA keys are supported", k)
+	}
+	bits := currentKey.N.BitLen()
+	if bits < minRotatedKeyBits {
+		bits = minRotatedKeyBits
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	if current, _ := pem.Decode(current); current != nil && current.Type == "PRIVATE KEY" {
+		if block.Bytes, err = x509.MarshalPKCS8PrivateKey(privateKey); err != nil {
+			return nil, nil, err
+		}
+		block.Type = current.Type
+	}
+	return pem.EncodeToMemory(block), publicKey, nil
+}
+
+// deleteRetiredKey deletes the deploy key a rotation retired, recorded in
+// the retiredDeployKeyId annotation, then forgets it. A failed deletion is
+// retried by the next syncs until it succeeds.
+func (c *Controller) deleteRetiredKey(ctx context.Context, secret *corev1.Secret) error {
+	if retiredKey, err := strconv.Atoi(secret.Annotations[retiredKeyLabelName]); err == nil {
+		if err := c.deletions.allow(); err != nil {
+			return err
+		}
+		projectID, _ := projectRef(secret)
+		logV(4).Infof("Deleting deploy key %d retired by the rotation of secret %s", retiredKey, secret.GetName())
+		resp, err := c.gitlabClient.DeployKeys.DeleteDeployKey(projectID, retiredKey, gitlab.WithContext(ctx))
+		if err != nil && !isNotFound(resp) {
+			return fmt.Errorf("failed to delete rotated deploy key %d: %w", retiredKey, err)
+		}
+		if err == nil {
+			audit.record(auditDeleteDeployKey, projectPath(secret), retiredKey, "", secret)
+		}
+	}
+	return c.updateSecret(ctx, secret, func(secret *corev1.Secret) {
+		delete(secret.Annotations, retiredKeyLabelName)
+	})
+}
+
+// rotateAgedKey replaces the deploy key of a secret older than -max-key-age
+// without downtime: the key of a new identity is added to the project, the
+// secret gets the new identity and the annotations of its key, and the old
+// key, recorded as retired until then, is deleted last.
+func (c *Controller) rotateAgedKey(ctx context.Context, secret *corev1.Secret) error {
+	oldKey, err := strconv.Atoi(secret.Annotations[deployKeyLabelName])
+	if err != nil {
+		return err
+	}
+	dataKey, ok := identityDataKey(secret)
+	if !ok || c.state != nil {
+		klog.Warningf("Deploy key %d of secret %s/%s is older than %s but its identity can't be replaced", oldKey, secret.Namespace, secret.Name, maxKeyAge)
+		return nil
+	}
+
+	project, err := c.getProject(ctx, secret)
+	if err != nil {
+		return err
+	}
+	current, _ := identity(secret)
+	newIdentity, sshKey, err := generateIdentity(current)
+	if err != nil {
+		return fmt.Errorf("failed to generate a new identity: %s", err.Error())
+	}
+
+	// The old key keeps its title until it's deleted, the new one is told
+	// apart by the next sequence number
+	sequence := keySequence(secret) + 1
+	title, canPush := desiredKey(secret)
+	title = sequencedTitle(title, sequence)
+	if titleEmbedHash {
+		title = embedTitleHash(title, project.PathWithNamespace, ssh.FingerprintSHA256(sshKey), canPush)
+	}
+	opts := &gitlab.AddDeployKeyOptions{Title: gitlab.String(title), Key: gitlab.String(c.authorizedKey(secret, sshKey)), CanPush: gitlab.Bool(canPush)}
+	newKey, _, err := c.gitlabClient.DeployKeys.AddDeployKey(project.ID, opts, gitlab.WithContext(ctx))
+	if isTitleTaken(err) && titleUniqueness != titleUniqueNone {
+		// The old key still has the title
+		opts.Title = gitlab.String(disambiguateTitle(title, secret))
+		newKey, _, err = c.gitlabClient.DeployKeys.AddDeployKey(project.ID, opts, gitlab.WithContext(ctx))
+	}
+	if err != nil {
+		return err
+	}
+	deployKeysCreated.Inc()
+	audit.record(auditCreateDeployKey, project.PathWithNamespace, newKey.ID, newKey.Title, secret)
+
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	rotate := func(secret *corev1.Secret) {
+		secret.Data[dataKey] = newIdentity
+		secret.Annotations[deployKeyLabelName] = strconv.Itoa(newKey.ID)
+		secret.Annotations[deployKeyFingerprintLabelName] = ssh.FingerprintSHA256(sshKey)
+		secret.Annotations[createdTitleLabelName] = newKey.Title
+		secret.Annotations[createdAtLabelName] = createdAt
+		secret.Annotations[keySequenceLabelName] = strconv.Itoa(sequence)
+		if !noDelete {
+			// The old key is deleted once the secret no longer uses it,
+			// until then the annotation keeps track of it
+			secret.Annotations[retiredKeyLabelName] = strconv.Itoa(oldKey)
+		}
+	}
+	err = c.updateSecret(ctx, secret, rotate)
+	if err != nil {
+		// The new identity is lost, so is its key
+		logV(4).Infof("Deleting deploy key %d, the secret %s couldn't be updated with its identity", newKey.ID, secret.GetName())
+		if _, err := c.gitlabClient.DeployKeys.DeleteDeployKey(project.ID, newKey.ID, gitlab.WithContext(ctx)); err == nil {
+			audit.record(auditDeleteDeployKey, project.PathWithNamespace, newKey.ID, newKey.Title, secret)
+		}
+		return err
+	}
+	c.forgetVerified(secret)
+	// The secret's private key was replaced, the source it's applied from
+	// would put the old one back
+	c.recorder.Eventf(secret, corev1.EventTypeWarning, IdentityReplaced, MessageIdentityReplaced, dataKey)
+	c.recorder.Eventf(secret, corev1.EventTypeNormal, KeyAgeRotated, MessageKeyAgeRotated, oldKey, maxKeyAge, newKey.ID)
+
+	if noDelete {
+		klog.Infof("Not deleting rotated deploy key %d of project %s, deletion is disabled", oldKey, project.PathWithNamespace)
+		return nil
+	}
+	rotated := secret.DeepCopy()
+	rotate(rotated)
+	return c.deleteRetiredKey(ctx, rotated)
+}
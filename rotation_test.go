@@ -0,0 +1,248 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestKeyTooOld(t *testing.T) {
+	defer func(age time.Duration) { maxKeyAge = age }(maxKeyAge)
+
+	secret := fluxSecret()
+	secret.Annotations[createdAtLabelName] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	maxKeyAge = 0
+	if keyTooOld(secret) {
+		t.Errorf("a key is too old without -max-key-age")
+	}
+	maxKeyAge = time.Hour
+	if !keyTooOld(secret) {
+		t.Errorf("a key created 2h ago isn't older than 1h")
+	}
+	maxKeyAge = 3 * time.Hour
+	if keyTooOld(secret) {
+		t.Errorf("a key created 2h ago is older than 3h")
+	}
+	maxKeyAge = time.Hour
+	secret.Annotations[createdAtLabelName] = "yesterday"
+	if keyTooOld(secret) {
+		t.Errorf("a key with an invalid creation time is too old")
+	}
+	delete(secret.Annotations, createdAtLabelName)
+	if keyTooOld(secret) {
+		t.Errorf("a key without a creation time is too old")
+	}
+}
+
+func TestSequencedTitle(t *testing.T) {
+	secret := fluxSecret()
+	for value, want := range map[string]int{"": 0, "2": 2, "-1": 0, "two": 0} {
+		secret.Annotations[keySequenceLabelName] = value
+		if got := keySequence(secret); got != want {
+			t.Errorf("keySequence(%q) = %d, want %d", value, got, want)
+		}
+	}
+
+	if got := sequencedTitle("flux", 0); got != "flux" {
+		t.Errorf("sequencedTitle of a key never rotated = %q, want it as is", got)
+	}
+	if got := sequencedTitle("flux", 3); got != "flux #3" {
+		t.Errorf("sequencedTitle = %q, want %q", got, "flux #3")
+	}
+	long := strings.Repeat("a", maxDeployKeyTitleLength)
+	if got := sequencedTitle(long, 12); len(got) != maxDeployKeyTitleLength || !strings.HasSuffix(got, " #12") {
+		t.Errorf("sequencedTitle of a long title = %q, want it truncated to %d with the suffix", got, maxDeployKeyTitleLength)
+	}
+}
+
+func TestGenerateIdentity(t *testing.T) {
+	pkcs1, _ := testKey(t, 1024)
+	identity, publicKey, err := generateIdentity(pkcs1)
+	if err != nil {
+		t.Fatalf("generateIdentity: %s", err.Error())
+	}
+	block, _ := pem.Decode(identity)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		t.Fatalf("generated identity = %q, want a PKCS#1 key", identity)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bits := key.N.BitLen(); bits != minRotatedKeyBits {
+		t.Errorf("generated identity has %d bits, want at least %d", bits, minRotatedKeyBits)
+	}
+	if want, _ := ssh.NewPublicKey(key.Public()); !bytes.Equal(publicKey.Marshal(), want.Marshal()) {
+		t.Errorf("the public key isn't the one of the identity")
+	}
+	if bytes.Equal(identity, pkcs1) {
+		t.Errorf("the identity wasn't replaced")
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	identity, _, err = generateIdentity(pkcs8)
+	if err != nil {
+		t.Fatalf("generateIdentity: %s", err.Error())
+	}
+	block, _ = pem.Decode(identity)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("generated identity = %q, want a PKCS#8 key", identity)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bits := parsed.(*rsa.PrivateKey).N.BitLen(); bits != 3072 {
+		t.Errorf("generated identity has %d bits, want the 3072 of the current one", bits)
+	}
+
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ = x509.MarshalPKCS8PrivateKey(edKey)
+	if _, _, err := generateIdentity(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err == nil {
+		t.Errorf("generateIdentity of an ed25519 identity didn't fail")
+	}
+}
+
+// agedSecret returns a secret whose deploy key was created 2h ago, added to
+// the fake gitlab
+func agedSecret(t *testing.T, gl *fakeGitlab) *corev1.Secret {
+	secret := identitySecret(t)
+	gl.addKey(&gitlab.DeployKey{Title: "Flux deployment key", CanPush: gitlab.Bool(true)})
+	secret.Annotations[deployKeyLabelName] = "1"
+	secret.Annotations[createdAtLabelName] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	return secret
+}
+
+func TestSyncRotatesAgedKey(t *testing.T) {
+	defer func(age time.Duration) { maxKeyAge = age }(maxKeyAge)
+	maxKeyAge = time.Hour
+
+	gl := newFakeGitlab()
+	secret := agedSecret(t, gl)
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+
+	updated := s.secret(t, secret)
+	if bytes.Equal(updated.Data["identity"], secret.Data["identity"]) {
+		t.Errorf("the identity of the secret wasn't replaced")
+	}
+	annotations := updated.Annotations
+	if annotations[deployKeyLabelName] != "2" || annotations[keySequenceLabelName] != "1" {
+		t.Errorf("annotations = %v, want deploy key 2 of sequence 1", annotations)
+	}
+	if _, ok := annotations[retiredKeyLabelName]; ok {
+		t.Errorf("the retired key is still recorded after its deletion")
+	}
+	if _, ok := s.gitlab.keys[1]; ok {
+		t.Errorf("the retired deploy key 1 wasn't deleted")
+	}
+	key := s.gitlab.keys[2]
+	if key == nil || !strings.HasSuffix(key.Title, " #1") {
+		t.Fatalf("deploy key 2 = %+v, want the title suffixed with the sequence", key)
+	}
+	signer, err := ssh.ParsePrivateKey(updated.Data["identity"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint := ssh.FingerprintSHA256(signer.PublicKey()); annotations[deployKeyFingerprintLabelName] != fingerprint {
+		t.Errorf("fingerprint = %q, want %q of the new identity", annotations[deployKeyFingerprintLabelName], fingerprint)
+	}
+	events := s.events()
+	if !hasEvent(events, IdentityReplaced) || !hasEvent(events, KeyAgeRotated) {
+		t.Errorf("events = %v, want %s and %s", events, IdentityReplaced, KeyAgeRotated)
+	}
+}
+
+func TestSyncDeletesRetiredKey(t *testing.T) {
+	gl := newFakeGitlab()
+	secret := agedSecret(t, gl)
+	gl.addKey(&gitlab.DeployKey{Title: "Flux deployment key #1"})
+	secret.Annotations[deployKeyLabelName] = "2"
+	secret.Annotations[retiredKeyLabelName] = "1"
+	delete(secret.Annotations, createdAtLabelName)
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if _, ok := s.gitlab.keys[1]; ok {
+		t.Errorf("the retired deploy key 1 wasn't deleted")
+	}
+	if _, ok := s.gitlab.keys[2]; !ok {
+		t.Errorf("the deploy key 2 of the secret was deleted")
+	}
+	if _, ok := s.secret(t, secret).Annotations[retiredKeyLabelName]; ok {
+		t.Errorf("the retired key is still recorded after its deletion")
+	}
+}
+
+func TestSyncIdentityChangedSequence(t *testing.T) {
+	defer func(reconcile bool) { reconcileOnIdentityChange = reconcile }(reconcileOnIdentityChange)
+	reconcileOnIdentityChange = true
+
+	_, previous := testKey(t, 1024)
+	gl := newFakeGitlab()
+	gl.addKey(&gitlab.DeployKey{Title: deployKeyTitle + " #1", Key: string(ssh.MarshalAuthorizedKey(previous))})
+	secret := identitySecret(t)
+	secret.Annotations[deployKeyLabelName] = "1"
+	secret.Annotations[deployKeyFingerprintLabelName] = ssh.FingerprintSHA256(previous)
+	secret.Annotations[keySequenceLabelName] = "1"
+
+	s := newTestSync(t, gl, secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if got := s.secret(t, secret).Annotations[keySequenceLabelName]; got != "2" {
+		t.Errorf("sequence = %q, want 2 after the rotation", got)
+	}
+	if key := gl.keys[2]; key == nil || !strings.HasSuffix(key.Title, " #2") {
+		t.Errorf("deploy key 2 = %+v, want the title suffixed with the sequence", key)
+	}
+}
+
+func TestReconcileSequencedTitle(t *testing.T) {
+	secret := fluxSecret()
+	secret.Annotations[keySequenceLabelName] = "2"
+	title, canPush := desiredKey(secret)
+
+	// The title of a rotated key has its sequence number, it didn't drift
+	c := &Controller{recorder: record.NewFakeRecorder(10), gitlabClient: unusedGitlab(t)}
+	key := &gitlab.DeployKey{ID: 1, Title: title + " #2", CanPush: gitlab.Bool(canPush)}
+	if recreate, err := c.reconcileKeyMetadata(context.Background(), secret, 10, key); err != nil || recreate {
+		t.Errorf("reconcileKeyMetadata = %v, %v, want false, nil", recreate, err)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/api/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog"
+)
+
+// metricsHandler returns the handler serving the controller metrics and the
+// inventory of its deploy keys
+func metricsHandler(c *Controller) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/inventory", c.inventoryHandler(c.list))
+	if serveConfig {
+		mux.Handle("/config", configHandler())
+	}
+	if len(reconcileToken) > 0 {
+		mux.Handle("/reconcile", bearerAuth(reconcileToken, c.reconcileHandler()))
+	}
+	return mux
+}
+
+// bearerAuth only lets the requests with the bearer token through to next
+func bearerAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := r.Header.Get("Authorization")
+		if !strings.HasPrefix(given, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(given, "Bearer ")), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reconcileHandler enqueues the Secret named by the namespace and name query
+// parameters of a POST request
+func (c *Controller) reconcileHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		namespace, name := r.URL.Query().Get("namespace"), r.URL.Query().Get("name")
+		if namespace == "" || name == "" {
+			http.Error(w, "the namespace and name parameters are required", http.StatusBadRequest)
+			return
+		}
+
+		secret, err := c.secretsLister.Secrets(namespace).Get(name)
+		if errors.IsNotFound(err) {
+			http.Error(w, fmt.Sprintf("secret %s/%s not found", namespace, name), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		klog.Infof("Reconcile of secret %s/%s requested", namespace, name)
+		// A forced reconcile also verifies the key whatever the verify cache
+		c.forgetVerified(secret)
+		c.enqueue(secret)
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// healthHandler returns the handler serving the controller health checks
+func healthHandler(c *Controller) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	mux.HandleFunc("/progressz", func(w http.ResponseWriter, r *http.Request) {
+		if err := c.checkProgress(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	return mux
+}
+
+// serve starts an http server for handler on addr until stopCh is closed.
+// An empty addr disables the server and "0" binds an ephemeral port, the
+// address actually bound is logged either way.
+func serve(name, addr string, handler http.Handler, stopCh <-chan struct{}) error {
+	if addr == "" {
+		klog.Infof("Not serving %s, no address configured", name)
+		return nil
+	}
+	if addr == "0" {
+		addr = ":0"
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s for %s: %s", addr, name, err.Error())
+	}
+	klog.Infof("Serving %s on %s", name, listener.Addr())
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			utilruntime.HandleError(fmt.Errorf("%s server failed: %s", name, err.Error()))
+		}
+	}()
+
+	return nil
+}
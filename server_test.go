@@ -0,0 +1,92 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestBearerAuth(t *testing.T) {
+	handler := bearerAuth("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{"Bearer secret", http.StatusNoContent},
+		{"", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer other", http.StatusUnauthorized},
+		{"Bearer secret2", http.StatusUnauthorized},
+		{"bearer secret", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/reconcile", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("Authorization %q: status %d, want %d", test.authorization, rec.Code, test.want)
+		}
+	}
+}
+
+func TestProgressz(t *testing.T) {
+	defer func(window time.Duration) { progressWindow = window }(progressWindow)
+	progressWindow = time.Minute
+
+	c := &Controller{
+		workqueue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		deletionqueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	handler := healthHandler(c)
+	progressz := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/progressz", nil))
+		return rec.Code
+	}
+
+	c.workqueue.Add(fluxSecret())
+	if code := progressz(); code != http.StatusOK {
+		t.Errorf("status %d before the workers started, want %d", code, http.StatusOK)
+	}
+	c.markProgress()
+	if code := progressz(); code != http.StatusOK {
+		t.Errorf("status %d within the progress window, want %d", code, http.StatusOK)
+	}
+	c.lastProgress = time.Now().Add(-2 * time.Minute).UnixNano()
+	if code := progressz(); code != http.StatusServiceUnavailable {
+		t.Errorf("status %d of a stalled workqueue, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	// Nothing to sync isn't being stuck
+	item, _ := c.workqueue.Get()
+	c.workqueue.Done(item)
+	if code := progressz(); code != http.StatusOK {
+		t.Errorf("status %d of an empty workqueue, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// stateAnnotations are the annotations kept in the state store rather than
+// on the Secrets
+var stateAnnotations = append([]string{deployKeyMissingLabelName}, managedAnnotations...)
+
+// stateStore keeps the annotations the controller would write on the Secrets
+// in the -state-configmap ConfigMap instead, for clusters where it can't
+// write the Secrets. The ConfigMap holds the annotations of every Secret as a
+// JSON object under its namespace.name key, and is the source of truth for
+// them: the annotations of a Secret it has an entry for are ignored.
+type stateStore struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	name       string
+
+	mu      sync.Mutex
+	secrets map[string]map[string]string
+}
+
+// newStateStore loads the state store from the ConfigMap named
+// namespace/name, which is created on the first write if it doesn't exist
+func newStateStore(kubeClient kubernetes.Interface, configMap string) (*stateStore, error) {
+	parts := strings.SplitN(configMap, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid state ConfigMap %q, expected namespace/name", configMap)
+	}
+	s := &stateStore{kubeClient: kubeClient, namespace: parts[0], name: parts[1], secrets: map[string]map[string]string{}}
+
+	cm, err := kubeClient.CoreV1().ConfigMaps(s.namespace).Get(context.TODO(), s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range cm.Data {
+		var annotations map[string]string
+		if err := json.Unmarshal([]byte(value), &annotations); err != nil {
+			utilruntime.HandleError(fmt.Errorf("invalid state of secret %s: %s", key, err.Error()))
+			continue
+		}
+		s.secrets[key] = annotations
+	}
+	klog.Infof("Loaded the state of %d secrets", len(s.secrets))
+	return s, nil
+}
+
+// stateKey returns the ConfigMap key of the state of the Secret. Namespaces
+// have no dots, so it can't be ambiguous.
+func stateKey(secret *corev1.Secret) string {
+	return secret.Namespace + "." + secret.Name
+}
+
+// overlay returns the Secret with the annotations of its state, or the Secret
+// itself without a state store or without a state for it
+func (s *stateStore) overlay(secret *corev1.Secret) *corev1.Secret {
+	if s == nil {
+		return secret
+	}
+	s.mu.Lock()
+	annotations, ok := s.secrets[stateKey(secret)]
+	s.mu.Unlock()
+	if !ok {
+		return secret
+	}
+
+	secret = secret.DeepCopy()
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	for _, key := range stateAnnotations {
+		delete(secret.Annotations, key)
+	}
+	for key, value := range annotations {
+		secret.Annotations[key] = value
+	}
+	return secret
+}
+
+// update records the state annotations of the Secret once mutate changed
+// them
+func (s *stateStore) update(ctx context.Context, secret *corev1.Secret, mutate func(*corev1.Secret)) error {
+	secret = s.overlay(secret).DeepCopy()
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	mutate(secret)
+
+	annotations := map[string]string{}
+	for _, key := range stateAnnotations {
+		if value, ok := secret.Annotations[key]; ok {
+			annotations[key] = value
+		}
+	}
+	return s.write(ctx, stateKey(secret), annotations)
+}
+
+// forget drops the state of the Secret, unless it changed since the Secret
+// was overlaid with it, e.g. for another Secret created under the same name
+func (s *stateStore) forget(ctx context.Context, secret *corev1.Secret) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	annotations, ok := s.secrets[stateKey(secret)]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	for _, key := range stateAnnotations {
+		if annotations[key] != secret.Annotations[key] {
+			return nil
+		}
+	}
+	return s.write(ctx, stateKey(secret), nil)
+}
+
+// write sets the state of key in the ConfigMap, removing it when annotations
+// is nil, and then in memory
+func (s *stateStore) write(ctx context.Context, key string, annotations map[string]string) error {
+	var value []byte
+	if annotations != nil {
+		var err error
+		if value, err = json.Marshal(annotations); err != nil {
+			return err
+		}
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := s.kubeClient.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			if annotations == nil {
+				return nil
+			}
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.name}}
+			cm.Data = map[string]string{key: string(value)}
+			_, err = s.kubeClient.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{FieldManager: fieldManager})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		if annotations == nil {
+			delete(cm.Data, key)
+		} else {
+			cm.Data[key] = string(value)
+		}
+		_, err = s.kubeClient.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{FieldManager: fieldManager})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write the state of secret %s: %s", key, err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if annotations == nil {
+		delete(s.secrets, key)
+	} else {
+		s.secrets[key] = annotations
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStateStore(t *testing.T) {
+	if _, err := newStateStore(fake.NewSimpleClientset(), "state"); err == nil {
+		t.Errorf("a state ConfigMap without namespace didn't fail")
+	}
+
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux", Name: "state"},
+		Data: map[string]string{
+			"flux.flux-git-deploy": `{"fluxcd.io/deployKeyId": "2"}`,
+			"flux.invalid":         "invalid",
+		},
+	})
+	state, err := newStateStore(client, "flux/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.secrets) != 1 {
+		t.Errorf("loaded the state of %d secrets, want the valid one", len(state.secrets))
+	}
+
+	// The state takes precedence over the annotations of the secret
+	secret := fluxSecret()
+	secret.Annotations[deployKeyFingerprintLabelName] = "SHA256:stale"
+	overlaid := state.overlay(secret)
+	if _, ok := overlaid.Annotations[deployKeyFingerprintLabelName]; ok || overlaid.Annotations[deployKeyLabelName] != "2" {
+		t.Errorf("overlaid annotations = %v, want the state's", overlaid.Annotations)
+	}
+	if overlaid.Annotations[gitUrlLabelName] != secret.Annotations[gitUrlLabelName] || secret.Annotations[deployKeyLabelName] != "1" {
+		t.Errorf("overlay changed the annotations it doesn't keep or the secret itself")
+	}
+	other := fluxSecret()
+	other.Name = "other"
+	if state.overlay(other) != other {
+		t.Errorf("a secret without state was overlaid")
+	}
+
+	// A state that changed since the secret was overlaid is kept
+	if err := state.forget(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.secrets["flux.flux-git-deploy"]; !ok {
+		t.Errorf("forget dropped the state of another secret")
+	}
+	if err := state.forget(context.Background(), overlaid); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := client.CoreV1().ConfigMaps("flux").Get(context.Background(), "state", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Data["flux.flux-git-deploy"]; ok || state.overlay(secret) != secret {
+		t.Errorf("the state of the secret wasn't forgotten")
+	}
+}
+
+func TestSyncStateStore(t *testing.T) {
+	secret := identitySecret(t)
+	s := newTestSync(t, newFakeGitlab(), secret)
+	state, err := newStateStore(s.client, "flux/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.state = state
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if _, ok := s.secret(t, secret).Annotations[deployKeyLabelName]; ok {
+		t.Errorf("the deploy key was recorded on the secret")
+	}
+	cm, err := s.client.CoreV1().ConfigMaps("flux").Get(context.Background(), "state", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.overlay(secret).Annotations[deployKeyLabelName] != "1" || cm.Data["flux.flux-git-deploy"] == "" {
+		t.Errorf("state = %v, want the deploy key", cm.Data)
+	}
+
+	// The recorded key is found through the state
+	requests := len(s.gitlab.requested())
+	if err := s.syncSecret(context.Background(), s.secret(t, secret)); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	if len(s.gitlab.keys) != 1 || len(s.gitlab.requested()) != requests {
+		t.Errorf("the second sync made gitlab requests %v", s.gitlab.requested()[requests:])
+	}
+}
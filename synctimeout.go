@@ -0,0 +1,149 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+const (
+	// reconcileTimeoutLimit is the number of timeouts in a row after which a
+	// Secret is dead-lettered
+	reconcileTimeoutLimit = 3
+
+	// reconcileTimeoutBackoff is how long a Secret whose sync timed out
+	// waits before being retried
+	reconcileTimeoutBackoff = time.Minute
+)
+
+// errReconcileTimeout is returned when the sync of a Secret outlasts
+// -reconcile-timeout
+var errReconcileTimeout = errors.New("reconcile timed out")
+
+// syncTimeouts counts, by namespace/name, the syncs in a row that outlasted
+// -reconcile-timeout, and keeps the version of the dead-lettered Secrets
+type syncTimeouts struct {
+	mu           sync.Mutex
+	timeouts     map[string]int
+	deadLettered map[string]deadLetter
+}
+
+// deadLetter is the version of a dead-lettered Secret, which isn't enqueued
+// again until it changes
+type deadLetter struct {
+	uid             types.UID
+	resourceVersion string
+}
+
+// succeeded forgets the timeouts of the Secret once its sync succeeded
+func (s *syncTimeouts) succeeded(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.timeouts, key)
+	delete(s.deadLettered, key)
+}
+
+// deadLetter records the current version of the dead-lettered Secret
+func (s *syncTimeouts) deadLetter(object metav1.Object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deadLettered == nil {
+		s.deadLettered = map[string]deadLetter{}
+	}
+	s.deadLettered[object.GetNamespace()+"/"+object.GetName()] = deadLetter{uid: object.GetUID(), resourceVersion: object.GetResourceVersion()}
+}
+
+// isDeadLettered reports whether the Secret is dead-lettered and unchanged
+// since, e.g. on a resync. A Secret that changed, or was recreated, is
+// forgotten.
+func (s *syncTimeouts) isDeadLettered(object metav1.Object) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := object.GetNamespace() + "/" + object.GetName()
+	dead, ok := s.deadLettered[key]
+	if !ok {
+		return false
+	}
+	if dead.uid == object.GetUID() && dead.resourceVersion == object.GetResourceVersion() {
+		return true
+	}
+	delete(s.deadLettered, key)
+	return false
+}
+
+// timedOut records a timeout of the sync of the Secret. It reports whether
+// the Secret timed out too many times in a row and is dead-lettered, which
+// starts its count over.
+func (s *syncTimeouts) timedOut(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timeouts == nil {
+		s.timeouts = map[string]int{}
+	}
+	s.timeouts[key]++
+	if s.timeouts[key] < reconcileTimeoutLimit {
+		return false
+	}
+	delete(s.timeouts, key)
+	return true
+}
+
+// syncWithTimeout runs the handler of the Secret with a context that expires
+// after -reconcile-timeout, which every gitlab and Kubernetes call of the
+// sync is made with, so a hanging call doesn't hold up the worker.
+func (c *Controller) syncWithTimeout(handler func(context.Context, *corev1.Secret) error, secret *corev1.Secret) error {
+	if reconcileTimeout <= 0 {
+		return handler(context.Background(), secret)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reconcileTimeout)
+	defer cancel()
+
+	key := secret.Namespace + "/" + secret.Name
+	err := handler(ctx, secret)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errReconcileTimeout
+	}
+	if err == nil {
+		c.timeouts.succeeded(key)
+	}
+	return err
+}
+
+// reconcileTimedOut records the timeout of the sync of the Secret. It
+// reports whether the Secret is dead-lettered, i.e. it isn't retried until
+// it changes. A deleted Secret is never dead-lettered, which would leave its
+// deploy key behind: its deletion keeps being retried.
+func (c *Controller) reconcileTimedOut(secret *corev1.Secret, deleted bool) bool {
+	reconcileTimeouts.Inc()
+	c.recorder.Eventf(secret, corev1.EventTypeWarning, ReconcileTimeout, MessageReconcileTimeout, reconcileTimeout)
+	if deleted || !c.timeouts.timedOut(secret.Namespace+"/"+secret.Name) {
+		return false
+	}
+	klog.Warningf("Sync of secret %s/%s timed out %d times in a row, not retrying it until it changes", secret.Namespace, secret.Name, reconcileTimeoutLimit)
+	c.timeouts.deadLetter(secret)
+	deadLettered.Inc()
+	c.recorder.Eventf(secret, corev1.EventTypeWarning, ReconcileDeadLettered, MessageReconcileDeadLettered, reconcileTimeoutLimit)
+	return true
+}
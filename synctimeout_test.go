@@ -0,0 +1,164 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestSyncTimeouts(t *testing.T) {
+	var timeouts syncTimeouts
+	for i := 1; i < reconcileTimeoutLimit; i++ {
+		if timeouts.timedOut("flux/flux-git-deploy") {
+			t.Fatalf("secret dead-lettered after %d timeouts, want %d", i, reconcileTimeoutLimit)
+		}
+	}
+	timeouts.succeeded("flux/flux-git-deploy")
+	for i := 1; i < reconcileTimeoutLimit; i++ {
+		if timeouts.timedOut("flux/flux-git-deploy") {
+			t.Fatalf("the timeouts weren't forgotten after a successful sync")
+		}
+	}
+	if timeouts.timedOut("flux/other") {
+		t.Errorf("the timeouts of another secret were counted")
+	}
+	if !timeouts.timedOut("flux/flux-git-deploy") {
+		t.Errorf("secret not dead-lettered after %d timeouts in a row", reconcileTimeoutLimit)
+	}
+	if timeouts.timedOut("flux/flux-git-deploy") {
+		t.Errorf("the count didn't start over once the secret was dead-lettered")
+	}
+}
+
+func TestSyncWithTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { reconcileTimeout = timeout }(reconcileTimeout)
+	c := &Controller{}
+	secret := fluxSecret()
+
+	reconcileTimeout = 0
+	err := c.syncWithTimeout(func(ctx context.Context, secret *corev1.Secret) error {
+		if _, ok := ctx.Deadline(); ok {
+			t.Errorf("the sync has a deadline without -reconcile-timeout")
+		}
+		return nil
+	}, secret)
+	if err != nil {
+		t.Errorf("syncWithTimeout = %v, want the handler's nil", err)
+	}
+
+	reconcileTimeout = 10 * time.Millisecond
+	hanging := func(ctx context.Context, secret *corev1.Secret) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err := c.syncWithTimeout(hanging, secret); err != errReconcileTimeout {
+		t.Errorf("syncWithTimeout of a hanging sync = %v, want errReconcileTimeout", err)
+	}
+
+	failed := errors.New("failed")
+	if err := c.syncWithTimeout(func(context.Context, *corev1.Secret) error { return failed }, secret); err != failed {
+		t.Errorf("syncWithTimeout of a failed sync = %v, want the handler's error", err)
+	}
+
+	c.timeouts.timedOut("flux/flux-git-deploy")
+	if err := c.syncWithTimeout(func(context.Context, *corev1.Secret) error { return nil }, secret); err != nil {
+		t.Errorf("syncWithTimeout = %v, want the handler's nil", err)
+	}
+	if _, ok := c.timeouts.timeouts["flux/flux-git-deploy"]; ok {
+		t.Errorf("the timeouts of the secret weren't forgotten after a successful sync")
+	}
+}
+
+func TestReconcileTimedOut(t *testing.T) {
+	s := newTestSync(t, newFakeGitlab())
+	secret := fluxSecret()
+	dead := testutil.ToFloat64(deadLettered)
+	for i := 1; i < reconcileTimeoutLimit; i++ {
+		if s.reconcileTimedOut(secret, false) {
+			t.Fatalf("secret dead-lettered after %d timeouts", i)
+		}
+	}
+	if !s.reconcileTimedOut(secret, false) {
+		t.Fatalf("secret not dead-lettered after %d timeouts", reconcileTimeoutLimit)
+	}
+	events := s.events()
+	if !hasEvent(events, ReconcileTimeout) || !hasEvent(events, ReconcileDeadLettered) {
+		t.Errorf("events = %v, want %s and %s", events, ReconcileTimeout, ReconcileDeadLettered)
+	}
+	if got := testutil.ToFloat64(deadLettered) - dead; got != 1 {
+		t.Errorf("dead-lettered secrets = %v, want 1", got)
+	}
+	if after, ok := s.backoff(secret, errReconcileTimeout); !ok || after != reconcileTimeoutBackoff {
+		t.Errorf("backoff of a timed out sync = %s, %v, want %s", after, ok, reconcileTimeoutBackoff)
+	}
+}
+
+func TestReconcileTimedOutDeleted(t *testing.T) {
+	s := newTestSync(t, newFakeGitlab())
+	secret := fluxSecret()
+	for i := 0; i <= reconcileTimeoutLimit; i++ {
+		if s.reconcileTimedOut(secret, true) {
+			t.Fatalf("deleted secret dead-lettered after %d timeouts", i+1)
+		}
+	}
+	if _, ok := s.timeouts.timeouts["flux/flux-git-deploy"]; ok {
+		t.Errorf("the timeouts of the deleted secret were counted")
+	}
+}
+
+func TestDeadLetteredResync(t *testing.T) {
+	s := newTestSync(t, newFakeGitlab())
+	s.workqueue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	s.deletionqueue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	secret := fluxSecret()
+	secret.ResourceVersion = "1"
+	for i := 0; i < reconcileTimeoutLimit; i++ {
+		s.reconcileTimedOut(secret, false)
+	}
+
+	// A resync updates the secret with the same version
+	resynced := secret.DeepCopy()
+	if materialChange(secret, resynced) {
+		s.handleObject(resynced)
+	}
+	if s.workqueue.Len() != 0 {
+		t.Fatalf("the resync enqueued the dead-lettered secret")
+	}
+
+	recreated := secret.DeepCopy()
+	recreated.UID = "recreated"
+	s.handleObject(recreated)
+	if s.workqueue.Len() != 1 {
+		t.Errorf("the secret recreated under the same name wasn't enqueued")
+	}
+	item, _ := s.workqueue.Get()
+	s.workqueue.Done(item)
+
+	changed := secret.DeepCopy()
+	changed.ResourceVersion = "2"
+	s.handleObject(changed)
+	if s.workqueue.Len() != 1 {
+		t.Errorf("the dead-lettered secret wasn't enqueued once changed")
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// throttlePauseThreshold is the number of consecutive rate limited, or
+// unavailable, syncs after which the workers stop dequeuing Secrets for a
+// while
+const throttlePauseThreshold = 5
+
+// throttle pauses all the workers once gitlab keeps rate limiting the
+// controller or is down for maintenance, so the API gets a chance to recover
+// instead of being hit by every queued Secret in turn. The rate limited and
+// unavailable syncs are counted apart, so a mix of both doesn't pause the
+// workers for the delay of either.
+type throttle struct {
+	mu              sync.Mutex
+	rateLimitedHits int
+	unavailableHits int
+	until           time.Time
+}
+
+// rateLimited records a rate limited sync that should be retried after
+// delay, pausing the workers for that long once the threshold is reached.
+func (t *throttle) rateLimited(delay time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rateLimitedHits++
+	if t.rateLimitedHits < throttlePauseThreshold {
+		return
+	}
+	if until := time.Now().Add(delay); until.After(t.until) {
+		klog.Warningf("GitLab rate limited %d syncs in a row, pausing workers for %s", t.rateLimitedHits, delay)
+		t.until = until
+		paused.Set(1)
+	}
+}
+
+// unavailable records a sync that failed because gitlab is unavailable, e.g.
+// in maintenance mode, pausing the workers for delay once the threshold is
+// reached. The pause is only logged when it starts, not on every sync
+// failing meanwhile.
+func (t *throttle) unavailable(delay time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.unavailableHits++
+	if t.unavailableHits < throttlePauseThreshold {
+		return
+	}
+	now := time.Now()
+	if now.After(t.until) {
+		klog.Warningf("GitLab was unavailable for %d syncs in a row, pausing workers for %s", t.unavailableHits, delay)
+	}
+	if until := now.Add(delay); until.After(t.until) {
+		t.until = until
+		paused.Set(1)
+	}
+}
+
+// reset starts both counts over once a sync succeeded, or gitlab answered it
+// with neither a 429 nor a 503
+func (t *throttle) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rateLimitedHits = 0
+	t.unavailableHits = 0
+}
+
+// wait blocks while the workers are paused. It returns false if stopCh was
+// closed in the meantime.
+func (t *throttle) wait(stopCh <-chan struct{}) bool {
+	for {
+		t.mu.Lock()
+		remaining := time.Until(t.until)
+		if remaining <= 0 {
+			paused.Set(0)
+		}
+		t.mu.Unlock()
+
+		if remaining <= 0 {
+			return true
+		}
+		select {
+		case <-stopCh:
+			return false
+		case <-time.After(remaining):
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// waits reports whether wait returns at once, without pausing
+func waits(t *throttle) bool {
+	stopCh := make(chan struct{})
+	close(stopCh)
+	return !t.wait(stopCh)
+}
+
+func TestThrottle(t *testing.T) {
+	var th throttle
+	for i := 1; i < throttlePauseThreshold; i++ {
+		th.rateLimited(time.Hour)
+	}
+	if waits(&th) {
+		t.Fatalf("the workers paused before %d rate limited syncs", throttlePauseThreshold)
+	}
+
+	th.reset()
+	for i := 1; i < throttlePauseThreshold; i++ {
+		th.rateLimited(time.Hour)
+	}
+	if waits(&th) {
+		t.Fatalf("the workers paused although a sync succeeded in between")
+	}
+
+	th.rateLimited(time.Hour)
+	if !waits(&th) {
+		t.Fatalf("the workers didn't pause after %d rate limited syncs", throttlePauseThreshold)
+	}
+}
+
+func TestThrottleUnavailable(t *testing.T) {
+	var th throttle
+	for i := 0; i < throttlePauseThreshold; i++ {
+		th.unavailable(10 * time.Millisecond)
+	}
+	start := time.Now()
+	if !th.wait(make(chan struct{})) {
+		t.Fatalf("wait returned false without being stopped")
+	}
+	if waited := time.Since(start); waited < 5*time.Millisecond {
+		t.Errorf("waited %s, want the 10ms pause", waited)
+	}
+}
+
+func TestThrottleMixed(t *testing.T) {
+	var th throttle
+	for i := 1; i < throttlePauseThreshold; i++ {
+		th.rateLimited(time.Hour)
+		th.unavailable(time.Hour)
+	}
+	if waits(&th) {
+		t.Fatalf("the workers paused before %d syncs of either kind", throttlePauseThreshold)
+	}
+	th.unavailable(time.Hour)
+	if !waits(&th) {
+		t.Fatalf("the workers didn't pause after %d unavailable syncs", throttlePauseThreshold)
+	}
+}
+
+func TestBackoffResetsThrottle(t *testing.T) {
+	c := &Controller{}
+	throttled := rateLimited(http.Header{"Retry-After": {"30"}})
+	for i := 1; i < throttlePauseThreshold; i++ {
+		c.backoff(unannotatedSecret(), throttled)
+	}
+	notFound := &gitlab.ErrorResponse{Response: &http.Response{StatusCode: http.StatusNotFound}}
+	if after, ok := c.backoff(unannotatedSecret(), notFound); ok {
+		t.Fatalf("backoff = %s, %v, want no backoff on a 404", after, ok)
+	}
+	c.backoff(unannotatedSecret(), throttled)
+	if waits(&c.throttle) {
+		t.Errorf("the workers paused although gitlab answered a 404 in between")
+	}
+}
+
+func TestBackoffCaps429(t *testing.T) {
+	defer func(max time.Duration) { max429Backoff = max }(max429Backoff)
+	max429Backoff = 10 * time.Minute
+
+	c := &Controller{}
+	err := rateLimited(http.Header{"Retry-After": {"86400"}})
+	if after, ok := c.backoff(unannotatedSecret(), err); !ok || after != max429Backoff {
+		t.Errorf("backoff = %s, %v, want %s, true", after, ok, max429Backoff)
+	}
+	err = rateLimited(http.Header{"Retry-After": {"30"}})
+	if after, ok := c.backoff(unannotatedSecret(), err); !ok || after != 30*time.Second {
+		t.Errorf("backoff = %s, %v, want 30s, true", after, ok)
+	}
+}
+
+func TestBackoffUnavailable(t *testing.T) {
+	defer func(pause time.Duration) { maintenancePause = pause }(maintenancePause)
+	maintenancePause = time.Hour
+
+	c := &Controller{}
+	err := &gitlab.ErrorResponse{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}}
+	for i := 0; i < throttlePauseThreshold; i++ {
+		if after, ok := c.backoff(unannotatedSecret(), err); !ok || after != time.Hour {
+			t.Fatalf("backoff = %s, %v, want the maintenance pause", after, ok)
+		}
+	}
+	if !waits(&c.throttle) {
+		t.Errorf("the workers didn't pause while gitlab is unavailable")
+	}
+}
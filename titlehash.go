@@ -0,0 +1,75 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// titleHashPattern matches the hash -title-embed-hash adds to the titles
+var titleHashPattern = regexp.MustCompile(`\[([0-9a-f]{8})\]`)
+
+// keyParamsHash returns a short hash of the parameters the controller manages
+// on a deploy key
+func keyParamsHash(project, fingerprint string, canPush bool) string {
+	h := fnv.New32a()
+	h.Write([]byte(normalizeProjectPath(project) + "\x00" + fingerprint + "\x00" + strconv.FormatBool(canPush)))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// embedTitleHash suffixes the title with the hash of the key parameters,
+// truncating the title so the hash is kept
+func embedTitleHash(title, project, fingerprint string, canPush bool) string {
+	suffix := " [" + keyParamsHash(project, fingerprint, canPush) + "]"
+	if len(title)+len(suffix) > maxDeployKeyTitleLength {
+		title = title[:maxDeployKeyTitleLength-len(suffix)]
+	}
+	return title + suffix
+}
+
+// embeddedTitleHash returns the last hash embedded in the title, empty when
+// it has none
+func embeddedTitleHash(title string) string {
+	matches := titleHashPattern.FindAllStringSubmatch(title, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[len(matches)-1][1]
+}
+
+// titleDrifted reports whether the hash embedded in the title of the deploy
+// key doesn't match its parameters, i.e. the title, key or push permission
+// was changed outside of the controller. Titles without a hash, e.g. of the
+// keys created before -title-embed-hash was set, didn't drift.
+func titleDrifted(title, project, fingerprint string, canPush bool) bool {
+	hash := embeddedTitleHash(title)
+	return hash != "" && hash != keyParamsHash(project, fingerprint, canPush)
+}
+
+// keyProject returns the project path the deploy key of the secret was
+// created in
+func keyProject(secret *corev1.Secret) string {
+	if path, ok := secret.Annotations[projectPathLabelName]; ok {
+		return path
+	}
+	return projectPath(secret)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestTitleHash(t *testing.T) {
+	title := embedTitleHash("Flux [00000000]", "Group/App", "SHA256:key", true)
+	hash := keyParamsHash("group/app", "SHA256:key", true)
+	if title != "Flux [00000000] ["+hash+"]" || embeddedTitleHash(title) != hash {
+		t.Errorf("embedTitleHash = %q, want the hash of the parameters %s last", title, hash)
+	}
+	if long := embedTitleHash(strings.Repeat("a", maxDeployKeyTitleLength), "group/app", "SHA256:key", true); len(long) != maxDeployKeyTitleLength || embeddedTitleHash(long) != hash {
+		t.Errorf("embedTitleHash of a long title = %q, want it truncated with the hash kept", long)
+	}
+
+	for _, test := range []struct {
+		name    string
+		title   string
+		drifted bool
+	}{
+		{"same parameters", title, false},
+		{"without hash", "Flux", false},
+		{"push changed", embedTitleHash("Flux", "group/app", "SHA256:key", false), true},
+		{"key changed", embedTitleHash("Flux", "group/app", "SHA256:other", true), true},
+	} {
+		if got := titleDrifted(test.title, "group/app", "SHA256:key", true); got != test.drifted {
+			t.Errorf("%s: titleDrifted = %v, want %v", test.name, got, test.drifted)
+		}
+	}
+}
+
+func TestSyncTitleHash(t *testing.T) {
+	defer func(embed bool) { titleEmbedHash = embed }(titleEmbedHash)
+	titleEmbedHash = true
+
+	secret := identitySecret(t)
+	s := newTestSync(t, newFakeGitlab(), secret)
+	if err := s.syncSecret(context.Background(), secret); err != nil {
+		t.Fatalf("syncSecret: %s", err.Error())
+	}
+	key := s.gitlab.keys[1]
+	fingerprint := s.secret(t, secret).Annotations[deployKeyFingerprintLabelName]
+	if key == nil || embeddedTitleHash(key.Title) != keyParamsHash("group/app", fingerprint, true) {
+		t.Errorf("deploy key = %+v, want the hash of its parameters in its title", key)
+	}
+	if keyProject(s.secret(t, secret)) != "group/app" {
+		t.Errorf("keyProject = %q, want the recorded project path", keyProject(s.secret(t, secret)))
+	}
+}